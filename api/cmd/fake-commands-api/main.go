@@ -0,0 +1,121 @@
+// fake-commands-api serves the command endpoints of the DIMO devices API, so the vehicle commands page can be
+// exercised locally. Point DEVICE_COMMANDS_API_URL at http://localhost:8090/v1. Commands are accepted right away,
+// stay pending for -delay and then complete, except for a -fail-rate share of them which fail.
+// Authorization headers are required but not verified.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	addr     = flag.String("addr", ":8090", "address to listen on")
+	delay    = flag.Duration("delay", 5*time.Second, "time a command stays pending")
+	failRate = flag.Float64("fail-rate", 0.2, "share of commands that fail, between 0 and 1")
+)
+
+// commandPaths are the commands the devices API accepts, relative to /v1/vehicle/{tokenId}/commands/
+var commandPaths = map[string]bool{
+	"doors/lock":   true,
+	"doors/unlock": true,
+	"trunk/open":   true,
+	"frunk/open":   true,
+	"charge/start": true,
+	"charge/stop":  true,
+}
+
+type command struct {
+	tokenID  string
+	path     string
+	doneAt   time.Time
+	succeeds bool
+}
+
+var (
+	mu       sync.Mutex
+	commands = map[string]command{}
+)
+
+func main() {
+	flag.Parse()
+
+	http.HandleFunc("POST /v1/vehicle/{tokenId}/commands/{group}/{action}", handleSendCommand)
+	http.HandleFunc("GET /v1/vehicle/{tokenId}/commands/{requestId}", handleCommandStatus)
+
+	log.Info().Msgf("Fake commands API listening on %s", *addr)
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		log.Fatal().Err(err).Msg("Server failed")
+	}
+}
+
+func handleSendCommand(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		http.Error(w, "missing privilege token", http.StatusUnauthorized)
+		return
+	}
+
+	path := r.PathValue("group") + "/" + r.PathValue("action")
+	if !commandPaths[path] {
+		http.Error(w, "unknown command "+path, http.StatusNotFound)
+		return
+	}
+
+	requestID := uuid.New().String()
+	mu.Lock()
+	commands[requestID] = command{
+		tokenID:  r.PathValue("tokenId"),
+		path:     path,
+		doneAt:   time.Now().Add(*delay),
+		succeeds: rand.Float64() >= *failRate,
+	}
+	mu.Unlock()
+
+	log.Info().Str("tokenId", r.PathValue("tokenId")).Str("command", path).Str("requestId", requestID).Msg("Command accepted")
+	writeJSON(w, map[string]string{"requestId": requestID})
+}
+
+func handleCommandStatus(w http.ResponseWriter, r *http.Request) {
+	if !authorized(r) {
+		http.Error(w, "missing privilege token", http.StatusUnauthorized)
+		return
+	}
+
+	mu.Lock()
+	cmd, ok := commands[r.PathValue("requestId")]
+	mu.Unlock()
+	if !ok || cmd.tokenID != r.PathValue("tokenId") {
+		http.Error(w, "command not found", http.StatusNotFound)
+		return
+	}
+
+	response := map[string]string{"id": r.PathValue("requestId"), "status": "Pending"}
+	switch {
+	case time.Now().Before(cmd.doneAt):
+	case cmd.succeeds:
+		response["status"] = "Complete"
+	default:
+		response["status"] = "Failed"
+		response["message"] = "vehicle did not respond to " + cmd.path
+	}
+	writeJSON(w, response)
+}
+
+func authorized(r *http.Request) bool {
+	return strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("Failed to write response")
+	}
+}
@@ -0,0 +1,194 @@
+// fake-telemetry-api serves a small subset of the DIMO telemetry GraphQL API with synthetic data, so features
+// polling telemetry (geofences, alerts, live signals) can be exercised locally. Point TELEMETRY_API_URL at
+// http://localhost:8089/query. Every vehicle drives in a circle around -lat/-lon, so it enters and leaves
+// places saved near that point. Authorization headers are accepted but not verified.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	addr     = flag.String("addr", ":8089", "address to listen on")
+	lat      = flag.Float64("lat", 52.52437, "latitude of the center of the route")
+	lon      = flag.Float64("lon", 13.41053, "longitude of the center of the route")
+	radiusKm = flag.Float64("radius-km", 2, "radius of the circular route in km")
+	period   = flag.Duration("period", 10*time.Minute, "time to complete one lap")
+)
+
+var (
+	tokenIDPattern        = regexp.MustCompile(`tokenId:\s*(\d+)`)
+	latestFieldPattern    = regexp.MustCompile(`(\w+)\s*\{\s*timestamp\s+value\s*\}`)
+	intervalPattern       = regexp.MustCompile(`interval:\s*"(\d+)([smhd])"`)
+	fromPattern           = regexp.MustCompile(`from:\s*"([^"]+)"`)
+	toPattern             = regexp.MustCompile(`to:\s*"([^"]+)"`)
+	aggregateFieldRegexp  = regexp.MustCompile(`(?:(\w+)\s*:\s*)?(\w+)\s*\(\s*agg:\s*\w+\s*\)`)
+	availableSignalsQuery = regexp.MustCompile(`availableSignals`)
+	signalsLatestQuery    = regexp.MustCompile(`signalsLatest`)
+	signalsQuery          = regexp.MustCompile(`signals\s*\(`)
+)
+
+// odometers count up from when the server started
+var startedAt = time.Now()
+
+var availableSignals = []string{
+	"speed",
+	"currentLocationLatitude",
+	"currentLocationLongitude",
+	"powertrainTransmissionTravelledDistance",
+	"powertrainCombustionEngineECT",
+	"lowVoltageBatteryCurrentVoltage",
+	"exteriorAirTemperature",
+}
+
+func main() {
+	flag.Parse()
+
+	http.HandleFunc("/query", handleQuery)
+
+	log.Info().Msgf("Fake telemetry API listening on %s", *addr)
+	if err := http.ListenAndServe(*addr, nil); err != nil {
+		log.Fatal().Err(err).Msg("Server failed")
+	}
+}
+
+func handleQuery(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var req struct {
+		Query string `json:"query"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, "invalid graphql request", http.StatusBadRequest)
+		return
+	}
+
+	var tokenID int64
+	if match := tokenIDPattern.FindStringSubmatch(req.Query); match != nil {
+		tokenID, _ = strconv.ParseInt(match[1], 10, 64)
+	}
+
+	data := map[string]any{}
+	switch {
+	case availableSignalsQuery.MatchString(req.Query):
+		data["availableSignals"] = availableSignals
+	case signalsLatestQuery.MatchString(req.Query):
+		data["signalsLatest"] = latestSignals(req.Query, tokenID)
+	case signalsQuery.MatchString(req.Query):
+		signals, err := historicalSignals(req.Query, tokenID)
+		if err != nil {
+			writeJSON(w, map[string]any{"errors": []map[string]any{{"message": err.Error()}}})
+			return
+		}
+		data["signals"] = signals
+	default:
+		writeJSON(w, map[string]any{"errors": []map[string]any{{"message": "unsupported query"}}})
+		return
+	}
+
+	writeJSON(w, map[string]any{"data": data})
+}
+
+func latestSignals(query string, tokenID int64) map[string]any {
+	now := time.Now().UTC()
+	result := map[string]any{}
+	for _, match := range latestFieldPattern.FindAllStringSubmatch(query, -1) {
+		name := match[1]
+		result[name] = map[string]any{
+			"timestamp": now.Format(time.RFC3339),
+			"value":     signalValue(name, tokenID, now),
+		}
+	}
+	return result
+}
+
+func historicalSignals(query string, tokenID int64) ([]map[string]any, error) {
+	intervalMatch := intervalPattern.FindStringSubmatch(query)
+	fromMatch := fromPattern.FindStringSubmatch(query)
+	toMatch := toPattern.FindStringSubmatch(query)
+	if intervalMatch == nil || fromMatch == nil || toMatch == nil {
+		return nil, fmt.Errorf("interval, from and to are required")
+	}
+
+	amount, _ := strconv.Atoi(intervalMatch[1])
+	unit := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour}[intervalMatch[2]]
+	interval := time.Duration(amount) * unit
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid interval")
+	}
+
+	from, err := time.Parse(time.RFC3339, fromMatch[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid from: %w", err)
+	}
+	to, err := time.Parse(time.RFC3339, toMatch[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid to: %w", err)
+	}
+	if to.Sub(from)/interval > 10000 {
+		return nil, fmt.Errorf("too many buckets")
+	}
+
+	fields := aggregateFieldRegexp.FindAllStringSubmatch(query, -1)
+	signals := make([]map[string]any, 0)
+	for bucket := from; bucket.Before(to); bucket = bucket.Add(interval) {
+		row := map[string]any{"timestamp": bucket.Format(time.RFC3339)}
+		for _, field := range fields {
+			alias, name := field[1], field[2]
+			if alias == "" {
+				alias = name
+			}
+			row[alias] = signalValue(name, tokenID, bucket)
+		}
+		signals = append(signals, row)
+	}
+	return signals, nil
+}
+
+// signalValue derives a deterministic value for the signal of the vehicle at time t
+func signalValue(name string, tokenID int64, t time.Time) any {
+	// vehicles start at different points of the lap
+	phase := float64(tokenID%360) * math.Pi / 180
+	angle := 2*math.Pi*float64(t.UnixNano()%int64(*period))/float64(*period) + phase
+	lapKm := 2 * math.Pi * *radiusKm
+
+	switch name {
+	case "currentLocationLatitude":
+		return *lat + (*radiusKm/111.32)*math.Sin(angle)
+	case "currentLocationLongitude":
+		return *lon + (*radiusKm/(111.32*math.Cos(*lat*math.Pi/180)))*math.Cos(angle)
+	case "speed":
+		return lapKm / period.Hours()
+	case "powertrainTransmissionTravelledDistance":
+		laps := float64(t.Sub(startedAt)) / float64(*period)
+		return 10000 + math.Max(0, laps*lapKm)
+	case "powertrainCombustionEngineECT":
+		return 90 + 5*math.Sin(angle)
+	case "lowVoltageBatteryCurrentVoltage":
+		return 12.4 + 0.6*math.Sin(angle)
+	case "exteriorAirTemperature":
+		return 15 + 10*math.Sin(2*math.Pi*float64(t.Hour())/24)
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Error().Err(err).Msg("Failed to write response")
+	}
+}
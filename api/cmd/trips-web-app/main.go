@@ -13,6 +13,7 @@ import (
 	"github.com/DIMO-Network/shared"
 	"github.com/dimo-network/trips-web-app/api/internal/config"
 	"github.com/dimo-network/trips-web-app/api/internal/controllers"
+	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/template/handlebars/v2"
@@ -62,10 +63,42 @@ func main() {
 	engine := handlebars.New("./views", ".hbs")
 
 	ac := controllers.NewAccountController(&settings, &logger)
-	vc := controllers.NewVehiclesController(&settings, &logger)
-	tc := controllers.NewTripsController(&settings, &logger)
-	st := controllers.NewStreamrController(&settings, &logger)
+	vc := controllers.NewVehiclesController(&settings, &logger, controllers.NewSignalPoller(&settings, &logger))
+	geocoder, err := controllers.NewGeocoder(&settings)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not create geocoder")
+	}
+
+	tc := controllers.NewTripsController(&settings, &logger, geocoder)
+	pc := controllers.NewPlacesController(&settings, &logger, &tc)
+	vdc := controllers.NewVehicleDetailController(&settings, &logger, &tc)
+	alc := controllers.NewAlertsController(&settings, &logger)
+	wc := controllers.NewWebhooksController(&settings, &logger)
+	cc := controllers.NewCommandsController(&settings, &logger)
+	crc := controllers.NewCredentialsController(&settings, &logger)
+	hc, err := controllers.NewDeviceHealthController(&settings, &logger)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not parse signal staleness thresholds")
+	}
+
+	var streamHub *controllers.StreamHub
+	var streamRecorder *controllers.StreamRecorder
+	streamSource, err := controllers.NewStreamSource(&settings)
+	if err != nil {
+		logger.Warn().Err(err).Msg("Live streams are disabled")
+	} else {
+		streamHub = controllers.NewStreamHub(streamSource, &logger)
+		streamRecorder, err = controllers.NewStreamRecorder(settings.StreamRecordingsDir, streamHub, &logger)
+		if err != nil {
+			log.Fatal().Err(err).Msg("could not load stream recordings")
+		}
+	}
+	st := controllers.NewStreamrController(&settings, &logger, streamHub, streamRecorder)
 	sc := controllers.NewSettingsController(&settings, &logger)
+	authProvider, err := controllers.NewAuthProvider(&settings)
+	if err != nil {
+		log.Fatal().Err(err).Msg("could not create auth provider")
+	}
 
 	app := fiber.New(fiber.Config{
 		ErrorHandler:          ErrorHandler,
@@ -79,16 +112,36 @@ func main() {
 		AllowHeaders:     "Origin, Content-Type, Accept, Authorization",
 		AllowCredentials: true,
 	}))
+	app.Use(controllers.CSRFMiddleware(&settings))
 
 	// View routes (protected)
 	app.Get("/account", controllers.AuthMiddleware(), ac.MyAccount)
+	app.Get("/account/sessions", controllers.AuthMiddleware(), controllers.HandleSessions)
 	app.Get("/vehicles/me", controllers.AuthMiddleware(), vc.HandleGetVehicles)
+	app.Get("/vehicles/:tokenid", controllers.AuthMiddleware(), vdc.HandleVehicleDetail)
 	app.Get("/vehicles/:tokenid/signals", controllers.AuthMiddleware(), vc.HandleVehicleSignals)
 	app.Get("/vehicles/:tokenid/history", vc.HandleGetHistoricalData)
+	app.Get("/vehicles/:tokenid/signals/live", controllers.AuthMiddleware(), vc.HandleLiveSignalsUpgrade, websocket.New(vc.HandleLiveSignals))
+	app.Get("/api/vehicles/:tokenid/signals/available", controllers.AuthMiddleware(), vc.HandleAvailableSignals)
+	app.Post("/api/vehicles/me/refresh", controllers.AuthMiddleware(), vc.HandleRefreshVehicles)
+	app.Get("/api/vehicles/:tokenid/completeness", controllers.AuthMiddleware(), vc.HandleCompletenessJSON)
 
 	app.Get("/vehicles/:tokenid/trips", controllers.AuthMiddleware(), tc.HandleTripsList)
+	app.Get("/vehicles/:tokenid/logbook", controllers.AuthMiddleware(), tc.HandleLogbook)
 	app.Get("/give-feedback", controllers.AuthMiddleware(), vc.HandleGiveFeedback(&settings))
 	app.Get("/streamr", controllers.AuthMiddleware(), st.GetStreamr)
+	app.Get("/vehicles/:tokenid/live", controllers.AuthMiddleware(), st.HandleLiveStream)
+	app.Get("/streams/recordings/:recordingID/replay", controllers.AuthMiddleware(), st.HandleReplayRecording)
+	app.Get("/streams/recordings/:recordingID/export", controllers.AuthMiddleware(), st.HandleExportRecording)
+	app.Get("/places", controllers.AuthMiddleware(), pc.HandlePlaces)
+	app.Get("/places/:placeID/visits", controllers.AuthMiddleware(), pc.HandlePlaceVisits)
+	app.Get("/alerts", controllers.AuthMiddleware(), alc.HandleAlerts)
+	app.Get("/fleet/health", controllers.AuthMiddleware(), hc.HandleFleetHealth)
+	app.Get("/vehicles/:tokenid/health", controllers.AuthMiddleware(), hc.HandleVehicleHealth)
+	app.Get("/vehicles/:tokenid/completeness", controllers.AuthMiddleware(), vc.HandleCompleteness)
+	app.Get("/webhooks/inbox", controllers.AuthMiddleware(), wc.HandleWebhookInbox)
+	app.Get("/vehicles/:tokenid/commands", controllers.AuthMiddleware(), cc.HandleCommandsPage)
+	app.Get("/vehicles/:tokenid/credentials", controllers.AuthMiddleware(), crc.HandleCredentials)
 
 	// API routes called via Javascript fetch
 	app.Get("/api/trip/:tripID", controllers.AuthMiddleware(), func(c *fiber.Ctx) error {
@@ -116,17 +169,51 @@ func main() {
 
 		return tc.HandleMapDataForTrip(c, &settings, tripID, startTime, endTime, estimatedStart)
 	})
+	app.Post("/api/trip/:tripID/purpose", controllers.AuthMiddleware(), tc.HandleSetTripPurpose)
+	app.Get("/api/places", controllers.AuthMiddleware(), pc.HandleListPlaces)
+	app.Post("/api/places", controllers.AuthMiddleware(), pc.HandleCreatePlace)
+	app.Delete("/api/places/:placeID", controllers.AuthMiddleware(), pc.HandleDeletePlace)
+	app.Get("/api/alerts", controllers.AuthMiddleware(), alc.HandleListAlerts)
+	app.Get("/api/geofences/subscriptions", controllers.AuthMiddleware(), alc.HandleListGeofenceSubscriptions)
+	app.Post("/api/geofences/subscriptions", controllers.AuthMiddleware(), alc.HandleGeofenceSubscribe)
+	app.Delete("/api/geofences/subscriptions/:tokenid", controllers.AuthMiddleware(), alc.HandleGeofenceUnsubscribe)
+	app.Get("/api/webhooks", controllers.AuthMiddleware(), wc.HandleListWebhooks)
+	app.Get("/api/webhooks/subscriptions/:tokenid", controllers.AuthMiddleware(), wc.HandleListSubscriptions)
+	app.Post("/api/webhooks/subscriptions/:tokenid/event/:eventID", controllers.AuthMiddleware(), wc.HandleSubscribe)
+	app.Delete("/api/webhooks/subscriptions/:tokenid/event/:eventID", controllers.AuthMiddleware(), wc.HandleUnsubscribe)
+	app.Post("/api/webhooks/events/:eventID/replay", controllers.AuthMiddleware(), wc.HandleReplayWebhookEvent)
+	app.Get("/api/vehicles/:tokenid/commands", controllers.AuthMiddleware(), cc.HandleListCommands)
+	app.Post("/api/vehicles/:tokenid/commands/:command", controllers.AuthMiddleware(), cc.HandleSendCommand)
+	app.Get("/api/vehicles/:tokenid/credentials/:kind", controllers.AuthMiddleware(), crc.HandleDownloadCredential)
+	app.Post("/api/vehicles/:tokenid/credentials/vin", controllers.AuthMiddleware(), crc.HandleIssueVINCredential)
+	app.Post("/api/credentials/verify", controllers.AuthMiddleware(), crc.HandleVerifyCredential)
+	app.Post("/api/session/extend", controllers.AuthMiddleware(), controllers.HandleExtendSession)
+	app.Post("/api/session/wallets", controllers.AuthMiddleware(), controllers.HandleLinkWallet(authProvider))
+	app.Delete("/api/session/wallets/:address", controllers.AuthMiddleware(), controllers.HandleUnlinkWallet)
+	app.Delete("/api/sessions/:handle", controllers.AuthMiddleware(), controllers.HandleRevokeSession(&settings))
+	app.Get("/api/streams/:tokenid/recordings", controllers.AuthMiddleware(), st.HandleListRecordings)
+	app.Post("/api/streams/:tokenid/recordings", controllers.AuthMiddleware(), st.HandleStartRecording)
+	app.Post("/api/streams/recordings/:recordingID/stop", controllers.AuthMiddleware(), st.HandleStopRecording)
+	app.Delete("/api/streams/recordings/:recordingID", controllers.AuthMiddleware(), st.HandleDeleteRecording)
+	app.Get("/api/alerts/rules", controllers.AuthMiddleware(), alc.HandleListAlertRules)
+	app.Post("/api/alerts/rules", controllers.AuthMiddleware(), alc.HandleCreateAlertRule)
+	app.Delete("/api/alerts/rules/:ruleID", controllers.AuthMiddleware(), alc.HandleDeleteAlertRule)
 	// used by /web frontend in lit for the login
 	app.Get("/v1/public/settings", sc.GetPublicSettings)
 
 	// Public Routes
-	app.Post("/auth/web3/generate_challenge", func(c *fiber.Ctx) error {
-		return controllers.HandleGenerateChallenge(c, &settings)
-	})
-	app.Post("/auth/web3/submit_challenge", func(c *fiber.Ctx) error {
-		return controllers.HandleSubmitChallenge(c, &settings)
-	})
-	app.Post("/auth/start_session", controllers.PersistJwtHandler)
+	app.Post("/auth/web3/generate_challenge", controllers.HandleGenerateChallenge(authProvider))
+	app.Post("/auth/web3/submit_challenge", controllers.HandleSubmitChallenge(&settings, authProvider))
+	// the JWT of DIMO's login page, local sign-ins get theirs from submit_challenge and never skip the challenge
+	if _, ok := authProvider.(*controllers.DIMOAuthProvider); ok {
+		app.Post("/auth/start_session", controllers.PersistJwtHandler(&settings, authProvider))
+	}
+	app.Post("/auth/logout", controllers.HandleLogout(&settings))
+	// polled by session.js, which renews the session before it runs out
+	app.Get("/api/session", controllers.HandleSessionStatus)
+	app.Post("/api/session/renew", controllers.HandleRenewSession(&settings, authProvider))
+	// called by DIMO, authenticated by the shared-secret signature
+	app.Post("/webhooks/receive", wc.HandleReceiveWebhook)
 
 	app.Post("/api/generate-token/:tokenID", controllers.AuthMiddleware(), func(c *fiber.Ctx) error {
 		tokenID, err := strconv.ParseInt(c.Params("tokenID"), 10, 64)
@@ -134,8 +221,17 @@ func main() {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
 		}
 
-		token, err := controllers.RequestPriviledgeToken(c, &settings, tokenID)
+		privileges, err := controllers.ParsePrivileges(c.Query("privileges", "1"))
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		token, err := controllers.RequestPriviledgeToken(c, &settings, tokenID, privileges)
 		if err != nil {
+			var missing *controllers.MissingPrivilegesError
+			if errors.As(err, &missing) {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Failed to generate privilege token", "details": err.Error()})
+			}
 			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to generate privilege token", "details": err.Error()})
 		}
 
@@ -169,6 +265,31 @@ func main() {
 	log.Info().Msgf("Starting server on port %s", settings.Port)
 	runFiber(gCtx, app, ":"+settings.Port, group, settings.UseDevCerts)
 
+	if streamHub != nil {
+		group.Go(func() error {
+			<-gCtx.Done()
+			streamHub.Close()
+			return nil
+		})
+	}
+
+	group.Go(func() error {
+		controllers.PrivilegeTokens.Run(gCtx)
+		return nil
+	})
+
+	alertDispatcher := controllers.NewAlertDispatcher(&settings, &logger)
+	geofenceWorker := controllers.NewGeofenceWorker(&settings, &logger, alertDispatcher)
+	group.Go(func() error {
+		geofenceWorker.Run(gCtx)
+		return nil
+	})
+	alertRuleWorker := controllers.NewAlertRuleWorker(&settings, &logger, alertDispatcher)
+	group.Go(func() error {
+		alertRuleWorker.Run(gCtx)
+		return nil
+	})
+
 	if err := group.Wait(); err != nil {
 		logger.Fatal().Err(err).Msg("Server failed.")
 	}
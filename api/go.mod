@@ -6,6 +6,10 @@ toolchain go1.23.1
 
 require (
 	github.com/DIMO-Network/shared v0.12.10
+	github.com/ethereum/go-ethereum v1.15.7
+	github.com/fasthttp/websocket v1.5.8
+	github.com/go-pdf/fpdf v0.9.0
+	github.com/gofiber/contrib/websocket v1.3.4
 	github.com/gofiber/fiber/v2 v2.52.6
 	github.com/gofiber/template/handlebars/v2 v2.1.11
 	github.com/golang-jwt/jwt/v5 v5.2.2
@@ -27,7 +31,6 @@ require (
 	github.com/aws/aws-sdk-go-v2/service/kms v1.38.2 // indirect
 	github.com/aws/smithy-go v1.22.3 // indirect
 	github.com/aymerick/raymond v2.0.2+incompatible // indirect
-	github.com/ethereum/go-ethereum v1.15.7 // indirect
 	github.com/gofiber/template v1.8.3 // indirect
 	github.com/gofiber/utils v1.1.0 // indirect
 	github.com/golang/protobuf v1.5.4 // indirect
@@ -39,11 +42,13 @@ require (
 	github.com/mattn/go-isatty v0.0.20 // indirect
 	github.com/mattn/go-runewidth v0.0.16 // indirect
 	github.com/rivo/uniseg v0.4.7 // indirect
+	github.com/savsgio/gotils v0.0.0-20240303185622-093b76447511 // indirect
 	github.com/sirupsen/logrus v1.9.3 // indirect
 	github.com/valyala/bytebufferpool v1.0.0 // indirect
 	github.com/valyala/fasthttp v1.60.0 // indirect
 	github.com/valyala/tcplisten v1.0.0 // indirect
 	golang.org/x/crypto v0.37.0 // indirect
+	golang.org/x/net v0.38.0 // indirect
 	golang.org/x/sys v0.32.0 // indirect
 	golang.org/x/text v0.24.0 // indirect
 	golang.org/x/time v0.11.0 // indirect
@@ -3,23 +3,53 @@ package config
 import "net/url"
 
 type Settings struct {
-	UseDevCerts               bool    `yaml:"USE_DEV_CERTS"`
-	ClientID                  string  `yaml:"CLIENT_ID"`
-	LoginURL                  url.URL `yaml:"LOGIN_URL"`
-	Domain                    string  `yaml:"DOMAIN"`
-	Scope                     string  `yaml:"SCOPE"`
-	ResponseType              string  `yaml:"RESPONSE_TYPE"`
-	GrantType                 string  `yaml:"GRANT_TYPE"`
-	AuthURL                   string  `yaml:"AUTH_URL"`
-	SubmitChallengeURL        string  `yaml:"SUBMIT_CHALLENGE_URL"`
-	IdentityAPIURL            string  `yaml:"IDENTITY_API_URL"`
-	TokenExchangeJWTKeySetURL string  `yaml:"TOKEN_EXCHANGE_JWK_KEY_SET_URL"`
-	TokenExchangeAPIURL       string  `yaml:"TOKEN_EXCHANGE_API_URL"`
-	PrivilegeNFTContractAddr  string  `yaml:"PRIVILEGE_NFT_CONTRACT_ADDR"`
-	Port                      string  `yaml:"PORT"`
-	LogLevel                  string  `yaml:"LOG_LEVEL"`
-	Environment               string  `yaml:"ENVIRONMENT"`
-	TripsAPIBaseURL           string  `yaml:"TRIPS_API_BASE_URL"`
-	UsersAPIBaseURL           string  `yaml:"USERS_API_BASE_URL"`
-	TelemetryAPIURL           string  `yaml:"TELEMETRY_API_URL"`
+	UseDevCerts                  bool    `yaml:"USE_DEV_CERTS"`
+	ClientID                     string  `yaml:"CLIENT_ID"`
+	LoginURL                     url.URL `yaml:"LOGIN_URL"`
+	Domain                       string  `yaml:"DOMAIN"`
+	Scope                        string  `yaml:"SCOPE"`
+	ResponseType                 string  `yaml:"RESPONSE_TYPE"`
+	GrantType                    string  `yaml:"GRANT_TYPE"`
+	AuthURL                      string  `yaml:"AUTH_URL"`
+	SubmitChallengeURL           string  `yaml:"SUBMIT_CHALLENGE_URL"`
+	AuthProvider                 string  `yaml:"AUTH_PROVIDER"`
+	LocalAuthURI                 string  `yaml:"LOCAL_AUTH_URI"`
+	LocalAuthChainID             int     `yaml:"LOCAL_AUTH_CHAIN_ID"`
+	IdentityAPIURL               string  `yaml:"IDENTITY_API_URL"`
+	TokenExchangeJWTKeySetURL    string  `yaml:"TOKEN_EXCHANGE_JWK_KEY_SET_URL"`
+	TokenExchangeAPIURL          string  `yaml:"TOKEN_EXCHANGE_API_URL"`
+	PrivilegeNFTContractAddr     string  `yaml:"PRIVILEGE_NFT_CONTRACT_ADDR"`
+	Port                         string  `yaml:"PORT"`
+	LogLevel                     string  `yaml:"LOG_LEVEL"`
+	Environment                  string  `yaml:"ENVIRONMENT"`
+	TripsAPIBaseURL              string  `yaml:"TRIPS_API_BASE_URL"`
+	UsersAPIBaseURL              string  `yaml:"USERS_API_BASE_URL"`
+	TelemetryAPIURL              string  `yaml:"TELEMETRY_API_URL"`
+	WebhooksAPIURL               string  `yaml:"WEBHOOKS_API_URL"`
+	DeviceCommandsAPIURL         string  `yaml:"DEVICE_COMMANDS_API_URL"`
+	AttestationAPIURL            string  `yaml:"ATTESTATION_API_URL"`
+	VCIssuerAddress              string  `yaml:"VC_ISSUER_ADDRESS"`
+	SessionCookieDomain          string  `yaml:"SESSION_COOKIE_DOMAIN"`
+	SessionCookieInsecure        bool    `yaml:"SESSION_COOKIE_INSECURE"`
+	CSRFTrustedOrigins           string  `yaml:"CSRF_TRUSTED_ORIGINS"`
+	WebhookReceiverSecret        string  `yaml:"WEBHOOK_RECEIVER_SECRET"`
+	WebhookReplayAllowedHosts    string  `yaml:"WEBHOOK_REPLAY_ALLOWED_HOSTS"`
+	StreamSource                 string  `yaml:"STREAM_SOURCE"`
+	StreamrBrokerURL             string  `yaml:"STREAMR_BROKER_URL"`
+	StreamrAPIKey                string  `yaml:"STREAMR_API_KEY"`
+	SignalsPollIntervalSeconds   int     `yaml:"SIGNALS_POLL_INTERVAL_SECONDS"`
+	SignalStaleAfterSeconds      int     `yaml:"SIGNAL_STALE_AFTER_SECONDS"`
+	SignalStaleThresholds        string  `yaml:"SIGNAL_STALE_THRESHOLDS"`
+	DeviceOfflineAfterSeconds    int     `yaml:"DEVICE_OFFLINE_AFTER_SECONDS"`
+	StreamRecordingsDir          string  `yaml:"STREAM_RECORDINGS_DIR"`
+	GeocoderBackend              string  `yaml:"GEOCODER_BACKEND"`
+	GeocoderDatasetPath          string  `yaml:"GEOCODER_DATASET_PATH"`
+	NominatimURL                 string  `yaml:"NOMINATIM_URL"`
+	GeofencePollIntervalSeconds  int     `yaml:"GEOFENCE_POLL_INTERVAL_SECONDS"`
+	AlertRulePollIntervalSeconds int     `yaml:"ALERT_RULE_POLL_INTERVAL_SECONDS"`
+	SMTPHost                     string  `yaml:"SMTP_HOST"`
+	SMTPPort                     int     `yaml:"SMTP_PORT"`
+	SMTPUsername                 string  `yaml:"SMTP_USERNAME"`
+	SMTPPassword                 string  `yaml:"SMTP_PASSWORD"`
+	SMTPFrom                     string  `yaml:"SMTP_FROM"`
 }
@@ -0,0 +1,377 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	defaultAlertRulePollInterval = time.Minute
+
+	AlertRuleStateOK     = "ok"
+	AlertRuleStateFiring = "firing"
+
+	// maxAlertRuleDuration caps how far back the history is queried to confirm a sustained breach
+	maxAlertRuleDuration = 24 * time.Hour
+)
+
+var errAlertRuleSignedOut = errors.New("the session the rule was created with signed out, create it again to keep receiving alerts")
+
+var alertRuleOperators = map[string]func(value, threshold float64) bool{
+	"<":  func(value, threshold float64) bool { return value < threshold },
+	"<=": func(value, threshold float64) bool { return value <= threshold },
+	">":  func(value, threshold float64) bool { return value > threshold },
+	">=": func(value, threshold float64) bool { return value >= threshold },
+}
+
+// AlertRule fires when a signal of the vehicle crosses the threshold, eg. lowVoltageBatteryCurrentVoltage < 11.8 for 10 minutes
+type AlertRule struct {
+	ID        string  `json:"id"`
+	Owner     string  `json:"owner"`
+	TokenID   int64   `json:"tokenId"`
+	Signal    string  `json:"signal"`
+	Operator  string  `json:"operator"`
+	Threshold float64 `json:"threshold"`
+	// DurationSeconds is how long the condition has to hold before the rule fires, 0 fires on the first breach
+	DurationSeconds int `json:"durationSeconds"`
+	// Hysteresis is how far back past the threshold the value has to go before a firing rule resolves
+	Hysteresis float64 `json:"hysteresis"`
+	// CooldownSeconds is the minimum time between two triggers of the rule
+	CooldownSeconds int                `json:"cooldownSeconds"`
+	Target          NotificationTarget `json:"target"`
+	// AccessToken is the session JWT of the owner, used to exchange privilege tokens while they are offline.
+	// It is cleared when the session signs out.
+	AccessToken string `json:"-"`
+	// SessionID is the session AccessToken came from
+	SessionID string `json:"-"`
+	// ExpiresAt is the exp of AccessToken, the rule isn't evaluated after it until it is created again
+	ExpiresAt     time.Time `json:"expiresAt"`
+	CreatedAt     time.Time `json:"createdAt"`
+	State         string    `json:"state"`
+	LastValue     *float64  `json:"lastValue,omitempty"`
+	LastEvaluated time.Time `json:"lastEvaluated"`
+	LastTriggered time.Time `json:"lastTriggered"`
+	LastError     string    `json:"lastError,omitempty"`
+}
+
+func (r AlertRule) Validate() error {
+	if r.TokenID <= 0 {
+		return fmt.Errorf("invalid token ID")
+	}
+	if r.Signal == "" {
+		return fmt.Errorf("signal is required")
+	}
+	if _, ok := alertRuleOperators[r.Operator]; !ok {
+		return fmt.Errorf("operator must be one of <, <=, >, >=")
+	}
+	if r.DurationSeconds < 0 || time.Duration(r.DurationSeconds)*time.Second > maxAlertRuleDuration {
+		return fmt.Errorf("duration must be between 0 and %d seconds", int(maxAlertRuleDuration.Seconds()))
+	}
+	if r.Hysteresis < 0 {
+		return fmt.Errorf("hysteresis can't be negative")
+	}
+	if r.CooldownSeconds < 0 {
+		return fmt.Errorf("cooldown can't be negative")
+	}
+	return r.Target.Validate()
+}
+
+// Breached tells whether the value satisfies the rule's condition
+func (r AlertRule) Breached(value float64) bool {
+	return alertRuleOperators[r.Operator](value, r.Threshold)
+}
+
+// Resolved tells whether the value is back on the good side of the threshold, including the hysteresis margin
+func (r AlertRule) Resolved(value float64) bool {
+	if strings.HasPrefix(r.Operator, "<") {
+		return value > r.Threshold+r.Hysteresis
+	}
+	return value < r.Threshold-r.Hysteresis
+}
+
+// Condition describes the rule, eg. "coolant > 110 for 5m0s"
+func (r AlertRule) Condition() string {
+	condition := fmt.Sprintf("%s %s %s", r.Signal, r.Operator, strconv.FormatFloat(r.Threshold, 'f', -1, 64))
+	if r.DurationSeconds > 0 {
+		condition += fmt.Sprintf(" for %s", time.Duration(r.DurationSeconds)*time.Second)
+	}
+	return condition
+}
+
+// historyAggregate is the aggregation that proves the condition held over a whole window:
+// the maximum stayed below the threshold, or the minimum stayed above it
+func (r AlertRule) historyAggregate() string {
+	if strings.HasPrefix(r.Operator, "<") {
+		return "MAX"
+	}
+	return "MIN"
+}
+
+// AlertRuleStore holds the threshold rules and their evaluation state, in memory
+type AlertRuleStore struct {
+	mu    sync.RWMutex
+	rules map[string]*AlertRule
+}
+
+var AlertRules = NewAlertRuleStore()
+
+func NewAlertRuleStore() *AlertRuleStore {
+	return &AlertRuleStore{rules: make(map[string]*AlertRule)}
+}
+
+func (s *AlertRuleStore) Create(rule AlertRule) AlertRule {
+	rule.ID = uuid.New().String()
+	rule.Owner = strings.ToLower(rule.Owner)
+	rule.State = AlertRuleStateOK
+	rule.CreatedAt = time.Now().UTC()
+	rule.ExpiresAt, _ = jwtExpiry(rule.AccessToken)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules[rule.ID] = &rule
+
+	return rule
+}
+
+// Delete removes the rule if it belongs to the owner
+func (s *AlertRuleStore) Delete(owner, id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rule, ok := s.rules[id]
+	if !ok || rule.Owner != strings.ToLower(owner) {
+		return false
+	}
+	delete(s.rules, id)
+	return true
+}
+
+// List returns the rules of the owner, or all rules when owner is empty
+func (s *AlertRuleStore) List(owner string) []AlertRule {
+	owner = strings.ToLower(owner)
+
+	s.mu.RLock()
+	rules := make([]AlertRule, 0, len(s.rules))
+	for _, rule := range s.rules {
+		if owner == "" || rule.Owner == owner {
+			rules = append(rules, *rule)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(rules, func(i, j int) bool {
+		if rules[i].TokenID != rules[j].TokenID {
+			return rules[i].TokenID < rules[j].TokenID
+		}
+		return rules[i].CreatedAt.Before(rules[j].CreatedAt)
+	})
+	return rules
+}
+
+// update applies fn to the stored rule, a no-op when the rule was deleted meanwhile
+func (s *AlertRuleStore) update(id string, fn func(rule *AlertRule)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rule, ok := s.rules[id]; ok {
+		fn(rule)
+	}
+}
+
+// signOut stops the rules evaluated with a JWT of the session, or only with accessToken when it is given
+func (s *AlertRuleStore) signOut(sessionID, accessToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rule := range s.rules {
+		if rule.SessionID == sessionID && rule.AccessToken != "" && (accessToken == "" || rule.AccessToken == accessToken) {
+			rule.AccessToken = ""
+			rule.LastError = errAlertRuleSignedOut.Error()
+		}
+	}
+}
+
+// AlertRuleWorker evaluates threshold rules against the latest signals, confirming sustained breaches with the signal history
+type AlertRuleWorker struct {
+	settings   *config.Settings
+	logger     *zerolog.Logger
+	dispatcher *AlertDispatcher
+	interval   time.Duration
+}
+
+func NewAlertRuleWorker(settings *config.Settings, logger *zerolog.Logger, dispatcher *AlertDispatcher) *AlertRuleWorker {
+	interval := time.Duration(settings.AlertRulePollIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultAlertRulePollInterval
+	}
+	return &AlertRuleWorker{
+		settings:   settings,
+		logger:     logger,
+		dispatcher: dispatcher,
+		interval:   interval,
+	}
+}
+
+// Run polls until the context is cancelled
+func (w *AlertRuleWorker) Run(ctx context.Context) {
+	w.logger.Info().Dur("interval", w.interval).Msg("Starting alert rule worker")
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Poll(ctx)
+		}
+	}
+}
+
+// Poll evaluates every rule once, fetching the latest signals once per owner and vehicle
+func (w *AlertRuleWorker) Poll(ctx context.Context) {
+	groups := make(map[string][]AlertRule)
+	for _, rule := range AlertRules.List("") {
+		if rule.AccessToken == "" {
+			// signed out, see AlertRuleStore.signOut
+			continue
+		}
+		key := fmt.Sprintf("%s_%d", rule.Owner, rule.TokenID)
+		groups[key] = append(groups[key], rule)
+	}
+
+	for _, rules := range groups {
+		if err := w.evaluateVehicle(ctx, rules); err != nil {
+			w.logger.Warn().Err(err).Int64("tokenId", rules[0].TokenID).Msg("Failed to evaluate alert rules")
+			now := time.Now().UTC()
+			for _, rule := range rules {
+				AlertRules.update(rule.ID, func(r *AlertRule) {
+					r.LastEvaluated = now
+					r.LastError = err.Error()
+				})
+			}
+		}
+	}
+}
+
+// evaluateVehicle evaluates the rules of one owner for one vehicle
+func (w *AlertRuleWorker) evaluateVehicle(ctx context.Context, rules []AlertRule) error {
+	// rules are sorted by creation, the newest one carries the freshest session
+	newest := rules[len(rules)-1]
+	accessToken := newest.AccessToken
+	tokenID := rules[0].TokenID
+	if accessTokenExpired(newest.ExpiresAt) {
+		return fmt.Errorf("the session the rule was created with expired at %s, create it again to keep receiving alerts", newest.ExpiresAt.Format(time.RFC3339))
+	}
+
+	privilegeToken, err := PrivilegeTokens.Get(w.settings, accessToken, tokenID, SignalsPrivileges)
+	if err != nil {
+		return fmt.Errorf("could not get privilege token, the rule may need to be recreated: %w", err)
+	}
+
+	signalNames := make([]string, 0, len(rules))
+	seen := make(map[string]bool)
+	for _, rule := range rules {
+		if !seen[rule.Signal] {
+			seen[rule.Signal] = true
+			signalNames = append(signalNames, rule.Signal)
+		}
+	}
+
+	latest, err := FetchLatestNumericSignals(w.settings, tokenID, signalNames, privilegeToken)
+	if err != nil {
+		return err
+	}
+
+	for _, rule := range rules {
+		err := w.evaluateRule(ctx, rule, latest, privilegeToken)
+		AlertRules.update(rule.ID, func(r *AlertRule) {
+			r.LastEvaluated = time.Now().UTC()
+			r.LastError = ""
+			if err != nil {
+				r.LastError = err.Error()
+			}
+		})
+	}
+	return nil
+}
+
+func (w *AlertRuleWorker) evaluateRule(ctx context.Context, rule AlertRule, latest map[string]NumericSignal, privilegeToken string) error {
+	signal, ok := latest[rule.Signal]
+	if !ok {
+		return fmt.Errorf("no numeric value for %s", rule.Signal)
+	}
+	value := signal.Value
+	AlertRules.update(rule.ID, func(r *AlertRule) {
+		r.LastValue = &value
+	})
+
+	if rule.State == AlertRuleStateFiring {
+		if !rule.Resolved(value) {
+			return nil
+		}
+		AlertRules.update(rule.ID, func(r *AlertRule) {
+			r.State = AlertRuleStateOK
+		})
+		w.dispatch(ctx, rule, AlertTypeThresholdOK, value, signal.Timestamp)
+		return nil
+	}
+
+	if !rule.Breached(value) {
+		return nil
+	}
+
+	now := time.Now().UTC()
+	if rule.CooldownSeconds > 0 && now.Sub(rule.LastTriggered) < time.Duration(rule.CooldownSeconds)*time.Second {
+		return nil
+	}
+
+	if rule.DurationSeconds > 0 {
+		// polls can be sparse, so the history decides whether the condition held for the whole duration
+		from := now.Add(-time.Duration(rule.DurationSeconds) * time.Second)
+		aggregate, err := FetchSignalAggregate(w.settings, rule.TokenID, rule.Signal, rule.historyAggregate(), from, now, privilegeToken)
+		if err != nil {
+			return err
+		}
+		if aggregate == nil || !rule.Breached(*aggregate) {
+			return nil
+		}
+	}
+
+	AlertRules.update(rule.ID, func(r *AlertRule) {
+		r.State = AlertRuleStateFiring
+		r.LastTriggered = now
+	})
+	w.dispatch(ctx, rule, AlertTypeThresholdFire, value, signal.Timestamp)
+	return nil
+}
+
+func (w *AlertRuleWorker) dispatch(ctx context.Context, rule AlertRule, alertType string, value float64, timestamp time.Time) {
+	alert := Alert{
+		Owner:     rule.Owner,
+		TokenID:   rule.TokenID,
+		Type:      alertType,
+		RuleID:    rule.ID,
+		Signal:    rule.Signal,
+		Value:     &value,
+		Timestamp: timestamp,
+	}
+
+	formatted := strconv.FormatFloat(value, 'f', -1, 64)
+	if alertType == AlertTypeThresholdFire {
+		alert.Message = fmt.Sprintf("Vehicle %d: %s (now %s)", rule.TokenID, rule.Condition(), formatted)
+	} else {
+		alert.Message = fmt.Sprintf("Vehicle %d: %s resolved (now %s)", rule.TokenID, rule.Condition(), formatted)
+	}
+
+	w.logger.Info().Int64("tokenId", rule.TokenID).Str("ruleId", rule.ID).Str("type", alertType).Float64("value", value).Msg("Alert rule transition")
+	w.dispatcher.Dispatch(ctx, alert, rule.Target)
+}
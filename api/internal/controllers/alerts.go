@@ -0,0 +1,268 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	AlertTypeGeofenceEnter = "geofence.enter"
+	AlertTypeGeofenceExit  = "geofence.exit"
+	AlertTypeThresholdFire = "threshold.triggered"
+	AlertTypeThresholdOK   = "threshold.resolved"
+
+	// maxAlertsPerOwner caps the in-app feed, oldest alerts are dropped first
+	maxAlertsPerOwner = 500
+)
+
+// Alert is something noteworthy that happened to a vehicle, eg. it left a geofence
+type Alert struct {
+	ID        string    `json:"id"`
+	Owner     string    `json:"owner"`
+	TokenID   int64     `json:"tokenId"`
+	Type      string    `json:"type"`
+	Message   string    `json:"message"`
+	PlaceID   string    `json:"placeId,omitempty"`
+	PlaceName string    `json:"placeName,omitempty"`
+	Location  *LatLon   `json:"location,omitempty"`
+	RuleID    string    `json:"ruleId,omitempty"`
+	Signal    string    `json:"signal,omitempty"`
+	Value     *float64  `json:"value,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// NotificationTarget says where, besides the in-app feed, alerts of a subscription are delivered
+type NotificationTarget struct {
+	WebhookURL string `json:"webhookUrl,omitempty"`
+	Email      string `json:"email,omitempty"`
+}
+
+func (t NotificationTarget) Validate() error {
+	if t.Email != "" {
+		// a bare address only, it goes into the To header as is
+		if address, err := mail.ParseAddress(t.Email); err != nil || address.Address != t.Email {
+			return fmt.Errorf("invalid email address")
+		}
+	}
+	if t.WebhookURL == "" {
+		return nil
+	}
+	return validateHTTPURL(t.WebhookURL)
+}
+
+// validateHTTPURL accepts absolute http(s) URLs only
+func validateHTTPURL(rawURL string) error {
+	if u, err := url.Parse(rawURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid webhook URL")
+	}
+	return nil
+}
+
+// accessTokenExpired tells whether the JWT a subscription or rule polls with has expired. The workers run on the JWT of
+// the session that created them, so they stop with it, at most sessionMaxLifetime after sign-in.
+func accessTokenExpired(expiresAt time.Time) bool {
+	return !expiresAt.IsZero() && !time.Now().Before(expiresAt)
+}
+
+// formatOptionalTime renders the time as RFC3339 for timeago.js, or nothing when it isn't set
+func formatOptionalTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+// Notifier delivers an alert through one channel. Notifiers skip targets they have nothing to deliver to.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, alert Alert, target NotificationTarget) error
+}
+
+// AlertStore is the in-app alert feed, kept in memory per owner
+type AlertStore struct {
+	mu     sync.RWMutex
+	alerts map[string][]Alert
+}
+
+var Alerts = NewAlertStore()
+
+func NewAlertStore() *AlertStore {
+	return &AlertStore{alerts: make(map[string][]Alert)}
+}
+
+func (s *AlertStore) Name() string {
+	return "in-app"
+}
+
+// Notify records the alert in the owner's feed
+func (s *AlertStore) Notify(_ context.Context, alert Alert, _ NotificationTarget) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	feed := append(s.alerts[alert.Owner], alert)
+	if len(feed) > maxAlertsPerOwner {
+		feed = feed[len(feed)-maxAlertsPerOwner:]
+	}
+	s.alerts[alert.Owner] = feed
+
+	return nil
+}
+
+// List returns up to limit alerts of the owner, newest first. A tokenID of 0 returns alerts of all vehicles.
+func (s *AlertStore) List(owner string, tokenID int64, limit int) []Alert {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	feed := s.alerts[strings.ToLower(owner)]
+	alerts := make([]Alert, 0)
+	for i := len(feed) - 1; i >= 0 && len(alerts) < limit; i-- {
+		if tokenID == 0 || feed[i].TokenID == tokenID {
+			alerts = append(alerts, feed[i])
+		}
+	}
+	return alerts
+}
+
+// WebhookNotifier POSTs the alert as JSON to the target's webhook URL, which has to be a public address
+type WebhookNotifier struct {
+	client *http.Client
+}
+
+func NewWebhookNotifier() *WebhookNotifier {
+	return &WebhookNotifier{client: publicHTTPClient(10 * time.Second)}
+}
+
+func (w *WebhookNotifier) Name() string {
+	return "webhook"
+}
+
+func (w *WebhookNotifier) Notify(ctx context.Context, alert Alert, target NotificationTarget) error {
+	if target.WebhookURL == "" {
+		return nil
+	}
+
+	payload, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", target.WebhookURL, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("webhook responded with status %d: %s", resp.StatusCode, string(body))
+	}
+	return nil
+}
+
+// SMTPNotifier emails the alert to the target's address
+type SMTPNotifier struct {
+	addr string
+	auth smtp.Auth
+	from string
+}
+
+// NewSMTPNotifier returns nil when no SMTP_HOST is configured
+func NewSMTPNotifier(settings *config.Settings) *SMTPNotifier {
+	if settings.SMTPHost == "" {
+		return nil
+	}
+
+	var auth smtp.Auth
+	if settings.SMTPUsername != "" {
+		auth = smtp.PlainAuth("", settings.SMTPUsername, settings.SMTPPassword, settings.SMTPHost)
+	}
+
+	return &SMTPNotifier{
+		addr: fmt.Sprintf("%s:%d", settings.SMTPHost, settings.SMTPPort),
+		auth: auth,
+		from: settings.SMTPFrom,
+	}
+}
+
+func (s *SMTPNotifier) Name() string {
+	return "smtp"
+}
+
+func (s *SMTPNotifier) Notify(_ context.Context, alert Alert, target NotificationTarget) error {
+	if target.Email == "" {
+		return nil
+	}
+	to, err := mail.ParseAddress(target.Email)
+	if err != nil {
+		return err
+	}
+
+	// the message names the user's places, line breaks in it must not start new headers
+	subject := mime.QEncoding.Encode("UTF-8", strings.NewReplacer("\r", " ", "\n", " ").Replace(
+		fmt.Sprintf("Vehicle %d: %s", alert.TokenID, alert.Message)))
+	body := fmt.Sprintf("%s\r\n\r\nVehicle: %d\r\nType: %s\r\nTime: %s\r\n",
+		alert.Message, alert.TokenID, alert.Type, alert.Timestamp.Format(time.RFC1123))
+	if alert.Location != nil {
+		body += fmt.Sprintf("Location: %.5f, %.5f\r\n", alert.Location.Latitude, alert.Location.Longitude)
+	}
+
+	msg := "From: " + s.from + "\r\n" +
+		"To: " + to.String() + "\r\n" +
+		"Subject: " + subject + "\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + body
+
+	return smtp.SendMail(s.addr, s.auth, s.from, []string{to.Address}, []byte(msg))
+}
+
+// AlertDispatcher fans alerts out to every configured notifier
+type AlertDispatcher struct {
+	notifiers []Notifier
+	logger    *zerolog.Logger
+}
+
+// NewAlertDispatcher always includes the in-app feed and webhooks, SMTP only when configured
+func NewAlertDispatcher(settings *config.Settings, logger *zerolog.Logger) *AlertDispatcher {
+	notifiers := []Notifier{Alerts, NewWebhookNotifier()}
+	if smtpNotifier := NewSMTPNotifier(settings); smtpNotifier != nil {
+		notifiers = append(notifiers, smtpNotifier)
+	}
+	return &AlertDispatcher{notifiers: notifiers, logger: logger}
+}
+
+// Dispatch delivers the alert. A failing notifier is logged and does not stop the others.
+func (d *AlertDispatcher) Dispatch(ctx context.Context, alert Alert, target NotificationTarget) {
+	if alert.ID == "" {
+		alert.ID = uuid.New().String()
+	}
+	alert.Owner = strings.ToLower(alert.Owner)
+	alert.CreatedAt = time.Now().UTC()
+
+	for _, notifier := range d.notifiers {
+		if err := notifier.Notify(ctx, alert, target); err != nil {
+			d.logger.Error().Err(err).Str("notifier", notifier.Name()).Str("alertId", alert.ID).Msg("Failed to deliver alert")
+		}
+	}
+}
@@ -4,8 +4,7 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/google/uuid"
-
+	"github.com/dimo-network/trips-web-app/api/internal/config"
 	"github.com/gofiber/fiber/v2"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/patrickmn/go-cache"
@@ -41,6 +40,19 @@ func ExtractEthereumAddressFromToken(tokenString string) (string, error) {
 	return ethAddress, nil
 }
 
+// jwtExpiry reads the exp claim of the token without verifying it
+func jwtExpiry(tokenString string) (time.Time, bool) {
+	token, _, err := new(jwt.Parser).ParseUnverified(tokenString, jwt.MapClaims{})
+	if err != nil {
+		return time.Time{}, false
+	}
+	exp, err := token.Claims.GetExpirationTime()
+	if err != nil || exp == nil {
+		return time.Time{}, false
+	}
+	return exp.Time, true
+}
+
 func AuthMiddleware() fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		// check if session_id cookie exists
@@ -50,14 +62,18 @@ func AuthMiddleware() fiber.Handler {
 			return c.Render("session_expired", fiber.Map{})
 		}
 
-		// check if the session_id is in the cache
-		jwtToken, found := CacheInstance.Get(sessionCookie)
+		// activity extends the session, up to the JWT's exp
+		session, found := Sessions.Touch(sessionCookie)
+		if !found {
+			return c.Render("session_expired", fiber.Map{})
+		}
+
+		jwtToken, found := CacheInstance.Get(session.ID)
 		if !found {
 			fmt.Println("Session expired")
 			return c.Render("session_expired", fiber.Map{})
 		}
 
-		// check if main auth jwt token has expired here, if not show same render of session expired etc.
 		ethAddress, err := ExtractEthereumAddressFromToken(jwtToken.(string))
 		if err != nil {
 			fmt.Println("Error extracting ethereum address from token:", err)
@@ -65,6 +81,8 @@ func AuthMiddleware() fiber.Handler {
 		}
 
 		c.Locals("ethereum_address", ethAddress)
+		// the signed in address and the linked wallets, the session can use the vehicles of each
+		c.Locals("ethereum_addresses", session.Addresses(time.Now()))
 
 		return c.Next()
 	}
@@ -75,21 +93,51 @@ type JwtRequest struct {
 	Jwt string `json:"jwt"`
 }
 
-// PersistJwtHandler handles the POST request containing the JWT for our session
-func PersistJwtHandler(c *fiber.Ctx) error {
-	var req JwtRequest
+// PersistJwtHandler handles the POST request containing the JWT for our session and sets the session cookie. Only
+// JWTs the auth provider verifies start a session.
+func PersistJwtHandler(settings *config.Settings, provider AuthProvider) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var req JwtRequest
 
-	// Parse the JSON body into our request struct.
-	if err := c.BodyParser(&req); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid request payload",
+		// Parse the JSON body into our request struct.
+		if err := c.BodyParser(&req); err != nil || req.Jwt == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid request payload",
+			})
+		}
+		if err := provider.VerifyToken(req.Jwt); err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		session, err := Sessions.Start(req.Jwt, c.Get(fiber.HeaderUserAgent), c.IP())
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		setSessionCookie(c, settings, session)
+
+		// a new login is when vehicles are most likely to have changed, e.g. just minted or shared
+		if ethAddress, err := ExtractEthereumAddressFromToken(req.Jwt); err == nil {
+			Vehicles.Invalidate(ethAddress)
+		}
+
+		return c.JSON(fiber.Map{
+			"message":        "Session started",
+			"expires_at":     session.ExpiresAt,
+			"max_expires_at": session.MaxExpiresAt,
 		})
 	}
-	sessionID := uuid.New().String()
-	CacheInstance.Set(sessionID, req.Jwt, 2*time.Hour)
+}
 
-	// Return the session_id as JSON.
-	return c.JSON(fiber.Map{
-		"session_id": sessionID,
-	})
+// HandleLogout ends the session of the session_id cookie and sends the browser back to the login page
+func HandleLogout(settings *config.Settings) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		if sessionID := c.Cookies(sessionCookieName); sessionID != "" {
+			Sessions.End(sessionID)
+		}
+		clearSessionCookie(c, settings)
+		return c.Redirect("/", fiber.StatusSeeOther)
+	}
 }
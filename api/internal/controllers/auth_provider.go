@@ -0,0 +1,71 @@
+package controllers
+
+import (
+	"fmt"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+)
+
+// AuthProvider signs wallets in with a web3 challenge: the wallet signs the challenge with personal_sign and the
+// provider trades the signature for the JWT of the session
+type AuthProvider interface {
+	GenerateChallenge(address string) (ChallengeResponse, error)
+	SubmitChallenge(signatureReq SignatureRequest) (string, error)
+	// VerifyToken checks the JWT was issued by the provider and hasn't expired
+	VerifyToken(accessToken string) error
+}
+
+// NewAuthProvider returns the provider AUTH_PROVIDER asks for, DIMO's auth server unless it is "local"
+func NewAuthProvider(settings *config.Settings) (AuthProvider, error) {
+	switch settings.AuthProvider {
+	case "", "dimo":
+		return NewDIMOAuthProvider(settings), nil
+	case "local":
+		return NewLocalAuthProvider(settings)
+	default:
+		return nil, fmt.Errorf("unknown AUTH_PROVIDER: %s", settings.AuthProvider)
+	}
+}
+
+func HandleGenerateChallenge(provider AuthProvider) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var challengeReq ChallengeRequest
+		if err := c.BodyParser(&challengeReq); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+
+		challenge, err := provider.GenerateChallenge(challengeReq.Address)
+		if errors.Is(err, ErrTooManyChallenges) {
+			return c.Status(fiber.StatusTooManyRequests).SendString(err.Error())
+		}
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		}
+		return c.JSON(challenge)
+	}
+}
+
+func HandleSubmitChallenge(settings *config.Settings, provider AuthProvider) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var signatureReq SignatureRequest
+		if err := c.BodyParser(&signatureReq); err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
+		}
+
+		accessToken, err := provider.SubmitChallenge(signatureReq)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).SendString(err.Error())
+		}
+
+		//jwt token storage
+		session, err := Sessions.Start(accessToken, c.Get(fiber.HeaderUserAgent), c.IP())
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).SendString(err.Error())
+		}
+		setSessionCookie(c, settings, session)
+
+		return c.JSON(fiber.Map{"message": "Challenge accepted and session started!", "id_token": accessToken})
+	}
+}
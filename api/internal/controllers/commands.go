@@ -0,0 +1,228 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+const (
+	CommandStatusPending  = "pending"
+	CommandStatusComplete = "complete"
+	CommandStatusFailed   = "failed"
+
+	// maxCommandsPerVehicle caps the command log, oldest commands are dropped first
+	maxCommandsPerVehicle = 100
+)
+
+// VehicleCommand is a command the devices API can send to a vehicle
+type VehicleCommand struct {
+	Name  string
+	Label string
+	// Path is appended to /vehicle/{tokenId}/commands/ on the devices API
+	Path string
+}
+
+// VehicleCommands are the commands offered on the commands page, in display order
+var VehicleCommands = []VehicleCommand{
+	{Name: "lock", Label: "Lock doors", Path: "doors/lock"},
+	{Name: "unlock", Label: "Unlock doors", Path: "doors/unlock"},
+	{Name: "trunk", Label: "Open trunk", Path: "trunk/open"},
+	{Name: "charge-start", Label: "Start charging", Path: "charge/start"},
+	{Name: "charge-stop", Label: "Stop charging", Path: "charge/stop"},
+}
+
+// FindVehicleCommand returns the command by name, nil if there's no such command
+func FindVehicleCommand(name string) *VehicleCommand {
+	for _, command := range VehicleCommands {
+		if command.Name == name {
+			return &command
+		}
+	}
+	return nil
+}
+
+// CommandLogEntry is a command sent to a vehicle and what became of it
+type CommandLogEntry struct {
+	ID        string    `json:"id"`
+	TokenID   int64     `json:"tokenId"`
+	Command   string    `json:"command"`
+	Label     string    `json:"label"`
+	RequestID string    `json:"requestId,omitempty"`
+	Status    string    `json:"status"`
+	Message   string    `json:"message,omitempty"`
+	IssuedBy  string    `json:"issuedBy"`
+	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// CommandLogStore keeps the commands sent to each vehicle in memory, shared by everyone with access to the vehicle
+type CommandLogStore struct {
+	mu       sync.RWMutex
+	commands map[int64][]CommandLogEntry
+}
+
+var CommandLog = NewCommandLogStore()
+
+func NewCommandLogStore() *CommandLogStore {
+	return &CommandLogStore{commands: make(map[int64][]CommandLogEntry)}
+}
+
+// Add records a new command and returns it with its ID
+func (s *CommandLogStore) Add(entry CommandLogEntry) CommandLogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.ID = uuid.New().String()
+	entry.CreatedAt = time.Now().UTC()
+	entry.UpdatedAt = entry.CreatedAt
+
+	log := append(s.commands[entry.TokenID], entry)
+	if len(log) > maxCommandsPerVehicle {
+		log = log[len(log)-maxCommandsPerVehicle:]
+	}
+	s.commands[entry.TokenID] = log
+	return entry
+}
+
+// UpdateStatus sets the status of a logged command, unknown IDs are ignored
+func (s *CommandLogStore) UpdateStatus(tokenID int64, id, status, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i := range s.commands[tokenID] {
+		entry := &s.commands[tokenID][i]
+		if entry.ID == id {
+			entry.Status = status
+			entry.Message = message
+			entry.UpdatedAt = time.Now().UTC()
+			return
+		}
+	}
+}
+
+// List returns the commands sent to the vehicle, newest first
+func (s *CommandLogStore) List(tokenID int64) []CommandLogEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	log := s.commands[tokenID]
+	entries := make([]CommandLogEntry, 0, len(log))
+	for i := len(log) - 1; i >= 0; i-- {
+		entries = append(entries, log[i])
+	}
+	return entries
+}
+
+// CommandServiceError is a failed call to the devices API, mapped to the status we answer the browser with
+type CommandServiceError struct {
+	Status  int
+	Message string
+}
+
+func (e *CommandServiceError) Error() string {
+	return e.Message
+}
+
+// CommandsClient sends commands through the devices API with a privilege token holding the commands privilege
+type CommandsClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewCommandsClient(baseURL string) *CommandsClient {
+	return &CommandsClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Send asks the devices API to run the command and returns the ID to follow it up with
+func (cc *CommandsClient) Send(ctx context.Context, privilegeToken string, tokenID int64, command VehicleCommand) (string, error) {
+	var response struct {
+		RequestID string `json:"requestId"`
+	}
+	path := fmt.Sprintf("/vehicle/%d/commands/%s", tokenID, command.Path)
+	if err := cc.do(ctx, http.MethodPost, path, privilegeToken, &response); err != nil {
+		return "", err
+	}
+	if response.RequestID == "" {
+		return "", &CommandServiceError{Status: fiber.StatusBadGateway, Message: "Devices API didn't return a command request ID"}
+	}
+	return response.RequestID, nil
+}
+
+// Status returns the status of a sent command as one of the CommandStatus values, with the device's message if any
+func (cc *CommandsClient) Status(ctx context.Context, privilegeToken string, tokenID int64, requestID string) (string, string, error) {
+	var response struct {
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	}
+	path := fmt.Sprintf("/vehicle/%d/commands/%s", tokenID, requestID)
+	if err := cc.do(ctx, http.MethodGet, path, privilegeToken, &response); err != nil {
+		return "", "", err
+	}
+
+	// the devices API answers Pending, Complete or Failed
+	switch strings.ToLower(response.Status) {
+	case CommandStatusComplete:
+		return CommandStatusComplete, response.Message, nil
+	case CommandStatusFailed:
+		return CommandStatusFailed, response.Message, nil
+	}
+	return CommandStatusPending, response.Message, nil
+}
+
+func (cc *CommandsClient) do(ctx context.Context, method, path, privilegeToken string, result any) error {
+	if cc.baseURL == "" {
+		return &CommandServiceError{Status: fiber.StatusServiceUnavailable, Message: "Vehicle commands are not configured"}
+	}
+
+	var body io.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader("{}")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, cc.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", privilegeToken))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := cc.client.Do(req)
+	if err != nil {
+		return &CommandServiceError{Status: fiber.StatusBadGateway, Message: "Devices API is unreachable"}
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return &CommandServiceError{Status: fiber.StatusBadGateway, Message: "Error reading response from devices API"}
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return &CommandServiceError{Status: fiber.StatusForbidden, Message: "Not allowed to send commands to this vehicle"}
+	case resp.StatusCode == http.StatusNotFound:
+		return &CommandServiceError{Status: fiber.StatusNotFound, Message: upstreamErrorMessage(respBody, "Vehicle or command not found")}
+	case resp.StatusCode >= 300:
+		return &CommandServiceError{Status: fiber.StatusBadGateway, Message: "Devices API error: " + upstreamErrorMessage(respBody, http.StatusText(resp.StatusCode))}
+	}
+
+	if err := json.Unmarshal(respBody, result); err != nil {
+		return &CommandServiceError{Status: fiber.StatusBadGateway, Message: "Invalid response from devices API"}
+	}
+	return nil
+}
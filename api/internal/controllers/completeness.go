@@ -0,0 +1,180 @@
+package controllers
+
+import (
+	"sort"
+	"time"
+)
+
+const (
+	// maxCompletenessBuckets keeps the heatmap readable and the telemetry queries small
+	maxCompletenessBuckets = 500
+
+	// longestGapsReported is how many of the longest gaps are listed per signal
+	longestGapsReported = 3
+
+	// minSuspiciousConstantBuckets is how many consecutive buckets must repeat the exact same value before it looks like a stuck sensor
+	minSuspiciousConstantBuckets = 12
+)
+
+// CompletenessIntervals are the bucket sizes offered by the report, as telemetry intervals
+var CompletenessIntervals = map[string]time.Duration{
+	"1m":  time.Minute,
+	"5m":  5 * time.Minute,
+	"15m": 15 * time.Minute,
+	"1h":  time.Hour,
+}
+
+// CompletenessGap is a run of buckets without data
+type CompletenessGap struct {
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Buckets int       `json:"buckets"`
+}
+
+// ConstantRun is the longest run of buckets reporting the exact same numeric value
+type ConstantRun struct {
+	Value   float64   `json:"value"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Buckets int       `json:"buckets"`
+}
+
+type SignalCompleteness struct {
+	Signal string `json:"signal"`
+	// Buckets tells for each bucket whether the signal had data
+	Buckets []bool `json:"buckets"`
+	// Coverage is the fraction of buckets with data, from 0 to 1
+	Coverage    float64           `json:"coverage"`
+	LongestGaps []CompletenessGap `json:"longestGaps"`
+	// Constant is set when the signal repeats the same value suspiciously long
+	Constant *ConstantRun `json:"constant,omitempty"`
+	Error    string       `json:"error,omitempty"`
+}
+
+type CompletenessReport struct {
+	TokenID      int64                `json:"tokenId"`
+	From         time.Time            `json:"from"`
+	To           time.Time            `json:"to"`
+	Interval     string               `json:"interval"`
+	BucketStarts []time.Time          `json:"bucketStarts"`
+	Signals      []SignalCompleteness `json:"signals"`
+}
+
+// completenessBucketCount is len(completenessBuckets(from, to, interval)) without allocating them
+func completenessBucketCount(from, to time.Time, interval time.Duration) int64 {
+	span := to.Sub(from)
+	if span <= 0 {
+		return 0
+	}
+	return int64((span + interval - 1) / interval)
+}
+
+// completenessBuckets returns the start of every bucket in [from, to)
+func completenessBuckets(from, to time.Time, interval time.Duration) []time.Time {
+	starts := []time.Time{}
+	for start := from; start.Before(to); start = start.Add(interval) {
+		starts = append(starts, start)
+	}
+	return starts
+}
+
+// EvaluateSignalCompleteness places the historical entries into the buckets and works out coverage, gaps and constant runs
+func EvaluateSignalCompleteness(signal string, entries []SignalEntry, bucketStarts []time.Time, interval time.Duration) SignalCompleteness {
+	completeness := SignalCompleteness{
+		Signal:      signal,
+		Buckets:     make([]bool, len(bucketStarts)),
+		LongestGaps: []CompletenessGap{},
+	}
+	if len(bucketStarts) == 0 {
+		return completeness
+	}
+
+	values := make([]any, len(bucketStarts))
+	for _, entry := range entries {
+		if entry.Value == nil {
+			continue
+		}
+		timestamp, err := time.Parse(time.RFC3339, entry.Timestamp)
+		if err != nil {
+			continue
+		}
+		// telemetry buckets may not start exactly on ours
+		index := int(timestamp.Sub(bucketStarts[0]) / interval)
+		if index < 0 || index >= len(bucketStarts) {
+			continue
+		}
+		completeness.Buckets[index] = true
+		values[index] = entry.Value
+	}
+
+	withData := 0
+	gaps := []CompletenessGap{}
+	gapStart := -1
+	for i, hasData := range completeness.Buckets {
+		if hasData {
+			withData++
+			if gapStart >= 0 {
+				gaps = append(gaps, newCompletenessGap(bucketStarts, gapStart, i, interval))
+				gapStart = -1
+			}
+		} else if gapStart < 0 {
+			gapStart = i
+		}
+	}
+	if gapStart >= 0 {
+		gaps = append(gaps, newCompletenessGap(bucketStarts, gapStart, len(bucketStarts), interval))
+	}
+
+	completeness.Coverage = float64(withData) / float64(len(bucketStarts))
+
+	sort.SliceStable(gaps, func(i, j int) bool {
+		return gaps[i].Buckets > gaps[j].Buckets
+	})
+	if len(gaps) > longestGapsReported {
+		gaps = gaps[:longestGapsReported]
+	}
+	completeness.LongestGaps = gaps
+
+	completeness.Constant = longestConstantRun(values, bucketStarts, interval)
+	return completeness
+}
+
+func newCompletenessGap(bucketStarts []time.Time, start, end int, interval time.Duration) CompletenessGap {
+	return CompletenessGap{
+		From:    bucketStarts[start],
+		To:      bucketStarts[end-1].Add(interval),
+		Buckets: end - start,
+	}
+}
+
+// longestConstantRun finds the longest run of buckets with the same numeric value, ignoring empty buckets in between.
+// Returns nil unless the run is long enough to be suspicious.
+func longestConstantRun(values []any, bucketStarts []time.Time, interval time.Duration) *ConstantRun {
+	var longest, current *ConstantRun
+	for i, raw := range values {
+		value, ok := raw.(float64)
+		if !ok {
+			if raw != nil {
+				// strings like the VIN are constant by nature
+				current = nil
+			}
+			continue
+		}
+
+		if current != nil && current.Value == value {
+			current.Buckets++
+			current.To = bucketStarts[i].Add(interval)
+		} else {
+			current = &ConstantRun{Value: value, From: bucketStarts[i], To: bucketStarts[i].Add(interval), Buckets: 1}
+		}
+		if longest == nil || current.Buckets > longest.Buckets {
+			run := *current
+			longest = &run
+		}
+	}
+
+	if longest == nil || longest.Buckets < minSuspiciousConstantBuckets {
+		return nil
+	}
+	return longest
+}
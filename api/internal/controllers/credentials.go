@@ -0,0 +1,446 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/common/hexutil"
+	"github.com/ethereum/go-ethereum/crypto"
+	"github.com/pkg/errors"
+)
+
+const (
+	CredentialStatusValid       = "valid"
+	CredentialStatusExpired     = "expired"
+	CredentialStatusNotYetValid = "not yet valid"
+	CredentialStatusRevoked     = "revoked"
+	CredentialStatusInvalid     = "invalid"
+	// CredentialStatusUnknown is a credential with a valid signature whose revocation couldn't be checked
+	CredentialStatusUnknown = "unknown"
+	// CredentialStatusUnverifiedIssuer is a credential signed by the issuer it names, which isn't known to be trusted
+	// because VC_ISSUER_ADDRESS isn't set. Anyone can sign a credential naming themselves.
+	CredentialStatusUnverifiedIssuer = "unverified issuer"
+
+	// credentialProofType is the proof type the attestation API's credentials name. The payload checked is an EIP-191
+	// personal_sign signature over the credential without its proof, canonicalized with JCS (RFC 8785): our reading of
+	// the format rather than the attestation API's specification, so the check is a convenience, not an authoritative
+	// verification.
+	credentialProofType = "EcdsaSecp256k1RecoverySignature2020"
+)
+
+// CredentialKind is a credential the telemetry API keeps the latest of per vehicle
+type CredentialKind struct {
+	Name  string
+	Label string
+	// Query is the telemetry API field returning the credential
+	Query string
+	// Issuable credentials can be requested from the attestation API on demand
+	Issuable bool
+}
+
+// CredentialKinds are the credentials shown on the credentials page, in display order
+var CredentialKinds = []CredentialKind{
+	{Name: "vin", Label: "VIN", Query: "vinVCLatest", Issuable: true},
+	{Name: "pom", Label: "Proof of Movement", Query: "pomVCLatest"},
+}
+
+// CredentialClaim is one claim of the credential subject, nested claims are flattened to dotted names
+type CredentialClaim struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// CredentialVerification is the outcome of checking a credential locally
+type CredentialVerification struct {
+	Status string `json:"status"`
+	// Reason explains any status other than valid, e.g. "expired 2024-01-01T00:00:00Z"
+	Reason string `json:"reason,omitempty"`
+	// Signer is the address recovered from the proof, empty if the proof couldn't be read
+	Signer string `json:"signer,omitempty"`
+	// Issuer is the address the credential claims to be issued by
+	Issuer string `json:"issuer,omitempty"`
+	// TrustedIssuer is set when the issuer is the one configured in VC_ISSUER_ADDRESS
+	TrustedIssuer bool      `json:"trustedIssuer"`
+	ValidFrom     time.Time `json:"validFrom"`
+	ValidTo       time.Time `json:"validTo"`
+}
+
+// verifiableCredential holds the fields of a W3C verifiable credential the verifier needs, the rest stays in raw
+type verifiableCredential struct {
+	Issuer            json.RawMessage        `json:"issuer"`
+	IssuanceDate      string                 `json:"issuanceDate"`
+	ExpirationDate    string                 `json:"expirationDate"`
+	ValidFrom         string                 `json:"validFrom"`
+	ValidUntil        string                 `json:"validUntil"`
+	CredentialSubject map[string]any         `json:"credentialSubject"`
+	CredentialStatus  *credentialStatusEntry `json:"credentialStatus"`
+	Proof             *struct {
+		Type               string `json:"type"`
+		VerificationMethod string `json:"verificationMethod"`
+		ProofValue         string `json:"proofValue"`
+	} `json:"proof"`
+}
+
+type credentialStatusEntry struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+}
+
+// VerifyCredential checks the proof of the raw credential, who issued it and whether it's valid at now.
+// isRevoked is asked about the credential status entry only when the signature holds. The error is only for credentials
+// that aren't JSON, every other problem is reported in the verification.
+func VerifyCredential(raw []byte, settings *config.Settings, now time.Time, isRevoked func(statusURL string) (bool, error)) (CredentialVerification, error) {
+	var vc verifiableCredential
+	if err := json.Unmarshal(raw, &vc); err != nil {
+		return CredentialVerification{}, errors.Wrap(err, "invalid credential")
+	}
+
+	verification := CredentialVerification{Issuer: credentialIssuerAddress(vc)}
+	verification.ValidFrom = parseCredentialTime(vc.ValidFrom, vc.IssuanceDate)
+	verification.ValidTo = parseCredentialTime(vc.ValidUntil, vc.ExpirationDate)
+
+	signer, err := recoverCredentialSigner(raw, vc)
+	if err != nil {
+		verification.Status = CredentialStatusInvalid
+		verification.Reason = err.Error()
+		return verification, nil
+	}
+	verification.Signer = signer.Hex()
+
+	if verification.Issuer == "" || !strings.EqualFold(verification.Issuer, verification.Signer) {
+		verification.Status = CredentialStatusInvalid
+		verification.Reason = fmt.Sprintf("signed by %s, not by the issuer", verification.Signer)
+		return verification, nil
+	}
+	verification.TrustedIssuer = settings.VCIssuerAddress != "" && strings.EqualFold(settings.VCIssuerAddress, verification.Issuer)
+	if settings.VCIssuerAddress != "" && !verification.TrustedIssuer {
+		verification.Status = CredentialStatusInvalid
+		verification.Reason = fmt.Sprintf("issued by %s instead of the trusted issuer %s", verification.Issuer, settings.VCIssuerAddress)
+		return verification, nil
+	}
+
+	if vc.CredentialStatus != nil && vc.CredentialStatus.ID != "" && isRevoked != nil {
+		revoked, err := isRevoked(vc.CredentialStatus.ID)
+		if err != nil {
+			verification.Status = CredentialStatusUnknown
+			verification.Reason = "couldn't check revocation: " + err.Error()
+			return verification, nil
+		}
+		if revoked {
+			verification.Status = CredentialStatusRevoked
+			verification.Reason = "revoked by the issuer"
+			return verification, nil
+		}
+	}
+
+	switch {
+	case !verification.ValidFrom.IsZero() && now.Before(verification.ValidFrom):
+		verification.Status = CredentialStatusNotYetValid
+		verification.Reason = "valid from " + verification.ValidFrom.Format(time.RFC3339)
+	case !verification.ValidTo.IsZero() && now.After(verification.ValidTo):
+		verification.Status = CredentialStatusExpired
+		verification.Reason = "expired " + verification.ValidTo.Format(time.RFC3339)
+	case !verification.TrustedIssuer:
+		verification.Status = CredentialStatusUnverifiedIssuer
+		verification.Reason = "no trusted issuer is configured, the signature only matches the issuer the credential names"
+	default:
+		verification.Status = CredentialStatusValid
+	}
+	return verification, nil
+}
+
+// CredentialClaims flattens the credential subject into claims sorted by name
+func CredentialClaims(raw []byte) ([]CredentialClaim, error) {
+	var vc verifiableCredential
+	if err := json.Unmarshal(raw, &vc); err != nil {
+		return nil, errors.Wrap(err, "invalid credential")
+	}
+
+	claims := []CredentialClaim{}
+	var flatten func(prefix string, value any)
+	flatten = func(prefix string, value any) {
+		switch v := value.(type) {
+		case map[string]any:
+			for key, nested := range v {
+				name := key
+				if prefix != "" {
+					name = prefix + "." + key
+				}
+				flatten(name, nested)
+			}
+		case nil:
+			claims = append(claims, CredentialClaim{Name: prefix, Value: ""})
+		case string:
+			claims = append(claims, CredentialClaim{Name: prefix, Value: v})
+		default:
+			encoded, _ := json.Marshal(v)
+			claims = append(claims, CredentialClaim{Name: prefix, Value: string(encoded)})
+		}
+	}
+	flatten("", vc.CredentialSubject)
+
+	sort.Slice(claims, func(i, j int) bool { return claims[i].Name < claims[j].Name })
+	return claims, nil
+}
+
+// recoverCredentialSigner recovers the address that signed the credential from its proof
+func recoverCredentialSigner(raw []byte, vc verifiableCredential) (common.Address, error) {
+	if vc.Proof == nil {
+		return common.Address{}, errors.New("credential has no proof")
+	}
+	if vc.Proof.Type != credentialProofType {
+		return common.Address{}, errors.Errorf("unsupported proof type %q", vc.Proof.Type)
+	}
+
+	payload, err := credentialSigningPayload(raw)
+	if err != nil {
+		return common.Address{}, err
+	}
+	signer, err := recoverPersonalSigner(payload, vc.Proof.ProofValue)
+	if err != nil {
+		return common.Address{}, errors.Wrap(err, "proof")
+	}
+	return signer, nil
+}
+
+// recoverPersonalSigner recovers the address that signed the message with personal_sign
+func recoverPersonalSigner(message []byte, signatureHex string) (common.Address, error) {
+	signature, err := hexutil.Decode(signatureHex)
+	if err != nil || len(signature) != crypto.SignatureLength {
+		return common.Address{}, errors.New("malformed signature")
+	}
+	// wallets sign with v as 27 or 28, the recovery expects 0 or 1
+	if signature[crypto.RecoveryIDOffset] >= 27 {
+		signature[crypto.RecoveryIDOffset] -= 27
+	}
+
+	publicKey, err := crypto.SigToPub(personalSignHash(message), signature)
+	if err != nil {
+		return common.Address{}, errors.New("signature doesn't recover to a key")
+	}
+	return crypto.PubkeyToAddress(*publicKey), nil
+}
+
+// personalSignHash is the hash personal_sign signs, the message prefixed as EIP-191 asks
+func personalSignHash(message []byte) []byte {
+	return crypto.Keccak256([]byte(fmt.Sprintf("\x19Ethereum Signed Message:\n%d%s", len(message), message)))
+}
+
+// credentialSigningPayload is the credential without its proof in the JSON Canonicalization Scheme (RFC 8785)
+func credentialSigningPayload(raw []byte) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var document map[string]any
+	if err := decoder.Decode(&document); err != nil {
+		return nil, errors.Wrap(err, "invalid credential")
+	}
+	delete(document, "proof")
+
+	var payload bytes.Buffer
+	if err := writeCanonicalJSON(&payload, document); err != nil {
+		return nil, err
+	}
+	return payload.Bytes(), nil
+}
+
+// writeCanonicalJSON writes the decoded JSON value as RFC 8785 asks: object keys sorted by their UTF-16 code units,
+// numbers as ECMAScript prints them and strings with only the escapes JSON requires
+func writeCanonicalJSON(buf *bytes.Buffer, value any) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteString("null")
+	case bool:
+		buf.WriteString(strconv.FormatBool(v))
+	case json.Number:
+		number, err := v.Float64()
+		if err != nil {
+			return errors.Wrapf(err, "number %s out of range", v)
+		}
+		buf.WriteString(ecmaScriptNumber(number))
+	case string:
+		writeCanonicalString(buf, v)
+	case []any:
+		buf.WriteByte('[')
+		for i, element := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonicalJSON(buf, element); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case map[string]any:
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			return slices.Compare(utf16.Encode([]rune(keys[i])), utf16.Encode([]rune(keys[j]))) < 0
+		})
+		buf.WriteByte('{')
+		for i, key := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, key)
+			buf.WriteByte(':')
+			if err := writeCanonicalJSON(buf, v[key]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	default:
+		return errors.Errorf("unexpected JSON value %T", value)
+	}
+	return nil
+}
+
+func writeCanonicalString(buf *bytes.Buffer, value string) {
+	buf.WriteByte('"')
+	for _, r := range value {
+		switch r {
+		case '"':
+			buf.WriteString(`\"`)
+		case '\\':
+			buf.WriteString(`\\`)
+		case '\b':
+			buf.WriteString(`\b`)
+		case '\f':
+			buf.WriteString(`\f`)
+		case '\n':
+			buf.WriteString(`\n`)
+		case '\r':
+			buf.WriteString(`\r`)
+		case '\t':
+			buf.WriteString(`\t`)
+		default:
+			if r < 0x20 {
+				fmt.Fprintf(buf, `\u%04x`, r)
+			} else {
+				buf.WriteRune(r)
+			}
+		}
+	}
+	buf.WriteByte('"')
+}
+
+// ecmaScriptNumber formats the number as ECMAScript's Number.prototype.toString, e.g. 1e+21, 0.000001 and 1e-7
+func ecmaScriptNumber(number float64) string {
+	if number == 0 {
+		return "0"
+	}
+	sign := ""
+	if number < 0 {
+		sign, number = "-", -number
+	}
+
+	// shortest digits that round trip, d.ddde±x
+	mantissa, exponent, _ := strings.Cut(strconv.FormatFloat(number, 'e', -1, 64), "e")
+	digits := strings.Replace(mantissa, ".", "", 1)
+	n, _ := strconv.Atoi(exponent)
+	n++ // the decimal point sits after n digits
+
+	switch {
+	case len(digits) <= n && n <= 21:
+		return sign + digits + strings.Repeat("0", n-len(digits))
+	case 0 < n && n <= 21:
+		return sign + digits[:n] + "." + digits[n:]
+	case -6 < n && n <= 0:
+		return sign + "0." + strings.Repeat("0", -n) + digits
+	}
+	exp := fmt.Sprintf("e%+d", n-1)
+	if len(digits) == 1 {
+		return sign + digits + exp
+	}
+	return sign + digits[:1] + "." + digits[1:] + exp
+}
+
+// credentialIssuerAddress reads the address out of the issuer, a DID like did:ethr:137:0x… given either as a string
+// or as an object with an id. Issuers that don't name an address, e.g. a URL, sign with the key their proof's
+// verification method names.
+func credentialIssuerAddress(vc verifiableCredential) string {
+	var id string
+	if err := json.Unmarshal(vc.Issuer, &id); err != nil {
+		var object struct {
+			ID string `json:"id"`
+		}
+		if err := json.Unmarshal(vc.Issuer, &object); err == nil {
+			id = object.ID
+		}
+	}
+	if address := didAddress(id); address != "" {
+		return address
+	}
+	if vc.Proof != nil {
+		return didAddress(vc.Proof.VerificationMethod)
+	}
+	return ""
+}
+
+// didAddress returns the address a DID or DID URL ends with, e.g. did:ethr:137:0x…#controller
+func didAddress(id string) string {
+	id, _, _ = strings.Cut(id, "#")
+	address := id[strings.LastIndex(id, ":")+1:]
+	if !common.IsHexAddress(address) {
+		return ""
+	}
+	return common.HexToAddress(address).Hex()
+}
+
+// parseCredentialTime returns the first of the values that parses, VC 2.0 and VC 1.1 name the validity dates differently
+func parseCredentialTime(values ...string) time.Time {
+	for _, value := range values {
+		if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+			return parsed
+		}
+	}
+	return time.Time{}
+}
+
+// credentialStatusRevoked asks the attestation API whether the credential was revoked, privilegeToken may be empty.
+// Status URLs pointing anywhere else are refused so a credential can't make the app call arbitrary hosts.
+func credentialStatusRevoked(settings *config.Settings, privilegeToken, statusURL string) (bool, error) {
+	base := strings.TrimSuffix(settings.AttestationAPIURL, "/")
+	if base == "" || !strings.HasPrefix(statusURL, base+"/") {
+		return false, errors.Errorf("status list %s is not on the attestation API", statusURL)
+	}
+
+	req, err := http.NewRequest(http.MethodGet, statusURL, nil)
+	if err != nil {
+		return false, err
+	}
+	if privilegeToken != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", privilegeToken))
+	}
+	req.Header.Set("Accept", "application/json")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, errors.Errorf("status list answered %d", resp.StatusCode)
+	}
+
+	var status struct {
+		Revoked bool `json:"revoked"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		return false, errors.Wrap(err, "invalid status list response")
+	}
+	return status.Revoked, nil
+}
@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+)
+
+const (
+	DeviceStatusOnline  = "online"
+	DeviceStatusStale   = "stale"
+	DeviceStatusOffline = "offline"
+	DeviceStatusUnknown = "unknown"
+)
+
+// StalenessThresholds decide when a signal is stale and when a device counts as offline
+type StalenessThresholds struct {
+	Default   time.Duration
+	PerSignal map[string]time.Duration
+	Offline   time.Duration
+}
+
+// NewStalenessThresholds reads the thresholds from settings. SIGNAL_STALE_THRESHOLDS overrides the default per signal,
+// as a comma separated list of signal=seconds, eg. "speed=300,currentLocationLatitude=600".
+func NewStalenessThresholds(settings *config.Settings) (StalenessThresholds, error) {
+	thresholds := StalenessThresholds{
+		Default:   time.Duration(settings.SignalStaleAfterSeconds) * time.Second,
+		PerSignal: make(map[string]time.Duration),
+		Offline:   time.Duration(settings.DeviceOfflineAfterSeconds) * time.Second,
+	}
+	if thresholds.Default <= 0 {
+		thresholds.Default = time.Hour
+	}
+	if thresholds.Offline <= 0 {
+		thresholds.Offline = 24 * time.Hour
+	}
+
+	for _, override := range strings.Split(settings.SignalStaleThresholds, ",") {
+		override = strings.TrimSpace(override)
+		if override == "" {
+			continue
+		}
+		name, value, ok := strings.Cut(override, "=")
+		seconds, err := strconv.Atoi(strings.TrimSpace(value))
+		if !ok || err != nil || seconds <= 0 {
+			return StalenessThresholds{}, fmt.Errorf("invalid SIGNAL_STALE_THRESHOLDS entry: %q", override)
+		}
+		thresholds.PerSignal[strings.TrimSpace(name)] = time.Duration(seconds) * time.Second
+	}
+
+	return thresholds, nil
+}
+
+func (t StalenessThresholds) For(signalName string) time.Duration {
+	if threshold, ok := t.PerSignal[signalName]; ok {
+		return threshold
+	}
+	return t.Default
+}
+
+// SignalFreshness is how long ago a signal was last reported
+type SignalFreshness struct {
+	Name      string
+	Value     any
+	Timestamp time.Time
+	Age       time.Duration
+	Threshold time.Duration
+	Stale     bool
+}
+
+// VehicleHealth summarizes whether the vehicle's device is still reporting
+type VehicleHealth struct {
+	Vehicle Vehicle
+	Shared  bool
+	// LastSeen is the most recent timestamp of any signal, nil when the vehicle never reported
+	LastSeen     *time.Time
+	Status       string
+	Signals      []SignalFreshness
+	StaleSignals int
+	Error        string
+}
+
+// EvaluateVehicleHealth works out the freshness of each signal and the device status from signalsLatest
+func EvaluateVehicleHealth(vehicle Vehicle, entries SignalEntries, thresholds StalenessThresholds, now time.Time) VehicleHealth {
+	health := VehicleHealth{Vehicle: vehicle, Status: DeviceStatusUnknown}
+
+	for _, entry := range entries {
+		timestamp, err := time.Parse(time.RFC3339, entry.Timestamp)
+		if err != nil {
+			// signals the vehicle never reported come back without a timestamp
+			continue
+		}
+
+		freshness := SignalFreshness{
+			Name:      entry.SignalName,
+			Value:     entry.Value,
+			Timestamp: timestamp,
+			Age:       now.Sub(timestamp),
+			Threshold: thresholds.For(entry.SignalName),
+		}
+		freshness.Stale = freshness.Age > freshness.Threshold
+		if freshness.Stale {
+			health.StaleSignals++
+		}
+		health.Signals = append(health.Signals, freshness)
+
+		if health.LastSeen == nil || timestamp.After(*health.LastSeen) {
+			health.LastSeen = &timestamp
+		}
+	}
+
+	// stalest first, that's what support looks for
+	sort.Slice(health.Signals, func(i, j int) bool {
+		return health.Signals[i].Age > health.Signals[j].Age
+	})
+
+	switch {
+	case health.LastSeen == nil:
+		health.Status = DeviceStatusUnknown
+	case now.Sub(*health.LastSeen) > thresholds.Offline:
+		health.Status = DeviceStatusOffline
+	case health.StaleSignals > 0:
+		health.Status = DeviceStatusStale
+	default:
+		health.Status = DeviceStatusOnline
+	}
+
+	return health
+}
+
+// SortByStaleness orders the fleet with vehicles that never reported first, then by the oldest last-seen time
+func SortByStaleness(fleet []VehicleHealth) {
+	sort.SliceStable(fleet, func(i, j int) bool {
+		a, b := fleet[i].LastSeen, fleet[j].LastSeen
+		if a == nil || b == nil {
+			return a == nil && b != nil
+		}
+		return a.Before(*b)
+	})
+}
+
+// formatAge renders a duration the way support reads it, eg. "3d 4h" or "12m"
+func formatAge(age time.Duration) string {
+	age = age.Round(time.Minute)
+	days := int(age.Hours()) / 24
+	hours := int(age.Hours()) % 24
+	minutes := int(age.Minutes()) % 60
+
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes)
+	default:
+		return fmt.Sprintf("%dm", minutes)
+	}
+}
@@ -7,11 +7,9 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
-	"time"
 
 	"github.com/dimo-network/trips-web-app/api/internal/config"
-	"github.com/gofiber/fiber/v2"
-	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 )
 
@@ -24,108 +22,104 @@ type SignatureRequest struct {
 	Signature string `json:"signature"`
 }
 
-func HandleGenerateChallenge(c *fiber.Ctx, settings *config.Settings) error {
-	var challengeReq ChallengeRequest
-	if err := c.BodyParser(&challengeReq); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
-	}
+// DIMOAuthProvider proxies the challenge to DIMO's auth server, which issues the JWT
+type DIMOAuthProvider struct {
+	settings *config.Settings
+	jwks     *JWKS
+}
 
-	address := challengeReq.Address
+func NewDIMOAuthProvider(settings *config.Settings) *DIMOAuthProvider {
+	return &DIMOAuthProvider{settings: settings, jwks: NewJWKS(settings)}
+}
 
+func (p *DIMOAuthProvider) GenerateChallenge(address string) (ChallengeResponse, error) {
 	formData := url.Values{}
-	formData.Add("client_id", settings.ClientID)
-	formData.Add("domain", settings.Domain)
-	formData.Add("scope", settings.Scope)
-	formData.Add("response_type", settings.ResponseType)
+	formData.Add("client_id", p.settings.ClientID)
+	formData.Add("domain", p.settings.Domain)
+	formData.Add("scope", p.settings.Scope)
+	formData.Add("response_type", p.settings.ResponseType)
 	formData.Add("address", address)
 
 	encodedFormData := formData.Encode()
-	reqURL := settings.AuthURL
+	reqURL := p.settings.AuthURL
 
 	resp, err := http.Post(reqURL, "application/x-www-form-urlencoded", strings.NewReader(encodedFormData))
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to make request to external service")
+		return ChallengeResponse{}, errors.New("Failed to make request to external service")
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Error reading external response")
+		return ChallengeResponse{}, errors.New("Error reading external response")
 	}
 
 	var apiResp ChallengeResponse
 	if err := json.Unmarshal(body, &apiResp); err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Error processing response from external service")
+		return ChallengeResponse{}, errors.New("Error processing response from external service")
 	}
 
 	if apiResp.State == "" || apiResp.Challenge == "" {
-		return c.Status(fiber.StatusInternalServerError).SendString("State or Challenge incomplete from external service")
+		return ChallengeResponse{}, errors.New("State or Challenge incomplete from external service")
 	}
 
 	log.Info().Msgf("Response from generate challenge: %+v", apiResp)
 
-	return c.JSON(apiResp)
+	return apiResp, nil
 }
 
-func HandleSubmitChallenge(c *fiber.Ctx, settings *config.Settings) error {
-	var signatureReq SignatureRequest
-	if err := c.BodyParser(&signatureReq); err != nil {
-		return c.Status(fiber.StatusBadRequest).SendString("Invalid request body")
-	}
-
+// SubmitChallenge trades the signed challenge for a JWT at the auth server
+func (p *DIMOAuthProvider) SubmitChallenge(signatureReq SignatureRequest) (string, error) {
 	log.Info().Msgf("State: %s, Signature: %s", signatureReq.State, signatureReq.Signature)
 
 	formData := url.Values{}
-	formData.Add("client_id", settings.ClientID)
-	formData.Add("domain", settings.Domain)
-	formData.Add("grant_type", settings.GrantType)
+	formData.Add("client_id", p.settings.ClientID)
+	formData.Add("domain", p.settings.Domain)
+	formData.Add("grant_type", p.settings.GrantType)
 	formData.Add("state", signatureReq.State)
 	formData.Add("signature", signatureReq.Signature)
 
 	log.Info().Msgf("Response from submit challenge: %+v", formData)
 
 	encodedFormData := formData.Encode()
-	reqURL := settings.SubmitChallengeURL
+	reqURL := p.settings.SubmitChallengeURL
 
 	resp, err := http.Post(reqURL, "application/x-www-form-urlencoded", strings.NewReader(encodedFormData))
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to make request to external service")
+		return "", errors.New("Failed to make request to external service")
 	}
 	defer resp.Body.Close()
 
 	// Check the HTTP status code here
 	if resp.StatusCode >= 300 {
-		return c.Status(fiber.StatusInternalServerError).SendString(fmt.Sprintf("Received non-success status code: %d", resp.StatusCode))
+		return "", fmt.Errorf("Received non-success status code: %d", resp.StatusCode)
 	}
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Failed to read response from external service")
+		return "", errors.New("Failed to read response from external service")
 	}
 
 	var responseMap map[string]interface{}
 	if err := json.Unmarshal(respBody, &responseMap); err != nil {
-		return c.Status(fiber.StatusInternalServerError).SendString("Error processing response")
+		return "", errors.New("Error processing response")
 	}
 
 	log.Info().Msgf("Response from submit challenge: %+v", responseMap) //debugging
 
 	token, exists := responseMap["id_token"]
 	if !exists {
-		return c.Status(fiber.StatusInternalServerError).SendString("Token not found in response")
+		return "", errors.New("Token not found in response")
 	}
 
-	//jwt token storage
-	sessionID := uuid.New().String()
-	CacheInstance.Set(sessionID, token, 2*time.Hour)
-
-	cookie := new(fiber.Cookie)
-	cookie.Name = "session_id"
-	cookie.Value = sessionID
-	cookie.Expires = time.Now().Add(2 * time.Hour)
-	cookie.HTTPOnly = true
-
-	c.Cookie(cookie)
+	accessToken, ok := token.(string)
+	if !ok {
+		return "", errors.New("Token in response is not a string")
+	}
+	return accessToken, nil
+}
 
-	return c.JSON(fiber.Map{"message": "Challenge accepted and session started!", "id_token": token})
+// VerifyToken checks the JWT against the keys DIMO's auth server publishes
+func (p *DIMOAuthProvider) VerifyToken(accessToken string) error {
+	return p.jwks.Verify(accessToken)
 }
@@ -0,0 +1,296 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/patrickmn/go-cache"
+	"github.com/pkg/errors"
+)
+
+//go:embed data/geonames_cities.tsv
+var gazetteerFS embed.FS
+
+const (
+	// geocodeCachePrecision is the number of decimals coordinates are rounded to for caching, ~110m
+	geocodeCachePrecision = 3
+	// offlineGeocoderMaxDistanceKm is how far the nearest city may be before we give up on naming a place
+	offlineGeocoderMaxDistanceKm = 100
+	// geocodeConcurrency limits parallel reverse geocoding lookups for a trips list
+	geocodeConcurrency = 4
+	earthRadiusKm      = 6371.0
+)
+
+// Geocoder turns coordinates into a human-readable locality name, eg. "Berlin, DE".
+// An empty name with no error means nothing is known about the location.
+type Geocoder interface {
+	ReverseGeocode(ctx context.Context, location LatLon) (string, error)
+}
+
+// NewGeocoder builds the geocoder configured in settings, wrapped in a cache keyed by rounded coordinate.
+// GEOCODER_BACKEND is either "offline" (default) or "nominatim".
+func NewGeocoder(settings *config.Settings) (Geocoder, error) {
+	var geocoder Geocoder
+	switch settings.GeocoderBackend {
+	case "", "offline":
+		offline, err := NewOfflineGeocoder(settings.GeocoderDatasetPath)
+		if err != nil {
+			return nil, err
+		}
+		geocoder = offline
+	case "nominatim":
+		if settings.NominatimURL == "" {
+			return nil, errors.New("NOMINATIM_URL is required for the nominatim geocoder")
+		}
+		geocoder = NewNominatimGeocoder(settings.NominatimURL)
+	default:
+		return nil, fmt.Errorf("unknown geocoder backend: %s", settings.GeocoderBackend)
+	}
+
+	return NewCachedGeocoder(geocoder, 24*time.Hour), nil
+}
+
+type gazetteerPlace struct {
+	Name        string
+	CountryCode string
+	Latitude    float64
+	Longitude   float64
+}
+
+// OfflineGeocoder resolves the nearest populated place from a GeoNames-style city dataset held in memory.
+type OfflineGeocoder struct {
+	// places bucketed by whole degree of latitude/longitude
+	grid map[[2]int][]gazetteerPlace
+}
+
+// NewOfflineGeocoder loads the gazetteer at datasetPath, or the bundled one when the path is empty
+func NewOfflineGeocoder(datasetPath string) (*OfflineGeocoder, error) {
+	var reader io.ReadCloser
+	var err error
+	if datasetPath == "" {
+		reader, err = gazetteerFS.Open("data/geonames_cities.tsv")
+	} else {
+		reader, err = os.Open(datasetPath)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "error opening gazetteer")
+	}
+	defer reader.Close()
+
+	places, err := parseGazetteer(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	g := &OfflineGeocoder{grid: make(map[[2]int][]gazetteerPlace)}
+	for _, place := range places {
+		cell := gridCell(place.Latitude, place.Longitude)
+		g.grid[cell] = append(g.grid[cell], place)
+	}
+
+	return g, nil
+}
+
+// parseGazetteer reads the GeoNames dump format, see https://download.geonames.org/export/dump/readme.txt
+func parseGazetteer(r io.Reader) ([]gazetteerPlace, error) {
+	var places []gazetteerPlace
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Split(line, "\t")
+		if len(fields) < 15 {
+			return nil, fmt.Errorf("gazetteer line %d: expected at least 15 columns, got %d", lineNumber, len(fields))
+		}
+
+		lat, err := strconv.ParseFloat(fields[4], 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "gazetteer line %d: invalid latitude", lineNumber)
+		}
+		lon, err := strconv.ParseFloat(fields[5], 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "gazetteer line %d: invalid longitude", lineNumber)
+		}
+		places = append(places, gazetteerPlace{
+			Name:        fields[1],
+			CountryCode: fields[8],
+			Latitude:    lat,
+			Longitude:   lon,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "error reading gazetteer")
+	}
+	if len(places) == 0 {
+		return nil, errors.New("gazetteer is empty")
+	}
+
+	return places, nil
+}
+
+func (g *OfflineGeocoder) ReverseGeocode(_ context.Context, location LatLon) (string, error) {
+	center := gridCell(location.Latitude, location.Longitude)
+
+	var nearest *gazetteerPlace
+	nearestDistance := math.MaxFloat64
+	// 1 degree of latitude is ~111km, so two rings of cells cover offlineGeocoderMaxDistanceKm
+	for dLat := -2; dLat <= 2; dLat++ {
+		for dLon := -2; dLon <= 2; dLon++ {
+			cell := [2]int{center[0] + dLat, wrapLongitudeCell(center[1] + dLon)}
+			for i, place := range g.grid[cell] {
+				distance := HaversineKm(location, LatLon{Latitude: place.Latitude, Longitude: place.Longitude})
+				if distance < nearestDistance {
+					nearestDistance = distance
+					nearest = &g.grid[cell][i]
+				}
+			}
+		}
+	}
+
+	if nearest == nil || nearestDistance > offlineGeocoderMaxDistanceKm {
+		return "", nil
+	}
+
+	return fmt.Sprintf("%s, %s", nearest.Name, nearest.CountryCode), nil
+}
+
+func gridCell(lat, lon float64) [2]int {
+	return [2]int{int(math.Floor(lat)), wrapLongitudeCell(int(math.Floor(lon)))}
+}
+
+func wrapLongitudeCell(lon int) int {
+	return ((lon+180)%360+360)%360 - 180
+}
+
+// HaversineKm returns the great-circle distance between two coordinates in kilometers
+func HaversineKm(a, b LatLon) float64 {
+	lat1 := a.Latitude * math.Pi / 180
+	lat2 := b.Latitude * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (b.Longitude - a.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadiusKm * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// NominatimGeocoder queries a Nominatim-compatible /reverse endpoint, eg. a local instance
+type NominatimGeocoder struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewNominatimGeocoder(baseURL string) *NominatimGeocoder {
+	return &NominatimGeocoder{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (n *NominatimGeocoder) ReverseGeocode(ctx context.Context, location LatLon) (string, error) {
+	params := url.Values{}
+	params.Set("format", "jsonv2")
+	params.Set("lat", strconv.FormatFloat(location.Latitude, 'f', 6, 64))
+	params.Set("lon", strconv.FormatFloat(location.Longitude, 'f', 6, 64))
+	params.Set("zoom", "14")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", n.baseURL+"/reverse?"+params.Encode(), nil)
+	if err != nil {
+		return "", err
+	}
+	// nominatim usage policy requires an identifying user agent
+	req.Header.Set("User-Agent", "trips-web-app")
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return "", errors.Wrap(err, "error making request to nominatim")
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("invalid response from nominatim: %d, %s", resp.StatusCode, string(body))
+	}
+
+	var result struct {
+		Error       string            `json:"error"`
+		DisplayName string            `json:"display_name"`
+		Address     map[string]string `json:"address"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return "", errors.Wrap(err, "error parsing nominatim response")
+	}
+	if result.Error != "" {
+		// eg. "Unable to geocode" for locations in the middle of the ocean
+		return "", nil
+	}
+
+	for _, key := range []string{"city", "town", "village", "hamlet", "municipality", "suburb", "county"} {
+		if locality := result.Address[key]; locality != "" {
+			if countryCode := result.Address["country_code"]; countryCode != "" {
+				return fmt.Sprintf("%s, %s", locality, strings.ToUpper(countryCode)), nil
+			}
+			return locality, nil
+		}
+	}
+
+	return result.DisplayName, nil
+}
+
+// CachedGeocoder memoizes another geocoder by coordinate rounded to geocodeCachePrecision decimals
+type CachedGeocoder struct {
+	geocoder Geocoder
+	cache    *cache.Cache
+}
+
+func NewCachedGeocoder(geocoder Geocoder, ttl time.Duration) *CachedGeocoder {
+	return &CachedGeocoder{
+		geocoder: geocoder,
+		cache:    cache.New(ttl, 2*ttl),
+	}
+}
+
+func (c *CachedGeocoder) ReverseGeocode(ctx context.Context, location LatLon) (string, error) {
+	rounded := LatLon{
+		Latitude:  roundTo(location.Latitude, geocodeCachePrecision),
+		Longitude: roundTo(location.Longitude, geocodeCachePrecision),
+	}
+	key := fmt.Sprintf("%.*f,%.*f", geocodeCachePrecision, rounded.Latitude, geocodeCachePrecision, rounded.Longitude)
+
+	if name, found := c.cache.Get(key); found {
+		return name.(string), nil
+	}
+
+	name, err := c.geocoder.ReverseGeocode(ctx, rounded)
+	if err != nil {
+		return "", err
+	}
+	c.cache.SetDefault(key, name)
+
+	return name, nil
+}
+
+func roundTo(value float64, decimals int) float64 {
+	factor := math.Pow(10, float64(decimals))
+	return math.Round(value*factor) / factor
+}
@@ -0,0 +1,258 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const defaultGeofencePollInterval = time.Minute
+
+var errGeofenceSignedOut = errors.New("the session the vehicle was watched with signed out, watch it again to keep receiving alerts")
+
+// GeofenceSubscription asks the worker to watch a vehicle against the owner's places
+type GeofenceSubscription struct {
+	ID      string             `json:"id"`
+	Owner   string             `json:"owner"`
+	TokenID int64              `json:"tokenId"`
+	Target  NotificationTarget `json:"target"`
+	// AccessToken is the session JWT of the owner, used to exchange privilege tokens while they are offline.
+	// It is cleared when the session signs out.
+	AccessToken string `json:"-"`
+	// SessionID is the session AccessToken came from
+	SessionID string `json:"-"`
+	// ExpiresAt is the exp of AccessToken, the vehicle isn't watched after it until it is subscribed again
+	ExpiresAt  time.Time `json:"expiresAt"`
+	CreatedAt  time.Time `json:"createdAt"`
+	LastPolled time.Time `json:"lastPolled"`
+	LastError  string    `json:"lastError,omitempty"`
+}
+
+// GeofenceSubscriptionStore holds one subscription per owner and vehicle, in memory
+type GeofenceSubscriptionStore struct {
+	mu            sync.RWMutex
+	subscriptions map[string]*GeofenceSubscription
+}
+
+var GeofenceSubscriptions = NewGeofenceSubscriptionStore()
+
+func NewGeofenceSubscriptionStore() *GeofenceSubscriptionStore {
+	return &GeofenceSubscriptionStore{subscriptions: make(map[string]*GeofenceSubscription)}
+}
+
+func geofenceSubscriptionKey(owner string, tokenID int64) string {
+	return fmt.Sprintf("%s_%d", strings.ToLower(owner), tokenID)
+}
+
+// Subscribe creates or replaces the subscription of the owner for the vehicle
+func (s *GeofenceSubscriptionStore) Subscribe(owner string, tokenID int64, sessionID, accessToken string, target NotificationTarget) GeofenceSubscription {
+	sub := &GeofenceSubscription{
+		ID:          uuid.New().String(),
+		Owner:       strings.ToLower(owner),
+		TokenID:     tokenID,
+		Target:      target,
+		AccessToken: accessToken,
+		SessionID:   sessionID,
+		CreatedAt:   time.Now().UTC(),
+	}
+	sub.ExpiresAt, _ = jwtExpiry(accessToken)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions[geofenceSubscriptionKey(owner, tokenID)] = sub
+
+	return *sub
+}
+
+func (s *GeofenceSubscriptionStore) Unsubscribe(owner string, tokenID int64) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := geofenceSubscriptionKey(owner, tokenID)
+	if _, ok := s.subscriptions[key]; !ok {
+		return false
+	}
+	delete(s.subscriptions, key)
+	return true
+}
+
+// List returns the subscriptions of the owner, or all subscriptions when owner is empty
+func (s *GeofenceSubscriptionStore) List(owner string) []GeofenceSubscription {
+	owner = strings.ToLower(owner)
+
+	s.mu.RLock()
+	subs := make([]GeofenceSubscription, 0, len(s.subscriptions))
+	for _, sub := range s.subscriptions {
+		if owner == "" || sub.Owner == owner {
+			subs = append(subs, *sub)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(subs, func(i, j int) bool {
+		return subs[i].TokenID < subs[j].TokenID
+	})
+	return subs
+}
+
+// signOut stops the subscriptions polling with a JWT of the session, or only with accessToken when it is given
+func (s *GeofenceSubscriptionStore) signOut(sessionID, accessToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range s.subscriptions {
+		if sub.SessionID == sessionID && sub.AccessToken != "" && (accessToken == "" || sub.AccessToken == accessToken) {
+			sub.AccessToken = ""
+			sub.LastError = errGeofenceSignedOut.Error()
+		}
+	}
+}
+
+func (s *GeofenceSubscriptionStore) recordPoll(id string, pollErr error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sub := range s.subscriptions {
+		if sub.ID != id {
+			continue
+		}
+		sub.LastPolled = time.Now().UTC()
+		sub.LastError = ""
+		if pollErr != nil {
+			sub.LastError = pollErr.Error()
+		}
+	}
+}
+
+// GeofenceWorker polls the latest location of subscribed vehicles and raises alerts on enter/exit transitions
+type GeofenceWorker struct {
+	settings   *config.Settings
+	logger     *zerolog.Logger
+	dispatcher *AlertDispatcher
+	interval   time.Duration
+
+	// inside tracks, per subscription and place, whether the vehicle was inside on the last poll
+	inside map[string]map[string]bool
+}
+
+func NewGeofenceWorker(settings *config.Settings, logger *zerolog.Logger, dispatcher *AlertDispatcher) *GeofenceWorker {
+	interval := time.Duration(settings.GeofencePollIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = defaultGeofencePollInterval
+	}
+	return &GeofenceWorker{
+		settings:   settings,
+		logger:     logger,
+		dispatcher: dispatcher,
+		interval:   interval,
+		inside:     make(map[string]map[string]bool),
+	}
+}
+
+// Run polls until the context is cancelled
+func (w *GeofenceWorker) Run(ctx context.Context) {
+	w.logger.Info().Dur("interval", w.interval).Msg("Starting geofence worker")
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			w.Poll(ctx)
+		}
+	}
+}
+
+// Poll evaluates every subscription once
+func (w *GeofenceWorker) Poll(ctx context.Context) {
+	subscriptions := GeofenceSubscriptions.List("")
+
+	active := make(map[string]bool, len(subscriptions))
+	for _, sub := range subscriptions {
+		active[sub.ID] = true
+		err := w.evaluate(ctx, sub)
+		if err != nil {
+			w.logger.Warn().Err(err).Int64("tokenId", sub.TokenID).Msg("Failed to evaluate geofences")
+		}
+		GeofenceSubscriptions.recordPoll(sub.ID, err)
+	}
+
+	// forget the state of removed subscriptions
+	for id := range w.inside {
+		if !active[id] {
+			delete(w.inside, id)
+		}
+	}
+}
+
+func (w *GeofenceWorker) evaluate(ctx context.Context, sub GeofenceSubscription) error {
+	places := Places.ForVehicle(sub.Owner, sub.TokenID)
+	if len(places) == 0 {
+		return nil
+	}
+
+	if sub.AccessToken == "" {
+		return errGeofenceSignedOut
+	}
+	if accessTokenExpired(sub.ExpiresAt) {
+		return fmt.Errorf("the session the vehicle was watched with expired at %s, watch it again to keep receiving alerts", sub.ExpiresAt.Format(time.RFC3339))
+	}
+	privilegeToken, err := PrivilegeTokens.Get(w.settings, sub.AccessToken, sub.TokenID, LiveLocationPrivileges)
+	if err != nil {
+		return fmt.Errorf("could not get privilege token, the subscription may need to be renewed: %w", err)
+	}
+
+	location, timestamp, err := FetchLatestLocation(w.settings, sub.TokenID, privilegeToken)
+	if err != nil {
+		return err
+	}
+	if location == nil {
+		return nil
+	}
+
+	state, ok := w.inside[sub.ID]
+	if !ok {
+		state = make(map[string]bool)
+		w.inside[sub.ID] = state
+	}
+
+	for _, place := range places {
+		isInside := place.Contains(*location)
+		wasInside, known := state[place.ID]
+		state[place.ID] = isInside
+
+		// the first observation only establishes the state
+		if !known || wasInside == isInside {
+			continue
+		}
+
+		alert := Alert{
+			Owner:     sub.Owner,
+			TokenID:   sub.TokenID,
+			PlaceID:   place.ID,
+			PlaceName: place.Name,
+			Location:  location,
+			Timestamp: timestamp,
+		}
+		if isInside {
+			alert.Type = AlertTypeGeofenceEnter
+			alert.Message = fmt.Sprintf("Vehicle %d entered %s", sub.TokenID, place.Name)
+		} else {
+			alert.Type = AlertTypeGeofenceExit
+			alert.Message = fmt.Sprintf("Vehicle %d left %s", sub.TokenID, place.Name)
+		}
+
+		w.logger.Info().Int64("tokenId", sub.TokenID).Str("place", place.Name).Str("type", alert.Type).Msg("Geofence transition")
+		w.dispatcher.Dispatch(ctx, alert, sub.Target)
+	}
+
+	return nil
+}
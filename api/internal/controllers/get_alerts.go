@@ -0,0 +1,249 @@
+package controllers
+
+import (
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+type AlertsController struct {
+	settings *config.Settings
+	logger   *zerolog.Logger
+}
+
+func NewAlertsController(settings *config.Settings, logger *zerolog.Logger) AlertsController {
+	return AlertsController{settings: settings, logger: logger}
+}
+
+// GeofenceSubscriptionRequest is the JSON payload to watch a vehicle against the saved places
+type GeofenceSubscriptionRequest struct {
+	TokenID    int64  `json:"tokenId"`
+	WebhookURL string `json:"webhookUrl"`
+	Email      string `json:"email"`
+}
+
+// AlertRuleRequest is the JSON payload to create a threshold rule
+type AlertRuleRequest struct {
+	TokenID         int64   `json:"tokenId"`
+	Signal          string  `json:"signal"`
+	Operator        string  `json:"operator"`
+	Threshold       float64 `json:"threshold"`
+	DurationSeconds int     `json:"durationSeconds"`
+	Hysteresis      float64 `json:"hysteresis"`
+	CooldownSeconds int     `json:"cooldownSeconds"`
+	WebhookURL      string  `json:"webhookUrl"`
+	Email           string  `json:"email"`
+}
+
+// HandleAlerts renders the in-app alert feed and the geofence subscriptions
+func (a *AlertsController) HandleAlerts(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	accountVehicles, err := Vehicles.LookupAll(sessionAddresses(c), a.settings)
+	if err != nil {
+		a.logger.Error().Err(err).Msg("Error querying vehicles")
+		return c.Status(fiber.StatusInternalServerError).SendString("Error querying vehicles: " + err.Error())
+	}
+
+	// times are rendered as RFC3339 for timeago.js
+	alerts := Alerts.List(ethAddress, 0, 100)
+	alertRows := make([]fiber.Map, 0, len(alerts))
+	for _, alert := range alerts {
+		alertRows = append(alertRows, fiber.Map{
+			"TokenID":   alert.TokenID,
+			"Message":   alert.Message,
+			"Location":  alert.Location,
+			"Timestamp": alert.Timestamp.Format(time.RFC3339),
+		})
+	}
+
+	subscriptions := GeofenceSubscriptions.List(ethAddress)
+	subscriptionRows := make([]fiber.Map, 0, len(subscriptions))
+	for _, sub := range subscriptions {
+		lastPolled := ""
+		if !sub.LastPolled.IsZero() {
+			lastPolled = sub.LastPolled.Format(time.RFC3339)
+		}
+		// a signed out subscription has stopped already, its error says so
+		expiresAt := ""
+		if sub.AccessToken != "" {
+			expiresAt = formatOptionalTime(sub.ExpiresAt)
+		}
+		subscriptionRows = append(subscriptionRows, fiber.Map{
+			"TokenID":    sub.TokenID,
+			"Target":     sub.Target,
+			"LastPolled": lastPolled,
+			"LastError":  sub.LastError,
+			"ExpiresAt":  expiresAt,
+		})
+	}
+
+	rules := AlertRules.List(ethAddress)
+	ruleRows := make([]fiber.Map, 0, len(rules))
+	for _, rule := range rules {
+		lastEvaluated := ""
+		if !rule.LastEvaluated.IsZero() {
+			lastEvaluated = rule.LastEvaluated.Format(time.RFC3339)
+		}
+		lastValue := "-"
+		if rule.LastValue != nil {
+			lastValue = strconv.FormatFloat(*rule.LastValue, 'f', -1, 64)
+		}
+		expiresAt := ""
+		if rule.AccessToken != "" {
+			expiresAt = formatOptionalTime(rule.ExpiresAt)
+		}
+		ruleRows = append(ruleRows, fiber.Map{
+			"ID":            rule.ID,
+			"TokenID":       rule.TokenID,
+			"Condition":     rule.Condition(),
+			"Firing":        rule.State == AlertRuleStateFiring,
+			"State":         rule.State,
+			"LastValue":     lastValue,
+			"LastEvaluated": lastEvaluated,
+			"LastError":     rule.LastError,
+			"ExpiresAt":     expiresAt,
+		})
+	}
+
+	return c.Render("alerts", fiber.Map{
+		"Title":         "Alerts",
+		"Alerts":        alertRows,
+		"Subscriptions": subscriptionRows,
+		"Rules":         ruleRows,
+		"Vehicles":      accountVehicles.All(),
+	})
+}
+
+// HandleListAlerts returns the alert feed as JSON. Query params: tokenId (optional), limit (default 50)
+func (a *AlertsController) HandleListAlerts(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	var tokenID int64
+	if tokenIDStr := c.Query("tokenId"); tokenIDStr != "" {
+		var err error
+		if tokenID, err = strconv.ParseInt(tokenIDStr, 10, 64); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
+		}
+	}
+
+	limit := c.QueryInt("limit", 50)
+	if limit <= 0 || limit > maxAlertsPerOwner {
+		limit = 50
+	}
+
+	return c.JSON(Alerts.List(ethAddress, tokenID, limit))
+}
+
+func (a *AlertsController) HandleListGeofenceSubscriptions(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+	return c.JSON(GeofenceSubscriptions.List(ethAddress))
+}
+
+// HandleGeofenceSubscribe starts watching the vehicle. The session token is kept so the worker can poll while the user is away.
+func (a *AlertsController) HandleGeofenceSubscribe(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	var req GeofenceSubscriptionRequest
+	if err := c.BodyParser(&req); err != nil || req.TokenID <= 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	target := NotificationTarget{WebhookURL: req.WebhookURL, Email: req.Email}
+	if err := target.Validate(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	// the worker polls with the JWT of the wallet that gives access to the vehicle
+	accessToken, err := vehicleAccessTokenByID(c, a.settings, req.TokenID)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Session expired"})
+	}
+
+	// fail early if we can't get at the vehicle's location
+	if _, err := RequestPriviledgeToken(c, a.settings, req.TokenID, LiveLocationPrivileges); err != nil {
+		a.logger.Error().Err(err).Int64("tokenId", req.TokenID).Msg("Failed to get privilege token for geofence subscription")
+		_, message := privilegeErrorStatus(err, fiber.StatusForbidden, "Could not get access to this vehicle")
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": message})
+	}
+
+	sub := GeofenceSubscriptions.Subscribe(ethAddress, req.TokenID, c.Cookies(sessionCookieName), accessToken, target)
+
+	return c.Status(fiber.StatusCreated).JSON(sub)
+}
+
+func (a *AlertsController) HandleGeofenceUnsubscribe(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
+	}
+
+	if !GeofenceSubscriptions.Unsubscribe(ethAddress, tokenID) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Subscription not found"})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (a *AlertsController) HandleListAlertRules(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+	return c.JSON(AlertRules.List(ethAddress))
+}
+
+// HandleCreateAlertRule validates the rule against the signals the vehicle actually reports
+func (a *AlertsController) HandleCreateAlertRule(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	var req AlertRuleRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+
+	rule := AlertRule{
+		Owner:           ethAddress,
+		TokenID:         req.TokenID,
+		Signal:          req.Signal,
+		Operator:        req.Operator,
+		Threshold:       req.Threshold,
+		DurationSeconds: req.DurationSeconds,
+		Hysteresis:      req.Hysteresis,
+		CooldownSeconds: req.CooldownSeconds,
+		Target:          NotificationTarget{WebhookURL: req.WebhookURL, Email: req.Email},
+	}
+	if err := rule.Validate(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	accessToken, err := vehicleAccessTokenByID(c, a.settings, req.TokenID)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Session expired"})
+	}
+	rule.AccessToken = accessToken
+	rule.SessionID = c.Cookies(sessionCookieName)
+
+	signals, err := FetchAvailableSignals(req.TokenID, a.settings, c)
+	if err != nil {
+		a.logger.Error().Err(err).Int64("tokenId", req.TokenID).Msg("Failed to fetch available signals for alert rule")
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "Could not get access to this vehicle"})
+	}
+	if !slices.Contains(signals, req.Signal) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Signal is not available for this vehicle"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(AlertRules.Create(rule))
+}
+
+func (a *AlertsController) HandleDeleteAlertRule(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	if !AlertRules.Delete(ethAddress, c.Params("ruleID")) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Rule not found"})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
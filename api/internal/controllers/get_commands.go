@@ -0,0 +1,190 @@
+package controllers
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+// commandPendingTimeout marks commands failed that the devices API still reports pending after this long
+const commandPendingTimeout = 5 * time.Minute
+
+type CommandsController struct {
+	settings *config.Settings
+	logger   *zerolog.Logger
+	client   *CommandsClient
+}
+
+func NewCommandsController(settings *config.Settings, logger *zerolog.Logger) CommandsController {
+	return CommandsController{
+		settings: settings,
+		logger:   logger,
+		client:   NewCommandsClient(settings.DeviceCommandsAPIURL),
+	}
+}
+
+// HandleCommandsPage renders the command buttons and the command log of a vehicle
+func (cc *CommandsController) HandleCommandsPage(c *fiber.Ctx) error {
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid token ID")
+	}
+
+	vehicle, err := FindVehicleWithPrivileges(sessionAddresses(c), tokenID, CommandsPrivileges, cc.settings)
+	if err != nil {
+		return renderPrivilegeError(c, err, fiber.StatusInternalServerError, "Error querying vehicles")
+	}
+	if vehicle == nil {
+		return c.Status(fiber.StatusNotFound).SendString("Vehicle not found")
+	}
+
+	return c.Render("vehicle_commands", fiber.Map{
+		"Title":    "Commands",
+		"TokenID":  tokenID,
+		"Vehicle":  vehicle,
+		"Commands": VehicleCommands,
+		"Log":      commandLogRows(CommandLog.List(tokenID)),
+	})
+}
+
+// HandleSendCommand sends a command to the vehicle and logs it as pending until the devices API reports back
+func (cc *CommandsController) HandleSendCommand(c *fiber.Ctx) error {
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
+	}
+
+	command := FindVehicleCommand(c.Params("command"))
+	if command == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Unknown command " + c.Params("command")})
+	}
+
+	vehicle, err := FindVehicleWithPrivileges(sessionAddresses(c), tokenID, CommandsPrivileges, cc.settings)
+	if err != nil {
+		status, message := privilegeErrorStatus(err, fiber.StatusInternalServerError, "Error querying vehicles")
+		return c.Status(status).JSON(fiber.Map{"error": message})
+	}
+	if vehicle == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Vehicle not found"})
+	}
+
+	privilegeToken, err := RequestPriviledgeToken(c, cc.settings, tokenID, CommandsPrivileges)
+	if err != nil {
+		cc.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Failed to get privilege token for command")
+		status, message := privilegeErrorStatus(err, fiber.StatusInternalServerError, "Failed to get privilege token")
+		return c.Status(status).JSON(fiber.Map{"error": message})
+	}
+
+	entry := CommandLogEntry{
+		TokenID:  tokenID,
+		Command:  command.Name,
+		Label:    command.Label,
+		Status:   CommandStatusPending,
+		IssuedBy: vehicle.AccessAddress,
+	}
+
+	requestID, err := cc.client.Send(c.Context(), *privilegeToken, tokenID, *command)
+	if err != nil {
+		cc.logger.Error().Err(err).Int64("tokenId", tokenID).Str("command", command.Name).Msg("Failed to send command")
+		status, message := commandErrorStatus(err)
+		if accessToken, err := vehicleAccessToken(c, *vehicle); err == nil && status == fiber.StatusForbidden {
+			// the devices API rejected the token, the next command exchanges a new one
+			PrivilegeTokens.Invalidate(accessToken, tokenID, CommandsPrivileges)
+		}
+		entry.Status = CommandStatusFailed
+		entry.Message = message
+		CommandLog.Add(entry)
+		return c.Status(status).JSON(fiber.Map{"error": message})
+	}
+
+	entry.RequestID = requestID
+	entry = CommandLog.Add(entry)
+	cc.logger.Info().Int64("tokenId", tokenID).Str("command", command.Name).Str("requestId", requestID).Msg("Command sent")
+
+	return c.Status(fiber.StatusAccepted).JSON(entry)
+}
+
+// HandleListCommands returns the command log of the vehicle, following up the pending commands with the devices API
+func (cc *CommandsController) HandleListCommands(c *fiber.Ctx) error {
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
+	}
+
+	vehicle, err := FindVehicleWithPrivileges(sessionAddresses(c), tokenID, CommandsPrivileges, cc.settings)
+	if err != nil {
+		status, message := privilegeErrorStatus(err, fiber.StatusInternalServerError, "Error querying vehicles")
+		return c.Status(status).JSON(fiber.Map{"error": message})
+	}
+	if vehicle == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Vehicle not found"})
+	}
+
+	cc.refreshPending(c, tokenID)
+
+	return c.JSON(fiber.Map{"commands": CommandLog.List(tokenID)})
+}
+
+// refreshPending asks the devices API for the status of the commands still pending, the ones pending for too long are given up on
+func (cc *CommandsController) refreshPending(c *fiber.Ctx, tokenID int64) {
+	var privilegeToken *string
+	for _, entry := range CommandLog.List(tokenID) {
+		if entry.Status != CommandStatusPending {
+			continue
+		}
+		if time.Since(entry.CreatedAt) > commandPendingTimeout {
+			CommandLog.UpdateStatus(tokenID, entry.ID, CommandStatusFailed, "No response from the vehicle")
+			continue
+		}
+
+		if privilegeToken == nil {
+			token, err := RequestPriviledgeToken(c, cc.settings, tokenID, CommandsPrivileges)
+			if err != nil {
+				cc.logger.Warn().Err(err).Int64("tokenId", tokenID).Msg("Failed to get privilege token for command status")
+				return
+			}
+			privilegeToken = token
+		}
+
+		ctx, cancel := context.WithTimeout(c.Context(), 10*time.Second)
+		status, message, err := cc.client.Status(ctx, *privilegeToken, tokenID, entry.RequestID)
+		cancel()
+		if err != nil {
+			// the next poll tries again
+			cc.logger.Warn().Err(err).Int64("tokenId", tokenID).Str("requestId", entry.RequestID).Msg("Failed to get command status")
+			continue
+		}
+		if status != CommandStatusPending {
+			CommandLog.UpdateStatus(tokenID, entry.ID, status, message)
+		}
+	}
+}
+
+// commandErrorStatus answers with the status and message of a devices API error, 502 for anything else
+func commandErrorStatus(err error) (int, string) {
+	var serviceErr *CommandServiceError
+	if errors.As(err, &serviceErr) {
+		return serviceErr.Status, serviceErr.Message
+	}
+	return fiber.StatusBadGateway, "Failed to send command"
+}
+
+// commandLogRows formats the log for the commands page
+func commandLogRows(entries []CommandLogEntry) []fiber.Map {
+	rows := make([]fiber.Map, 0, len(entries))
+	for _, entry := range entries {
+		rows = append(rows, fiber.Map{
+			"Label":     entry.Label,
+			"Status":    entry.Status,
+			"Message":   entry.Message,
+			"IssuedBy":  entry.IssuedBy,
+			"CreatedAt": entry.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	return rows
+}
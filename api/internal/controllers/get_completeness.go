@@ -0,0 +1,179 @@
+package controllers
+
+import (
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	defaultCompletenessInterval = "15m"
+	defaultCompletenessRange    = 24 * time.Hour
+
+	// completenessConcurrency caps the parallel telemetry queries, one per signal
+	completenessConcurrency = 4
+)
+
+// HandleCompleteness renders the data completeness heatmap of the vehicle.
+// Query params: from, to (RFC3339 or yyyy-mm-ddThh:mm in UTC), interval (1m, 5m, 15m or 1h), signals (comma separated, all by default)
+func (v *VehiclesController) HandleCompleteness(c *fiber.Ctx) error {
+	report, vehicle, reportErr := v.completenessReport(c)
+	if reportErr != nil {
+		return c.Status(reportErr.Code).JSON(fiber.Map{"error": reportErr.Message})
+	}
+
+	signalRows := make([]fiber.Map, 0, len(report.Signals))
+	for _, signal := range report.Signals {
+		gaps := make([]string, 0, len(signal.LongestGaps))
+		for _, gap := range signal.LongestGaps {
+			gaps = append(gaps, fmt.Sprintf("%s for %s", gap.From.Format("Jan 2 15:04"), formatAge(gap.To.Sub(gap.From))))
+		}
+		constant := ""
+		if signal.Constant != nil {
+			constant = fmt.Sprintf("%v for %s from %s", signal.Constant.Value, formatAge(signal.Constant.To.Sub(signal.Constant.From)), signal.Constant.From.Format("Jan 2 15:04"))
+		}
+		signalRows = append(signalRows, fiber.Map{
+			"Signal":   signal.Signal,
+			"Buckets":  signal.Buckets,
+			"Coverage": fmt.Sprintf("%.1f%%", signal.Coverage*100),
+			"Gaps":     gaps,
+			"Constant": constant,
+			"Error":    signal.Error,
+		})
+	}
+
+	intervals := make([]string, 0, len(CompletenessIntervals))
+	for interval := range CompletenessIntervals {
+		intervals = append(intervals, interval)
+	}
+	slices.SortFunc(intervals, func(a, b string) int {
+		return int(CompletenessIntervals[a] - CompletenessIntervals[b])
+	})
+
+	return c.Render("completeness", fiber.Map{
+		"Title":        "Data Completeness",
+		"TokenID":      report.TokenID,
+		"Vehicle":      vehicle,
+		"From":         report.From.Format("2006-01-02T15:04"),
+		"To":           report.To.Format("2006-01-02T15:04"),
+		"Interval":     report.Interval,
+		"Intervals":    intervals,
+		"BucketCount":  len(report.BucketStarts),
+		"Signals":      signalRows,
+		"SignalFilter": c.Query("signals"),
+	})
+}
+
+// HandleCompletenessJSON returns the same report as JSON, for comparing devices outside the app
+func (v *VehiclesController) HandleCompletenessJSON(c *fiber.Ctx) error {
+	report, _, reportErr := v.completenessReport(c)
+	if reportErr != nil {
+		return c.Status(reportErr.Code).JSON(fiber.Map{"error": reportErr.Message})
+	}
+	return c.JSON(report)
+}
+
+// completenessReport builds the report from the request, errors carry the status to answer with
+func (v *VehiclesController) completenessReport(c *fiber.Ctx) (*CompletenessReport, *Vehicle, *fiber.Error) {
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Invalid token ID")
+	}
+
+	interval := c.Query("interval", defaultCompletenessInterval)
+	intervalDuration, ok := CompletenessIntervals[interval]
+	if !ok {
+		return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Interval must be 1m, 5m, 15m or 1h")
+	}
+
+	to := time.Now().UTC().Truncate(intervalDuration).Add(intervalDuration)
+	if c.Query("to") != "" {
+		if to, err = parseReportTime(c.Query("to")); err != nil {
+			return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Invalid to time")
+		}
+	}
+	from := to.Add(-defaultCompletenessRange)
+	if c.Query("from") != "" {
+		if from, err = parseReportTime(c.Query("from")); err != nil {
+			return nil, nil, fiber.NewError(fiber.StatusBadRequest, "Invalid from time")
+		}
+	}
+	if !from.Before(to) {
+		return nil, nil, fiber.NewError(fiber.StatusBadRequest, "From must be before to")
+	}
+	// counted before allocating them, a range of years would otherwise allocate millions of buckets
+	if count := completenessBucketCount(from, to, intervalDuration); count > maxCompletenessBuckets {
+		return nil, nil, fiber.NewError(fiber.StatusBadRequest,
+			fmt.Sprintf("The range has %d buckets, at most %d are allowed. Use a larger interval or a shorter range.", count, maxCompletenessBuckets))
+	}
+	bucketStarts := completenessBuckets(from, to, intervalDuration)
+
+	vehicle, _, err := FindAccessibleVehicle(sessionAddresses(c), tokenID, v.settings)
+	if err != nil {
+		v.logger.Error().Err(err).Msg("Error querying vehicles")
+		return nil, nil, fiber.NewError(fiber.StatusInternalServerError, "Error querying vehicles")
+	}
+	if vehicle == nil {
+		return nil, nil, fiber.NewError(fiber.StatusNotFound, "Vehicle not found")
+	}
+
+	privilegeToken, err := RequestPriviledgeToken(c, v.settings, tokenID, SignalsPrivileges)
+	if err != nil {
+		v.logger.Error().Err(err).Msg("Error obtaining privilege token")
+		return nil, nil, fiber.NewError(privilegeErrorStatus(err, fiber.StatusInternalServerError, "Failed to get access to the vehicle"))
+	}
+
+	signalNames, err := queryAvailableSignals(v.settings, tokenID, *privilegeToken)
+	if err != nil {
+		v.logger.Error().Err(err).Msg("Failed to fetch available signals")
+		return nil, nil, fiber.NewError(fiber.StatusInternalServerError, "Failed to fetch available signals")
+	}
+	if filter := c.Query("signals"); filter != "" {
+		requested := strings.Split(filter, ",")
+		signalNames = slices.DeleteFunc(signalNames, func(name string) bool {
+			return !slices.Contains(requested, name)
+		})
+	}
+	slices.Sort(signalNames)
+
+	report := &CompletenessReport{
+		TokenID:      tokenID,
+		From:         from,
+		To:           to,
+		Interval:     interval,
+		BucketStarts: bucketStarts,
+		Signals:      make([]SignalCompleteness, len(signalNames)),
+	}
+
+	group := errgroup.Group{}
+	group.SetLimit(completenessConcurrency)
+	for i, signalName := range signalNames {
+		group.Go(func() error {
+			entries, err := queryHistoricalSignalValues(v.settings, tokenID, signalName, interval, from.Format(time.RFC3339), to.Format(time.RFC3339), *privilegeToken)
+			if err != nil {
+				// one failing signal shouldn't hide the others
+				v.logger.Error().Err(err).Str("signal", signalName).Msg("Failed to fetch historical signal values")
+				report.Signals[i] = SignalCompleteness{Signal: signalName, Buckets: make([]bool, len(bucketStarts)), LongestGaps: []CompletenessGap{}, Error: "Failed to fetch data"}
+				return nil
+			}
+			report.Signals[i] = EvaluateSignalCompleteness(signalName, entries, bucketStarts, intervalDuration)
+			return nil
+		})
+	}
+	_ = group.Wait()
+
+	return report, vehicle, nil
+}
+
+// parseReportTime accepts RFC3339 or the value of a datetime-local input, taken as UTC
+func parseReportTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.UTC(), nil
+	}
+	return time.Parse("2006-01-02T15:04", value)
+}
@@ -0,0 +1,270 @@
+package controllers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+type CredentialsController struct {
+	settings *config.Settings
+	logger   *zerolog.Logger
+}
+
+func NewCredentialsController(settings *config.Settings, logger *zerolog.Logger) CredentialsController {
+	return CredentialsController{settings: settings, logger: logger}
+}
+
+// HandleCredentials renders the latest credential of each kind with its claims and whether it verifies
+func (cc *CredentialsController) HandleCredentials(c *fiber.Ctx) error {
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).SendString("Invalid token ID")
+	}
+
+	vehicle, err := FindVehicleWithPrivileges(sessionAddresses(c), tokenID, CredentialsPrivileges, cc.settings)
+	if err != nil {
+		return renderPrivilegeError(c, err, fiber.StatusInternalServerError, "Error querying vehicles")
+	}
+	if vehicle == nil {
+		return c.Status(fiber.StatusNotFound).SendString("Vehicle not found")
+	}
+
+	privilegeToken, err := RequestPriviledgeToken(c, cc.settings, tokenID, CredentialsPrivileges)
+	if err != nil {
+		cc.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Failed to get privilege token for credentials")
+		return renderPrivilegeError(c, err, fiber.StatusInternalServerError, "Failed to get privilege token")
+	}
+
+	now := time.Now().UTC()
+	credentials := make([]fiber.Map, 0, len(CredentialKinds))
+	for _, kind := range CredentialKinds {
+		row := fiber.Map{"Name": kind.Name, "Label": kind.Label, "Issuable": kind.Issuable}
+		raw, err := FetchLatestCredential(cc.settings, tokenID, kind, *privilegeToken)
+		switch {
+		case err != nil:
+			cc.logger.Error().Err(err).Int64("tokenId", tokenID).Str("kind", kind.Name).Msg("Failed to fetch credential")
+			row["Error"] = "Failed to fetch the credential"
+		case raw != nil:
+			row["Credential"] = cc.credentialDetails(raw, *privilegeToken, now)
+		}
+		credentials = append(credentials, row)
+	}
+
+	return c.Render("vehicle_credentials", fiber.Map{
+		"Title":            "Verifiable Credentials",
+		"TokenID":          tokenID,
+		"Vehicle":          vehicle,
+		"Credentials":      credentials,
+		"IssuerConfigured": cc.settings.VCIssuerAddress != "",
+		"IssuerAddress":    cc.settings.VCIssuerAddress,
+		"CanIssue":         cc.settings.AttestationAPIURL != "",
+	})
+}
+
+// HandleDownloadCredential returns the raw latest credential of a kind, for handing to whoever needs to verify it
+func (cc *CredentialsController) HandleDownloadCredential(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
+	}
+	kind := findCredentialKind(c.Params("kind"))
+	if kind == nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Unknown credential " + c.Params("kind")})
+	}
+
+	privilegeToken, status, message := cc.credentialsToken(c, ethAddress, tokenID)
+	if status != fiber.StatusOK {
+		return c.Status(status).JSON(fiber.Map{"error": message})
+	}
+
+	raw, err := FetchLatestCredential(cc.settings, tokenID, *kind, privilegeToken)
+	if err != nil {
+		cc.logger.Error().Err(err).Int64("tokenId", tokenID).Str("kind", kind.Name).Msg("Failed to fetch credential")
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Failed to fetch the credential"})
+	}
+	if raw == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "The vehicle has no " + kind.Label + " credential"})
+	}
+
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="vehicle-%d-%s-credential.json"`, tokenID, kind.Name))
+	c.Set(fiber.HeaderContentType, fiber.MIMEApplicationJSON)
+	return c.Send(raw)
+}
+
+// HandleIssueVINCredential asks the attestation API to issue a fresh VIN credential for the vehicle
+func (cc *CredentialsController) HandleIssueVINCredential(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
+	}
+
+	privilegeToken, status, message := cc.credentialsToken(c, ethAddress, tokenID)
+	if status != fiber.StatusOK {
+		return c.Status(status).JSON(fiber.Map{"error": message})
+	}
+
+	if err := issueVINCredential(cc.settings, tokenID, privilegeToken); err != nil {
+		cc.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Failed to issue VIN credential")
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"message": "VIN credential issued"})
+}
+
+// HandleVerifyCredential verifies a credential posted as the request body, e.g. one a partner received from the owner
+func (cc *CredentialsController) HandleVerifyCredential(c *fiber.Ctx) error {
+	raw := c.Body()
+	if !json.Valid(raw) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "The credential isn't valid JSON"})
+	}
+
+	now := time.Now().UTC()
+	verification, err := VerifyCredential(raw, cc.settings, now, func(statusURL string) (bool, error) {
+		return credentialStatusRevoked(cc.settings, "", statusURL)
+	})
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	claims, err := CredentialClaims(raw)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	return c.JSON(fiber.Map{"verification": verification, "claims": claims})
+}
+
+// credentialsToken checks the address holds the credentials privilege on the vehicle and returns a token for it,
+// or the status and message to answer with
+func (cc *CredentialsController) credentialsToken(c *fiber.Ctx, ethAddress string, tokenID int64) (string, int, string) {
+	vehicle, err := FindVehicleWithPrivileges(sessionAddresses(c), tokenID, CredentialsPrivileges, cc.settings)
+	if err != nil {
+		status, message := privilegeErrorStatus(err, fiber.StatusInternalServerError, "Error querying vehicles")
+		return "", status, message
+	}
+	if vehicle == nil {
+		return "", fiber.StatusNotFound, "Vehicle not found"
+	}
+
+	privilegeToken, err := RequestPriviledgeToken(c, cc.settings, tokenID, CredentialsPrivileges)
+	if err != nil {
+		cc.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Failed to get privilege token for credentials")
+		status, message := privilegeErrorStatus(err, fiber.StatusInternalServerError, "Failed to get privilege token")
+		return "", status, message
+	}
+	return *privilegeToken, fiber.StatusOK, ""
+}
+
+// credentialDetails verifies the credential and formats it with its claims for the page
+func (cc *CredentialsController) credentialDetails(raw []byte, privilegeToken string, now time.Time) fiber.Map {
+	verification, err := VerifyCredential(raw, cc.settings, now, func(statusURL string) (bool, error) {
+		return credentialStatusRevoked(cc.settings, privilegeToken, statusURL)
+	})
+	if err != nil {
+		return fiber.Map{"Status": CredentialStatusInvalid, "StatusClass": CredentialStatusInvalid, "Reason": err.Error()}
+	}
+	claims, err := CredentialClaims(raw)
+	if err != nil {
+		return fiber.Map{"Status": CredentialStatusInvalid, "StatusClass": CredentialStatusInvalid, "Reason": err.Error()}
+	}
+
+	details := fiber.Map{
+		"Status":        verification.Status,
+		"StatusClass":   strings.ReplaceAll(verification.Status, " ", "-"),
+		"Reason":        verification.Reason,
+		"Issuer":        verification.Issuer,
+		"Signer":        verification.Signer,
+		"TrustedIssuer": verification.TrustedIssuer,
+		"Claims":        claims,
+	}
+	if !verification.ValidFrom.IsZero() {
+		details["ValidFrom"] = verification.ValidFrom.Format(time.RFC3339)
+	}
+	if !verification.ValidTo.IsZero() {
+		details["ValidTo"] = verification.ValidTo.Format(time.RFC3339)
+	}
+	return details
+}
+
+func findCredentialKind(name string) *CredentialKind {
+	for _, kind := range CredentialKinds {
+		if kind.Name == name {
+			return &kind
+		}
+	}
+	return nil
+}
+
+// FetchLatestCredential returns the raw latest credential of the kind from the telemetry API, nil if the vehicle has none
+func FetchLatestCredential(settings *config.Settings, tokenID int64, kind CredentialKind, privilegeToken string) ([]byte, error) {
+	graphqlQuery := fmt.Sprintf(`{
+		%s(tokenId: %d) {
+			rawVC
+		}
+	}`, kind.Query, tokenID)
+
+	resp, err := makeGraphQLRequest(settings.TelemetryAPIURL, graphqlQuery, &privilegeToken)
+	if err != nil {
+		return nil, err
+	}
+
+	var result struct {
+		Data map[string]*struct {
+			RawVC string `json:"rawVC"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return nil, errors.Wrap(err, "error parsing credential response")
+	}
+
+	credential := result.Data[kind.Query]
+	if credential == nil || credential.RawVC == "" {
+		// the telemetry API answers a vehicle without the credential with a null and a not found error
+		if len(result.Errors) > 0 && !strings.Contains(strings.ToLower(result.Errors[0].Message), "not found") {
+			return nil, errors.New(result.Errors[0].Message)
+		}
+		return nil, nil
+	}
+	return []byte(credential.RawVC), nil
+}
+
+// issueVINCredential has the attestation API attest the VIN the vehicle reports, the telemetry API serves it shortly after
+func issueVINCredential(settings *config.Settings, tokenID int64, privilegeToken string) error {
+	if settings.AttestationAPIURL == "" {
+		return errors.New("Issuing credentials is not configured")
+	}
+
+	url := fmt.Sprintf("%s/v1/vc/vin/%d", strings.TrimSuffix(settings.AttestationAPIURL, "/"), tokenID)
+	req, err := http.NewRequest(http.MethodPost, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", privilegeToken))
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.New("Attestation API is unreachable")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+		return errors.New("Attestation API error: " + upstreamErrorMessage(body, http.StatusText(resp.StatusCode)))
+	}
+	return nil
+}
@@ -0,0 +1,181 @@
+package controllers
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+)
+
+// fleetHealthConcurrency caps how many vehicles are queried at once for the fleet table
+const fleetHealthConcurrency = 4
+
+type DeviceHealthController struct {
+	settings   *config.Settings
+	logger     *zerolog.Logger
+	thresholds StalenessThresholds
+}
+
+func NewDeviceHealthController(settings *config.Settings, logger *zerolog.Logger) (DeviceHealthController, error) {
+	thresholds, err := NewStalenessThresholds(settings)
+	if err != nil {
+		return DeviceHealthController{}, err
+	}
+	return DeviceHealthController{settings: settings, logger: logger, thresholds: thresholds}, nil
+}
+
+// HandleFleetHealth renders every owned and shared vehicle, the ones that haven't reported for the longest first
+func (h *DeviceHealthController) HandleFleetHealth(c *fiber.Ctx) error {
+	if _, err := sessionAccessToken(c); err != nil {
+		return c.Render("session_expired", fiber.Map{})
+	}
+
+	accountVehicles, err := Vehicles.LookupAll(sessionAddresses(c), h.settings)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Error querying vehicles")
+		return c.Status(fiber.StatusInternalServerError).SendString("Error querying vehicles: " + err.Error())
+	}
+	vehicles, sharedVehicles := accountVehicles.Owned, accountVehicles.Shared
+	all := append(vehicles, sharedVehicles...)
+
+	// each vehicle is read with the JWT of the wallet that gives access to it
+	accessTokens := make([]string, len(all))
+	for i, vehicle := range all {
+		if accessTokens[i], err = vehicleAccessToken(c, vehicle); err != nil {
+			return c.Render("session_expired", fiber.Map{})
+		}
+	}
+
+	fleet := make([]VehicleHealth, len(all))
+	now := time.Now().UTC()
+
+	group := errgroup.Group{}
+	group.SetLimit(fleetHealthConcurrency)
+	for i, vehicle := range all {
+		shared := i >= len(vehicles)
+		accessToken := accessTokens[i]
+		group.Go(func() error {
+			// a vehicle that fails shows up with its error, it shouldn't hide the rest of the fleet
+			fleet[i] = h.vehicleHealth(accessToken, vehicle, shared, now)
+			return nil
+		})
+	}
+	_ = group.Wait()
+
+	SortByStaleness(fleet)
+
+	rows := make([]fiber.Map, 0, len(fleet))
+	for _, health := range fleet {
+		rows = append(rows, h.healthRow(health, now))
+	}
+
+	return c.Render("device_health", fiber.Map{
+		"Title":             "Device Health",
+		"Fleet":             rows,
+		"DefaultStaleAfter": formatAge(h.thresholds.Default),
+		"OfflineAfter":      formatAge(h.thresholds.Offline),
+	})
+}
+
+// HandleVehicleHealth renders the freshness of every signal of one vehicle
+func (h *DeviceHealthController) HandleVehicleHealth(c *fiber.Ctx) error {
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
+	}
+
+	vehicle, shared, err := FindAccessibleVehicle(sessionAddresses(c), tokenID, h.settings)
+	if err != nil {
+		h.logger.Error().Err(err).Msg("Error querying vehicles")
+		return c.Status(fiber.StatusInternalServerError).SendString("Error querying vehicles: " + err.Error())
+	}
+	if vehicle == nil {
+		return c.Status(fiber.StatusNotFound).SendString("Vehicle not found")
+	}
+
+	accessToken, err := vehicleAccessToken(c, *vehicle)
+	if err != nil {
+		return c.Render("session_expired", fiber.Map{})
+	}
+
+	now := time.Now().UTC()
+	health := h.vehicleHealth(accessToken, *vehicle, shared, now)
+
+	signalRows := make([]fiber.Map, 0, len(health.Signals))
+	for _, signal := range health.Signals {
+		signalRows = append(signalRows, fiber.Map{
+			"Name":      signal.Name,
+			"Value":     signal.Value,
+			"Timestamp": signal.Timestamp.Format(time.RFC3339),
+			"Age":       formatAge(signal.Age),
+			"Threshold": formatAge(signal.Threshold),
+			"Stale":     signal.Stale,
+		})
+	}
+
+	return c.Render("vehicle_health", fiber.Map{
+		"Title":   "Device Health",
+		"Vehicle": h.healthRow(health, now),
+		"Signals": signalRows,
+	})
+}
+
+func (h *DeviceHealthController) vehicleHealth(accessToken string, vehicle Vehicle, shared bool, now time.Time) VehicleHealth {
+	health := VehicleHealth{Vehicle: vehicle, Shared: shared, Status: DeviceStatusUnknown}
+
+	privilegeToken, err := PrivilegeTokens.Get(h.settings, accessToken, vehicle.TokenID, SignalsPrivileges)
+	if err != nil {
+		h.logger.Error().Err(err).Int64("tokenId", vehicle.TokenID).Msg("Failed to get privilege token for device health")
+		health.Error = "No access to the vehicle's signals"
+		return health
+	}
+
+	signalNames, err := queryAvailableSignals(h.settings, vehicle.TokenID, privilegeToken)
+	if err != nil {
+		h.logger.Error().Err(err).Int64("tokenId", vehicle.TokenID).Msg("Failed to fetch available signals for device health")
+		health.Error = "Failed to fetch available signals"
+		return health
+	}
+	if len(signalNames) == 0 {
+		return health
+	}
+
+	entries, err := queryLatestSignalValues(h.settings, vehicle.TokenID, signalNames, privilegeToken)
+	if err != nil {
+		h.logger.Error().Err(err).Int64("tokenId", vehicle.TokenID).Msg("Failed to fetch latest signals for device health")
+		health.Error = "Failed to fetch latest signal values"
+		return health
+	}
+
+	health = EvaluateVehicleHealth(vehicle, entries, h.thresholds, now)
+	health.Shared = shared
+	return health
+}
+
+// healthRow flattens the health for the templates, times are rendered as RFC3339 for timeago.js
+func (h *DeviceHealthController) healthRow(health VehicleHealth, now time.Time) fiber.Map {
+	lastSeen, lastSeenAge := "", ""
+	if health.LastSeen != nil {
+		lastSeen = health.LastSeen.Format(time.RFC3339)
+		lastSeenAge = formatAge(now.Sub(*health.LastSeen))
+	}
+
+	return fiber.Map{
+		"TokenID":      health.Vehicle.TokenID,
+		"Definition":   health.Vehicle.Definition,
+		"Shared":       health.Shared,
+		"Serial":       health.Vehicle.AftermarketDevice.Serial,
+		"Manufacturer": health.Vehicle.AftermarketDevice.Manufacturer.Name,
+		"LastSeen":     lastSeen,
+		"LastSeenAge":  lastSeenAge,
+		"Status":       health.Status,
+		"Offline":      health.Status == DeviceStatusOffline || health.Status == DeviceStatusUnknown,
+		"Stale":        health.Status == DeviceStatusStale,
+		"StaleSignals": health.StaleSignals,
+		"TotalSignals": len(health.Signals),
+		"Error":        health.Error,
+	}
+}
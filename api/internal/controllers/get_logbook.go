@@ -0,0 +1,511 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/go-pdf/fpdf"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// maxTripsPages guards against paging through the trips API forever
+	maxTripsPages = 100
+	// odometerQueryConcurrency limits parallel telemetry queries when building a logbook
+	odometerQueryConcurrency = 5
+)
+
+// LogbookEntry is a single trip row of a mileage logbook.
+type LogbookEntry struct {
+	TripID        string
+	StartTime     time.Time
+	EndTime       time.Time
+	StartAddress  string
+	EndAddress    string
+	OdometerStart *float64
+	OdometerEnd   *float64
+	DistanceKm    *float64
+	Purpose       string
+}
+
+// LogbookPeriodTotal holds the aggregated trips and distance for one period (day, week or month).
+type LogbookPeriodTotal struct {
+	Period     string
+	Trips      int
+	DistanceKm float64
+}
+
+type Logbook struct {
+	TokenID         int64
+	From            time.Time
+	To              time.Time
+	Entries         []LogbookEntry
+	Totals          []LogbookPeriodTotal
+	TotalDistanceKm float64
+}
+
+// tripPurposeStore keeps the user provided purpose of each trip, eg. "Business" or "Commute"
+type tripPurposeStore struct {
+	mu       sync.RWMutex
+	purposes map[string]string
+}
+
+var TripPurposes = &tripPurposeStore{purposes: make(map[string]string)}
+
+func (s *tripPurposeStore) Get(tripID string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.purposes[tripID]
+}
+
+func (s *tripPurposeStore) Set(tripID, purpose string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if purpose == "" {
+		delete(s.purposes, tripID)
+		return
+	}
+	s.purposes[tripID] = purpose
+}
+
+// HandleSetTripPurpose stores the purpose of a trip so it shows up in the logbook
+func (t *TripsController) HandleSetTripPurpose(c *fiber.Ctx) error {
+	tripID := c.Params("tripID")
+	tokenID, exists := TripVehicles.Get(tripID)
+	if !exists {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Trip not found"})
+	}
+	// trip IDs are shared by every session, only the ones that can see the vehicle may label its trips
+	vehicle, _, err := FindAccessibleVehicle(sessionAddresses(c), tokenID, t.settings)
+	if err != nil {
+		t.logger.Error().Err(err).Msg("Error querying vehicles")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error querying vehicles"})
+	}
+	if vehicle == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Trip not found"})
+	}
+
+	var req struct {
+		Purpose string `json:"purpose"`
+	}
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+
+	TripPurposes.Set(tripID, req.Purpose)
+
+	return c.JSON(fiber.Map{"tripId": tripID, "purpose": req.Purpose})
+}
+
+// HandleLogbook generates a mileage logbook for a vehicle over a date range, as CSV or PDF.
+// Query params: from, to (YYYY-MM-DD, inclusive), format (csv|pdf), period (day|week|month)
+func (t *TripsController) HandleLogbook(c *fiber.Ctx) error {
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid token ID",
+		})
+	}
+
+	to := time.Now().UTC()
+	from := to.AddDate(0, 0, -30)
+	if fromStr := c.Query("from"); fromStr != "" {
+		if from, err = time.Parse(time.DateOnly, fromStr); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid from date, expected YYYY-MM-DD"})
+		}
+	}
+	if toStr := c.Query("to"); toStr != "" {
+		if to, err = time.Parse(time.DateOnly, toStr); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid to date, expected YYYY-MM-DD"})
+		}
+		// include the whole last day
+		to = to.AddDate(0, 0, 1)
+	}
+	if !from.Before(to) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "from must be before to"})
+	}
+
+	period := c.Query("period", "month")
+	if period != "day" && period != "week" && period != "month" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid period, expected day, week or month"})
+	}
+
+	format := c.Query("format", "csv")
+	if format != "csv" && format != "pdf" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid format, expected csv or pdf"})
+	}
+
+	logbook, err := t.BuildLogbook(c, tokenID, from, to, period)
+	if err != nil {
+		t.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Failed to build logbook")
+		return renderPrivilegeError(c, err, fiber.StatusInternalServerError, "Failed to build logbook")
+	}
+
+	fileName := fmt.Sprintf("logbook_%d_%s_%s", tokenID, from.Format(time.DateOnly), to.AddDate(0, 0, -1).Format(time.DateOnly))
+
+	var buf bytes.Buffer
+	if format == "pdf" {
+		if err := writeLogbookPDF(&buf, logbook); err != nil {
+			t.logger.Error().Err(err).Msg("Failed to render logbook PDF")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to render logbook"})
+		}
+		c.Set(fiber.HeaderContentType, "application/pdf")
+	} else {
+		if err := writeLogbookCSV(&buf, logbook); err != nil {
+			t.logger.Error().Err(err).Msg("Failed to render logbook CSV")
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to render logbook"})
+		}
+		c.Set(fiber.HeaderContentType, "text/csv; charset=utf-8")
+	}
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="%s.%s"`, fileName, format))
+
+	return c.Send(buf.Bytes())
+}
+
+// BuildLogbook collects the trips of the vehicle within [from, to) and enriches them with odometer readings
+func (t *TripsController) BuildLogbook(c *fiber.Ctx, tokenID int64, from, to time.Time, period string) (*Logbook, error) {
+	trips, err := t.FetchTripsInRange(c, tokenID, from, to)
+	if err != nil {
+		return nil, errors.Wrap(err, "error fetching trips")
+	}
+
+	privilegeToken, err := RequestPriviledgeToken(c, t.settings, tokenID, TripsPrivileges)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting privilege token")
+	}
+
+	annotateSavedPlaces(trips, Places.ForVehicle(c.Locals("ethereum_address").(string), tokenID))
+
+	entries := make([]LogbookEntry, len(trips))
+	// the addresses are looked up in parallel like for the trips list, a month of trips one by one takes minutes
+	geocodeGroup := errgroup.Group{}
+	geocodeGroup.SetLimit(geocodeConcurrency)
+	for i, trip := range trips {
+		startTime, _ := time.Parse(time.RFC3339, trip.Start.Time)
+		endTime, _ := time.Parse(time.RFC3339, trip.End.Time)
+		entries[i] = LogbookEntry{
+			TripID:    trip.ID,
+			StartTime: startTime,
+			EndTime:   endTime,
+			Purpose:   TripPurposes.Get(trip.ID),
+		}
+
+		entry := &entries[i]
+		geocodeGroup.Go(func() error {
+			entry.StartAddress = t.logbookAddress(c.UserContext(), trip.Start)
+			entry.EndAddress = t.logbookAddress(c.UserContext(), trip.End)
+			return nil
+		})
+	}
+	_ = geocodeGroup.Wait()
+
+	group := errgroup.Group{}
+	group.SetLimit(odometerQueryConcurrency)
+	for i := range entries {
+		entry := &entries[i]
+		group.Go(func() error {
+			odoStart, odoEnd, err := FetchOdometerRange(t.settings, tokenID, entry.StartTime, entry.EndTime, *privilegeToken)
+			if err != nil {
+				// a missing odometer should not fail the whole logbook
+				t.logger.Warn().Err(err).Str("tripId", entry.TripID).Msg("Failed to fetch odometer for trip")
+				return nil
+			}
+			entry.OdometerStart = odoStart
+			entry.OdometerEnd = odoEnd
+			if odoStart != nil && odoEnd != nil {
+				distance := *odoEnd - *odoStart
+				entry.DistanceKm = &distance
+			}
+			return nil
+		})
+	}
+	_ = group.Wait()
+
+	logbook := &Logbook{
+		TokenID: tokenID,
+		From:    from,
+		To:      to,
+		Entries: entries,
+	}
+
+	totals := map[string]*LogbookPeriodTotal{}
+	for _, entry := range entries {
+		key := logbookPeriodKey(entry.StartTime, period)
+		total, ok := totals[key]
+		if !ok {
+			total = &LogbookPeriodTotal{Period: key}
+			totals[key] = total
+		}
+		total.Trips++
+		if entry.DistanceKm != nil {
+			total.DistanceKm += *entry.DistanceKm
+			logbook.TotalDistanceKm += *entry.DistanceKm
+		}
+	}
+	for _, total := range totals {
+		logbook.Totals = append(logbook.Totals, *total)
+	}
+	sort.Slice(logbook.Totals, func(i, j int) bool {
+		return logbook.Totals[i].Period < logbook.Totals[j].Period
+	})
+
+	return logbook, nil
+}
+
+// FetchTripsInRange pages through the trips API and returns the trips that started within [from, to), oldest first
+func (t *TripsController) FetchTripsInRange(c *fiber.Ctx, tokenID int64, from, to time.Time) ([]Trip, error) {
+	privilegeToken, err := RequestPriviledgeToken(c, t.settings, tokenID, TripsPrivileges)
+	if err != nil {
+		return nil, errors.Wrap(err, "error getting privilege token")
+	}
+
+	var trips []Trip
+	for page := 1; page <= maxTripsPages; page++ {
+		tripsResponse, err := fetchTripsPage(t.settings, tokenID, page, *privilegeToken)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, trip := range tripsResponse.Trips {
+			startTime, err := time.Parse(time.RFC3339, trip.Start.Time)
+			if err != nil {
+				log.Warn().Err(err).Str("tripId", trip.ID).Msg("Skipping trip with invalid start time")
+				continue
+			}
+			if startTime.Before(from) || !startTime.Before(to) {
+				continue
+			}
+			TripVehicles.Set(trip.ID, tokenID)
+			trips = append(trips, trip)
+		}
+
+		if len(tripsResponse.Trips) == 0 || page >= tripsResponse.TotalPages {
+			break
+		}
+	}
+
+	sort.Slice(trips, func(i, j int) bool {
+		return trips[i].Start.Time < trips[j].Start.Time
+	})
+
+	return trips, nil
+}
+
+func fetchTripsPage(settings *config.Settings, tokenID int64, page int, privilegeToken string) (*TripsResponse, error) {
+	url := fmt.Sprintf("%s/vehicle/%d/trips?page=%d", settings.TripsAPIBaseURL, tokenID, page)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", privilegeToken))
+
+	client := &http.Client{}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	responseBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("invalid response from trips API: %d, %s", resp.StatusCode, string(responseBody))
+	}
+
+	var tripsResponse TripsResponse
+	if err := json.Unmarshal(responseBody, &tripsResponse); err != nil {
+		return nil, errors.Wrap(err, "error parsing trips API response")
+	}
+
+	return &tripsResponse, nil
+}
+
+// FetchOdometerRange returns the lowest and highest powertrainTransmissionTravelledDistance (km) seen between start and end
+func FetchOdometerRange(settings *config.Settings, tokenID int64, startTime, endTime time.Time, privilegeToken string) (*float64, *float64, error) {
+	var odometerData struct {
+		Data struct {
+			Signals []struct {
+				OdometerStart *float64 `json:"odometerStart"`
+				OdometerEnd   *float64 `json:"odometerEnd"`
+			} `json:"signals"`
+		} `json:"data"`
+	}
+
+	// a single bucket covering the whole trip
+	intervalSeconds := int64(endTime.Sub(startTime).Seconds()) + 1
+
+	graphqlQuery := fmt.Sprintf(`{
+		signals(tokenId: %d, interval: "%ds", from: "%s", to: "%s") {
+			odometerStart: powertrainTransmissionTravelledDistance(agg: MIN)
+			odometerEnd: powertrainTransmissionTravelledDistance(agg: MAX)
+		}
+	}`, tokenID, intervalSeconds, startTime.UTC().Format(time.RFC3339), endTime.UTC().Add(time.Second).Format(time.RFC3339))
+
+	resp, err := makeGraphQLRequest(settings.TelemetryAPIURL, graphqlQuery, &privilegeToken)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if err := json.Unmarshal(resp, &odometerData); err != nil {
+		return nil, nil, errors.Wrap(err, "error parsing odometer response")
+	}
+
+	var odoStart, odoEnd *float64
+	for _, signal := range odometerData.Data.Signals {
+		if signal.OdometerStart != nil && (odoStart == nil || *signal.OdometerStart < *odoStart) {
+			odoStart = signal.OdometerStart
+		}
+		if signal.OdometerEnd != nil && (odoEnd == nil || *signal.OdometerEnd > *odoEnd) {
+			odoEnd = signal.OdometerEnd
+		}
+	}
+
+	return odoStart, odoEnd, nil
+}
+
+// logbookAddress prefers the saved place name over the geocoded locality or coordinates
+func (t *TripsController) logbookAddress(ctx context.Context, point TripPoint) string {
+	if point.SavedPlace != "" {
+		return point.SavedPlace
+	}
+	return t.describeTripPoint(ctx, point)
+}
+
+func logbookPeriodKey(t time.Time, period string) string {
+	switch period {
+	case "day":
+		return t.Format(time.DateOnly)
+	case "week":
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-W%02d", year, week)
+	default:
+		return t.Format("2006-01")
+	}
+}
+
+func formatOptionalKm(value *float64) string {
+	if value == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*value, 'f', 1, 64)
+}
+
+// csvText keeps spreadsheets from running text as a formula, e.g. a purpose or place name starting with "="
+func csvText(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+func writeLogbookCSV(w io.Writer, logbook *Logbook) error {
+	writer := csv.NewWriter(w)
+
+	rows := [][]string{{"Date", "Trip ID", "Start Time", "End Time", "Start Address", "End Address", "Odometer Start (km)", "Odometer End (km)", "Distance (km)", "Purpose"}}
+	for _, entry := range logbook.Entries {
+		rows = append(rows, []string{
+			entry.StartTime.Format(time.DateOnly),
+			csvText(entry.TripID),
+			entry.StartTime.Format(time.TimeOnly),
+			entry.EndTime.Format(time.TimeOnly),
+			csvText(entry.StartAddress),
+			csvText(entry.EndAddress),
+			formatOptionalKm(entry.OdometerStart),
+			formatOptionalKm(entry.OdometerEnd),
+			formatOptionalKm(entry.DistanceKm),
+			csvText(entry.Purpose),
+		})
+	}
+
+	rows = append(rows, []string{}, []string{"Period", "Trips", "Distance (km)"})
+	for _, total := range logbook.Totals {
+		rows = append(rows, []string{total.Period, strconv.Itoa(total.Trips), formatOptionalKm(&total.DistanceKm)})
+	}
+	rows = append(rows, []string{"Total", strconv.Itoa(len(logbook.Entries)), formatOptionalKm(&logbook.TotalDistanceKm)})
+
+	if err := writer.WriteAll(rows); err != nil {
+		return err
+	}
+	return writer.Error()
+}
+
+func writeLogbookPDF(w io.Writer, logbook *Logbook) error {
+	pdf := fpdf.New("L", "mm", "A4", "")
+	pdf.SetTitle(fmt.Sprintf("Mileage logbook - vehicle %d", logbook.TokenID), true)
+	pdf.AddPage()
+	// core fonts are cp1252 encoded, addresses and purposes are free text
+	translate := pdf.UnicodeTranslatorFromDescriptor("")
+
+	pdf.SetFont("Helvetica", "B", 16)
+	pdf.Cell(0, 10, fmt.Sprintf("Mileage logbook - vehicle %d", logbook.TokenID))
+	pdf.Ln(8)
+	pdf.SetFont("Helvetica", "", 10)
+	pdf.Cell(0, 8, fmt.Sprintf("%s to %s", logbook.From.Format(time.DateOnly), logbook.To.AddDate(0, 0, -1).Format(time.DateOnly)))
+	pdf.Ln(12)
+
+	headers := []string{"Date", "Start", "End", "From", "To", "Odo start", "Odo end", "Km", "Purpose"}
+	widths := []float64{22, 16, 16, 50, 50, 24, 24, 18, 57}
+
+	pdf.SetFont("Helvetica", "B", 9)
+	pdf.SetFillColor(230, 230, 230)
+	for i, header := range headers {
+		pdf.CellFormat(widths[i], 7, header, "1", 0, "C", true, 0, "")
+	}
+	pdf.Ln(-1)
+
+	pdf.SetFont("Helvetica", "", 8)
+	for _, entry := range logbook.Entries {
+		cells := []string{
+			entry.StartTime.Format(time.DateOnly),
+			entry.StartTime.Format("15:04"),
+			entry.EndTime.Format("15:04"),
+			translate(entry.StartAddress),
+			translate(entry.EndAddress),
+			formatOptionalKm(entry.OdometerStart),
+			formatOptionalKm(entry.OdometerEnd),
+			formatOptionalKm(entry.DistanceKm),
+			translate(entry.Purpose),
+		}
+		for i, cell := range cells {
+			pdf.CellFormat(widths[i], 6, cell, "1", 0, "L", false, 0, "")
+		}
+		pdf.Ln(-1)
+	}
+
+	pdf.Ln(6)
+	pdf.SetFont("Helvetica", "B", 9)
+	pdf.CellFormat(40, 7, "Period", "1", 0, "C", true, 0, "")
+	pdf.CellFormat(20, 7, "Trips", "1", 0, "C", true, 0, "")
+	pdf.CellFormat(30, 7, "Distance (km)", "1", 0, "C", true, 0, "")
+	pdf.Ln(-1)
+	pdf.SetFont("Helvetica", "", 8)
+	for _, total := range logbook.Totals {
+		pdf.CellFormat(40, 6, total.Period, "1", 0, "L", false, 0, "")
+		pdf.CellFormat(20, 6, strconv.Itoa(total.Trips), "1", 0, "R", false, 0, "")
+		pdf.CellFormat(30, 6, formatOptionalKm(&total.DistanceKm), "1", 0, "R", false, 0, "")
+		pdf.Ln(-1)
+	}
+	pdf.SetFont("Helvetica", "B", 8)
+	pdf.CellFormat(40, 6, "Total", "1", 0, "L", false, 0, "")
+	pdf.CellFormat(20, 6, strconv.Itoa(len(logbook.Entries)), "1", 0, "R", false, 0, "")
+	pdf.CellFormat(30, 6, formatOptionalKm(&logbook.TotalDistanceKm), "1", 0, "R", false, 0, "")
+
+	return pdf.Output(w)
+}
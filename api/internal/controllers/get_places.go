@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+type PlacesController struct {
+	settings *config.Settings
+	logger   *zerolog.Logger
+	trips    *TripsController
+}
+
+func NewPlacesController(settings *config.Settings, logger *zerolog.Logger, trips *TripsController) PlacesController {
+	return PlacesController{settings: settings, logger: logger, trips: trips}
+}
+
+// CreatePlaceRequest is the JSON payload to save a place
+type CreatePlaceRequest struct {
+	Name         string   `json:"name"`
+	TokenID      *int64   `json:"tokenId"`
+	Shape        string   `json:"shape"`
+	Center       *LatLon  `json:"center"`
+	RadiusMeters float64  `json:"radiusMeters"`
+	Polygon      []LatLon `json:"polygon"`
+}
+
+// HandlePlaces renders the saved places of the account
+func (p *PlacesController) HandlePlaces(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	accountVehicles, err := Vehicles.LookupAll(sessionAddresses(c), p.settings)
+	if err != nil {
+		p.logger.Error().Err(err).Msg("Error querying vehicles")
+		return c.Status(fiber.StatusInternalServerError).SendString("Error querying vehicles: " + err.Error())
+	}
+
+	return c.Render("places", fiber.Map{
+		"Title":    "Saved Places",
+		"Places":   Places.List(ethAddress),
+		"Vehicles": accountVehicles.All(),
+	})
+}
+
+// HandleListPlaces returns the saved places as JSON, optionally only those applying to ?tokenId=
+func (p *PlacesController) HandleListPlaces(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	if tokenIDStr := c.Query("tokenId"); tokenIDStr != "" {
+		tokenID, err := strconv.ParseInt(tokenIDStr, 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
+		}
+		return c.JSON(Places.ForVehicle(ethAddress, tokenID))
+	}
+
+	return c.JSON(Places.List(ethAddress))
+}
+
+func (p *PlacesController) HandleCreatePlace(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	var req CreatePlaceRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+
+	place, err := Places.Create(Place{
+		Owner:        ethAddress,
+		TokenID:      req.TokenID,
+		Name:         req.Name,
+		Shape:        req.Shape,
+		Center:       req.Center,
+		RadiusMeters: req.RadiusMeters,
+		Polygon:      req.Polygon,
+	})
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(place)
+}
+
+func (p *PlacesController) HandleDeletePlace(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	if !Places.Delete(ethAddress, c.Params("placeID")) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Place not found"})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// HandlePlaceVisits renders the arrivals, departures and dwell times of a vehicle at a place over the last ?days= (default 30)
+func (p *PlacesController) HandlePlaceVisits(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	place, found := Places.Get(ethAddress, c.Params("placeID"))
+	if !found {
+		return c.Status(fiber.StatusNotFound).SendString("Place not found")
+	}
+
+	var tokenID int64
+	if place.TokenID != nil {
+		tokenID = *place.TokenID
+	} else {
+		var err error
+		tokenID, err = strconv.ParseInt(c.Query("tokenId"), 10, 64)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).SendString("tokenId is required for account wide places")
+		}
+	}
+
+	days := c.QueryInt("days", 30)
+	if days <= 0 || days > 365 {
+		return c.Status(fiber.StatusBadRequest).SendString("days must be between 1 and 365")
+	}
+	to := time.Now().UTC()
+	from := to.AddDate(0, 0, -days)
+
+	trips, err := p.trips.FetchTripsInRange(c, tokenID, from, to)
+	if err != nil {
+		p.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Failed to fetch trips for place visits")
+		return renderPrivilegeError(c, err, fiber.StatusInternalServerError, "Failed to fetch trips")
+	}
+
+	visits := ComputePlaceVisits(place, trips)
+
+	// an open visit is confirmed with the latest location, the vehicle may have left on a trip not yet processed
+	if len(visits) > 0 && visits[len(visits)-1].Departure.IsZero() {
+		last := &visits[len(visits)-1]
+		privilegeToken, err := RequestPriviledgeToken(c, p.settings, tokenID, LiveLocationPrivileges)
+		if err == nil {
+			location, timestamp, err := FetchLatestLocation(p.settings, tokenID, *privilegeToken)
+			if err != nil {
+				p.logger.Warn().Err(err).Int64("tokenId", tokenID).Msg("Failed to fetch latest location")
+			} else if location != nil && place.Contains(*location) && !last.Arrival.IsZero() {
+				last.Ongoing = true
+				last.Dwell = timestamp.Sub(last.Arrival)
+			}
+		}
+	}
+
+	if c.Accepts(fiber.MIMETextHTML, fiber.MIMEApplicationJSON) == fiber.MIMEApplicationJSON {
+		return c.JSON(visits)
+	}
+
+	var totalDwell time.Duration
+	rows := make([]fiber.Map, 0, len(visits))
+	// newest first
+	for i := len(visits) - 1; i >= 0; i-- {
+		visit := visits[i]
+		totalDwell += visit.Dwell
+		rows = append(rows, fiber.Map{
+			"Arrival":         formatVisitTime(visit.Arrival),
+			"Departure":       formatVisitDeparture(visit),
+			"ArrivalTripID":   visit.ArrivalTripID,
+			"DepartureTripID": visit.DepartureTripID,
+			"Dwell":           formatDwell(visit.Dwell),
+		})
+	}
+
+	return c.Render("place_visits", fiber.Map{
+		"Title":      fmt.Sprintf("Visits to %s", place.Name),
+		"Place":      place,
+		"TokenID":    tokenID,
+		"Days":       days,
+		"Visits":     rows,
+		"TotalDwell": formatDwell(totalDwell),
+	})
+}
+
+func formatVisitTime(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+func formatVisitDeparture(visit PlaceVisit) string {
+	if visit.Ongoing {
+		return "still there"
+	}
+	return formatVisitTime(visit.Departure)
+}
+
+func formatDwell(d time.Duration) string {
+	if d <= 0 {
+		return "-"
+	}
+	d = d.Round(time.Minute)
+	hours := int(d.Hours())
+	minutes := int(d.Minutes()) % 60
+	if hours >= 24 {
+		return fmt.Sprintf("%dd %dh %dm", hours/24, hours%24, minutes)
+	}
+	return fmt.Sprintf("%dh %dm", hours, minutes)
+}
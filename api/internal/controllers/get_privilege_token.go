@@ -6,52 +6,141 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/DIMO-Network/shared/privileges"
 	"github.com/dimo-network/trips-web-app/api/internal/config"
 	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
 )
 
-func RequestPriviledgeToken(c *fiber.Ctx, settings *config.Settings, tokenID int64) (*string, error) {
-	sessionCookie := c.Cookies("session_id")
-	privilegeTokenKey := fmt.Sprintf("privilegeToken_%s_%d", sessionCookie, tokenID)
+// The privileges each feature asks the token exchange for, so a vehicle shared with only some privileges still
+// works for the features they cover
+var (
+	// SignalsPrivileges covers the latest and historical signals, health and alert rules
+	SignalsPrivileges = []privileges.Privilege{privileges.VehicleNonLocationData}
+	// TripsPrivileges covers trips, their maps, the logbook and place visits
+	TripsPrivileges = []privileges.Privilege{privileges.VehicleNonLocationData, privileges.VehicleAllTimeLocation}
+	// LiveLocationPrivileges covers geofences and the current location of the vehicle
+	LiveLocationPrivileges = []privileges.Privilege{privileges.VehicleCurrentLocation}
+	// StreamsPrivileges covers the live streams and their recordings
+	StreamsPrivileges = []privileges.Privilege{privileges.VehicleSubscribeLiveDataPrivilege}
+	// CommandsPrivileges covers locking, unlocking, the trunk and charging
+	CommandsPrivileges = []privileges.Privilege{privileges.VehicleCommands}
+	// CredentialsPrivileges covers the VIN and other verifiable credentials of the vehicle
+	CredentialsPrivileges = []privileges.Privilege{privileges.VehicleVinCredential}
+)
+
+// MissingPrivilegesError is returned by the token exchange when the vehicle wasn't shared with all the requested privileges
+type MissingPrivilegesError struct {
+	TokenID int64
+	Missing []privileges.Privilege
+}
 
-	privilegeToken, exists := CacheInstance.Get(privilegeTokenKey)
+func (e *MissingPrivilegesError) Error() string {
+	return fmt.Sprintf("vehicle %d is not shared with the %s privilege", e.TokenID, PrivilegeNames(e.Missing))
+}
 
-	if exists {
-		privilegeTokenString, ok := privilegeToken.(string)
+// PrivilegeNames lists the privileges by label and ID, e.g. "All-time location (4)"
+func PrivilegeNames(privs []privileges.Privilege) string {
+	names := make([]string, 0, len(privs))
+	for _, priv := range privs {
+		name, ok := VehiclePrivilegeNames[priv]
 		if !ok {
-			return nil, fmt.Errorf("privilege token value is not valid")
+			name = "Privilege"
 		}
-		return &privilegeTokenString, nil
+		names = append(names, fmt.Sprintf("%s (%d)", name, priv))
 	}
+	return strings.Join(names, ", ")
+}
 
-	jwtToken, found := CacheInstance.Get(sessionCookie)
-	if !found {
-		return nil, fmt.Errorf("JWT token not found in cache")
+// privilegeErrorStatus answers 403 naming the missing privileges, and the given status and message for any other error
+func privilegeErrorStatus(err error, status int, message string) (int, string) {
+	var missing *MissingPrivilegesError
+	if errors.As(err, &missing) {
+		return fiber.StatusForbidden, fmt.Sprintf("This vehicle isn't shared with you with the %s privilege", PrivilegeNames(missing.Missing))
 	}
+	return status, message
+}
 
-	accessToken, ok := jwtToken.(string)
-	if !ok {
-		return nil, fmt.Errorf("JWT token value is not valid")
+// renderPrivilegeError renders a page naming the missing privileges so the user knows what to ask the owner for,
+// any other error is answered with the given status and message as JSON
+func renderPrivilegeError(c *fiber.Ctx, err error, status int, message string) error {
+	var missing *MissingPrivilegesError
+	if errors.As(err, &missing) {
+		_, message = privilegeErrorStatus(err, status, message)
+		return c.Status(fiber.StatusForbidden).Render("missing_privilege", fiber.Map{
+			"TokenID": missing.TokenID,
+			"Message": message,
+		})
+	}
+	return c.Status(status).JSON(fiber.Map{"error": message})
+}
+
+// ParsePrivileges reads a comma separated list of privilege IDs, e.g. "1,4"
+func ParsePrivileges(value string) ([]privileges.Privilege, error) {
+	privs := []privileges.Privilege{}
+	for _, part := range strings.Split(value, ",") {
+		id, err := strconv.ParseInt(strings.TrimSpace(part), 10, 64)
+		if err != nil {
+			return nil, errors.Errorf("invalid privilege %q", part)
+		}
+		if _, ok := VehiclePrivilegeNames[privileges.Privilege(id)]; !ok {
+			return nil, errors.Errorf("unknown privilege %d", id)
+		}
+		if !slices.Contains(privs, privileges.Privilege(id)) {
+			privs = append(privs, privileges.Privilege(id))
+		}
+	}
+	slices.Sort(privs)
+	return privs, nil
+}
+
+func privilegesKey(privs []privileges.Privilege) string {
+	ids := make([]string, 0, len(privs))
+	for _, priv := range privs {
+		ids = append(ids, strconv.FormatInt(int64(priv), 10))
 	}
+	return strings.Join(ids, ",")
+}
+
+// RequestPriviledgeToken returns a privilege token of the session on the vehicle with exactly the required privileges.
+// It is exchanged with the JWT of the session's wallet that gives access to the vehicle.
+func RequestPriviledgeToken(c *fiber.Ctx, settings *config.Settings, tokenID int64, required []privileges.Privilege) (*string, error) {
+	accessToken, err := vehicleAccessTokenByID(c, settings, tokenID)
+	if err != nil {
+		return nil, err
+	}
+
+	privilegeTokenString, err := PrivilegeTokens.Get(settings, accessToken, tokenID, required)
+	if err != nil {
+		return nil, err
+	}
+
+	return &privilegeTokenString, nil
+}
 
-	privileges := []int{1, 2, 3, 4, 5, 6}
+// ExchangePrivilegeToken trades the user's access token for a privilege token on the vehicle.
+// When the exchange is refused because the vehicle wasn't shared with some of the privileges, the error is a *MissingPrivilegesError.
+func ExchangePrivilegeToken(settings *config.Settings, accessToken string, tokenID int64, required []privileges.Privilege) (string, error) {
 	requestBody := map[string]interface{}{
 		"nftContractAddress": settings.PrivilegeNFTContractAddr,
-		"privileges":         privileges,
+		"privileges":         required,
 		"tokenID":            tokenID,
 	}
 
 	requestBodyBytes, err := json.Marshal(requestBody)
 	if err != nil {
-		return nil, fmt.Errorf("error marshalling request body")
+		return "", fmt.Errorf("error marshalling request body")
 	}
 
 	req, err := http.NewRequest("POST", settings.TokenExchangeAPIURL, bytes.NewBuffer(requestBodyBytes))
 	if err != nil {
-		return nil, fmt.Errorf("error creating request to token exchange API")
+		return "", fmt.Errorf("error creating request to token exchange API")
 	}
 	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
 	req.Header.Set("Content-Type", "application/json")
@@ -60,36 +149,54 @@ func RequestPriviledgeToken(c *fiber.Ctx, settings *config.Settings, tokenID int
 	resp, err := client.Do(req)
 
 	if err != nil {
-		return nil, fmt.Errorf("error making request to token exchange API")
+		return "", fmt.Errorf("error making request to token exchange API")
 	}
 	defer resp.Body.Close()
 
 	respBody, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, fmt.Errorf("error reading response from token exchange API")
+		return "", fmt.Errorf("error reading response from token exchange API")
 	}
 	if resp.StatusCode != 200 {
-		return nil, fmt.Errorf("invalid response from token exchange server: %d,  %s", resp.StatusCode, string(respBody))
+		exchangeErr := fmt.Errorf("invalid response from token exchange server: %d,  %s", resp.StatusCode, string(respBody))
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			if missing := missingPrivileges(settings, accessToken, tokenID, required); len(missing) > 0 {
+				return "", &MissingPrivilegesError{TokenID: tokenID, Missing: missing}
+			}
+		}
+		return "", exchangeErr
 	}
 
 	var responseMap map[string]interface{}
 	if err := json.Unmarshal(respBody, &responseMap); err != nil {
 		log.Error().Err(err).Str("body", string(respBody)).Msg("Error processing response")
-		return nil, fmt.Errorf("error processing response from token exchange API")
+		return "", fmt.Errorf("error processing response from token exchange API")
 	}
 
 	token, exists := responseMap["token"]
 	if !exists {
 		log.Error().Interface("response", responseMap).Msg("Token not found in response")
-		return nil, fmt.Errorf("token not found in response from token exchange API")
+		return "", fmt.Errorf("token not found in response from token exchange API")
 	}
 
 	privilegeTokenString, ok := token.(string)
 	if !ok {
-		return nil, fmt.Errorf("token value is not valid")
+		return "", fmt.Errorf("token value is not valid")
 	}
 
-	CacheInstance.Set(privilegeTokenKey, token, time.Second*30)
+	return privilegeTokenString, nil
+}
 
-	return &privilegeTokenString, nil
+// missingPrivileges works out which of the required privileges the user lacks on a vehicle shared with them.
+// Owners hold every privilege. Returns nil when it can't tell.
+func missingPrivileges(settings *config.Settings, accessToken string, tokenID int64, required []privileges.Privilege) []privileges.Privilege {
+	ethAddress, err := ExtractEthereumAddressFromToken(accessToken)
+	if err != nil {
+		return nil
+	}
+	vehicle, _, err := FindAccessibleVehicle([]string{ethAddress}, tokenID, settings)
+	if err != nil || vehicle == nil {
+		return nil
+	}
+	return vehicle.MissingPrivileges(required, time.Now())
 }
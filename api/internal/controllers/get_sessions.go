@@ -0,0 +1,147 @@
+package controllers
+
+import (
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/gofiber/fiber/v2"
+)
+
+// HandleSessions renders the active sessions of the connected wallet so forgotten ones can be revoked
+func HandleSessions(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+	currentID := c.Cookies(sessionCookieName)
+
+	sessions := Sessions.List(ethAddress)
+	rows := make([]fiber.Map, 0, len(sessions))
+	for _, session := range sessions {
+		rows = append(rows, fiber.Map{
+			"Handle":    session.Handle,
+			"UserAgent": session.UserAgent,
+			"IP":        session.IP,
+			"CreatedAt": session.CreatedAt.Format(time.RFC3339),
+			"ExpiresAt": session.ExpiresAt.Format(time.RFC3339),
+			"Current":   session.ID == currentID,
+		})
+	}
+
+	return c.Render("sessions", fiber.Map{
+		"EthAddress": ethAddress,
+		"Sessions":   rows,
+	})
+}
+
+// HandleRevokeSession ends one of the sessions of the connected wallet, the current one included
+func HandleRevokeSession(settings *config.Settings) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		ethAddress := c.Locals("ethereum_address").(string)
+
+		session, found := Sessions.FindByHandle(ethAddress, c.Params("handle"))
+		if !found {
+			return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Session not found"})
+		}
+
+		Sessions.End(session.ID)
+		current := session.ID == c.Cookies(sessionCookieName)
+		if current {
+			clearSessionCookie(c, settings)
+		}
+		return c.JSON(fiber.Map{"message": "Session revoked", "current": current})
+	}
+}
+
+// HandleSessionStatus tells the frontend when the session expires so it can warn before it does. It doesn't count as
+// activity, polling it would otherwise keep the session alive forever.
+func HandleSessionStatus(c *fiber.Ctx) error {
+	session, found := Sessions.Get(c.Cookies(sessionCookieName))
+	if !found {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Session expired"})
+	}
+	return c.JSON(sessionStatus(session))
+}
+
+// HandleExtendSession is the activity that extends the session when the user asks to stay signed in, AuthMiddleware
+// does the extending
+func HandleExtendSession(c *fiber.Ctx) error {
+	session, found := Sessions.Get(c.Cookies(sessionCookieName))
+	if !found {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Session expired"})
+	}
+	return c.JSON(sessionStatus(session))
+}
+
+// HandleRenewSession submits a challenge signed by the wallet of the session and restarts the session's lifetime with
+// the new JWT, without a page load. A session that already expired is replaced by a new one.
+func HandleRenewSession(settings *config.Settings, provider AuthProvider) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var signatureReq SignatureRequest
+		if err := c.BodyParser(&signatureReq); err != nil || signatureReq.State == "" || signatureReq.Signature == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+
+		accessToken, err := provider.SubmitChallenge(signatureReq)
+		if err != nil {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		sessionID := c.Cookies(sessionCookieName)
+		var session Session
+		if _, found := Sessions.Get(sessionID); found {
+			session, err = Sessions.Renew(sessionID, accessToken)
+		} else {
+			session, err = Sessions.Start(accessToken, c.Get(fiber.HeaderUserAgent), c.IP())
+		}
+		if err != nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": err.Error()})
+		}
+		setSessionCookie(c, settings, session)
+		return c.JSON(sessionStatus(session))
+	}
+}
+
+func sessionStatus(session Session) fiber.Map {
+	return fiber.Map{
+		"address":      session.Address,
+		"addresses":    session.Addresses(time.Now()),
+		"expiresAt":    session.ExpiresAt,
+		"maxExpiresAt": session.MaxExpiresAt,
+		"canExtend":    session.CanExtend(),
+	}
+}
+
+// HandleLinkWallet submits a challenge signed by another wallet and adds it to the session, so the vehicles it owns or
+// that are shared with it are listed too
+func HandleLinkWallet(provider AuthProvider) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var signatureReq SignatureRequest
+		if err := c.BodyParser(&signatureReq); err != nil || signatureReq.State == "" || signatureReq.Signature == "" {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+		}
+
+		accessToken, err := provider.SubmitChallenge(signatureReq)
+		if err != nil {
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": err.Error()})
+		}
+
+		session, err := Sessions.Link(c.Cookies(sessionCookieName), accessToken)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+		}
+		wallet := session.Linked[len(session.Linked)-1]
+		Vehicles.Invalidate(wallet.Address)
+
+		return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+			"address":   wallet.Address,
+			"linkedAt":  wallet.LinkedAt,
+			"expiresAt": wallet.ExpiresAt,
+		})
+	}
+}
+
+// HandleUnlinkWallet removes a linked wallet from the session, the address it signed in with can't be unlinked
+func HandleUnlinkWallet(c *fiber.Ctx) error {
+	if _, unlinked := Sessions.Unlink(c.Cookies(sessionCookieName), c.Params("address")); !unlinked {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Wallet not linked"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -1,37 +1,258 @@
 package controllers
 
 import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+
 	"github.com/dimo-network/trips-web-app/api/internal/config"
 	"github.com/gofiber/fiber/v2"
 	"github.com/rs/zerolog"
 )
 
+// sseHeartbeatInterval keeps proxies from closing idle live connections
+const sseHeartbeatInterval = 15 * time.Second
+
 type StreamrController struct {
 	settings *config.Settings
 	logger   *zerolog.Logger
+	hub      *StreamHub
+	recorder *StreamRecorder
 }
 
-func NewStreamrController(settings *config.Settings, logger *zerolog.Logger) StreamrController {
-	return StreamrController{settings: settings, logger: logger}
+// NewStreamrController takes a nil hub and recorder when no stream source is configured, live streams then answer 503
+func NewStreamrController(settings *config.Settings, logger *zerolog.Logger, hub *StreamHub, recorder *StreamRecorder) StreamrController {
+	return StreamrController{settings: settings, logger: logger, hub: hub, recorder: recorder}
 }
 
 func (tc *StreamrController) GetStreamr(c *fiber.Ctx) error {
+	accountVehicles, err := Vehicles.LookupAll(sessionAddresses(c), tc.settings)
+	if err != nil {
+		tc.logger.Error().Err(err).Msg("Error querying vehicles")
+		return c.Status(fiber.StatusInternalServerError).SendString("Error querying vehicles: " + err.Error())
+	}
+	// only vehicles shared with the live data privilege can be streamed
+	now := time.Now()
+	streamable := slices.DeleteFunc(accountVehicles.Shared, func(vehicle Vehicle) bool {
+		return len(vehicle.MissingPrivileges(StreamsPrivileges, now)) > 0
+	})
+
+	return c.Render("streamr_live", fiber.Map{
+		"Title":          "Streamr Live",
+		"Vehicles":       accountVehicles.Owned,
+		"SharedVehicles": streamable,
+	})
+}
+
+// HandleLiveStream relays the vehicle's stream to the browser as Server-Sent Events
+func (tc *StreamrController) HandleLiveStream(c *fiber.Ctx) error {
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
+	}
+
+	if tc.hub == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Live streams are not configured"})
+	}
+
+	tokenIDs, err := AccessibleTokenIDs(sessionAddresses(c), tc.settings)
+	if err != nil {
+		tc.logger.Error().Err(err).Msg("Error querying vehicles for live stream")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error querying vehicles"})
+	}
+	if !tokenIDs[tokenID] {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "No access to this vehicle"})
+	}
+	if _, err := RequestPriviledgeToken(c, tc.settings, tokenID, StreamsPrivileges); err != nil {
+		tc.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Failed to get privilege token for the live stream")
+		status, message := privilegeErrorStatus(err, fiber.StatusForbidden, "Could not get access to the vehicle's live data")
+		return c.Status(status).JSON(fiber.Map{"error": message})
+	}
+
+	messages, unsubscribe := tc.hub.Subscribe(VehicleStreamID(tokenID))
+	streamSSE(c, messages, unsubscribe, "")
+
+	return nil
+}
+
+// HandleStartRecording starts recording the vehicle's live stream on the server
+func (tc *StreamrController) HandleStartRecording(c *fiber.Ctx) error {
 	ethAddress := c.Locals("ethereum_address").(string)
 
-	vehicles, err := QueryIdentityAPIForVehicles(ethAddress, tc.settings)
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
 	if err != nil {
-		tc.logger.Error().Err(err).Msg("Error querying My Vehicles")
-		return c.Status(fiber.StatusInternalServerError).SendString("Error querying my vehicles: " + err.Error())
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
+	}
+
+	if tc.recorder == nil {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Live streams are not configured"})
 	}
 
-	sharedVehicles, err := QuerySharedVehicles(ethAddress, tc.settings)
+	tokenIDs, err := AccessibleTokenIDs(sessionAddresses(c), tc.settings)
 	if err != nil {
-		tc.logger.Error().Err(err).Msg("Error querying Shared Vehicles")
-		return c.Status(fiber.StatusInternalServerError).SendString("Error querying shared vehicles: " + err.Error())
+		tc.logger.Error().Err(err).Msg("Error querying vehicles for stream recording")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error querying vehicles"})
 	}
-	return c.Render("streamr_live", fiber.Map{
-		"Title":          "Streamr Live",
-		"Vehicles":       vehicles,
-		"SharedVehicles": sharedVehicles,
+	if !tokenIDs[tokenID] {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "No access to this vehicle"})
+	}
+	if _, err := RequestPriviledgeToken(c, tc.settings, tokenID, StreamsPrivileges); err != nil {
+		tc.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Failed to get privilege token for the live stream")
+		status, message := privilegeErrorStatus(err, fiber.StatusForbidden, "Could not get access to the vehicle's live data")
+		return c.Status(status).JSON(fiber.Map{"error": message})
+	}
+
+	recording, err := tc.recorder.Start(ethAddress, tokenID)
+	if errors.Is(err, ErrRecordingInProgress) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": err.Error()})
+	}
+	if err != nil {
+		tc.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Failed to start stream recording")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to start recording"})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(recording)
+}
+
+func (tc *StreamrController) HandleListRecordings(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
+	}
+
+	if tc.recorder == nil {
+		return c.JSON([]StreamRecording{})
+	}
+	return c.JSON(tc.recorder.List(ethAddress, tokenID))
+}
+
+func (tc *StreamrController) HandleStopRecording(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	if tc.recorder == nil || !tc.recorder.Stop(ethAddress, c.Params("recordingID")) {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Recording not found"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+func (tc *StreamrController) HandleDeleteRecording(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	if tc.recorder == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Recording not found"})
+	}
+
+	err := tc.recorder.Delete(ethAddress, c.Params("recordingID"))
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Recording not found"})
+	case errors.Is(err, ErrRecordingInProgress):
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{"error": "Stop the recording before deleting it"})
+	case err != nil:
+		tc.logger.Error().Err(err).Msg("Failed to delete stream recording")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to delete recording"})
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// HandleExportRecording downloads the recorded messages as NDJSON
+func (tc *StreamrController) HandleExportRecording(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	if tc.recorder == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Recording not found"})
+	}
+	recording, ok := tc.recorder.Get(ethAddress, c.Params("recordingID"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Recording not found"})
+	}
+
+	c.Attachment(fmt.Sprintf("vehicle-%d-%s.ndjson", recording.TokenID, recording.StartedAt.Format("20060102-150405")))
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	return c.SendFile(tc.recorder.MessagesPath(recording))
+}
+
+// HandleReplayRecording plays a recording back over SSE, in the same format as the live stream. Query param: speed (1, 5 or 20)
+func (tc *StreamrController) HandleReplayRecording(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	speed := c.QueryInt("speed", 1)
+	if !slices.Contains(ReplaySpeeds, speed) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Speed must be 1, 5 or 20"})
+	}
+
+	if tc.recorder == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Recording not found"})
+	}
+	recording, ok := tc.recorder.Get(ethAddress, c.Params("recordingID"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Recording not found"})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	messages, err := tc.recorder.Replay(ctx, recording, speed)
+	if err != nil {
+		cancel()
+		tc.logger.Error().Err(err).Str("recordingId", recording.ID).Msg("Failed to replay stream recording")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to replay recording"})
+	}
+
+	// tell the browser not to reconnect, which would start the replay over
+	streamSSE(c, messages, cancel, "end")
+
+	return nil
+}
+
+// streamSSE writes the messages as Server-Sent Events until the channel closes or the browser goes away, then calls done.
+// When endEvent is set, it is sent once the channel closes.
+func streamSSE(c *fiber.Ctx, messages <-chan StreamMessage, done func(), endEvent string) {
+	c.Set(fiber.HeaderContentType, "text/event-stream")
+	c.Set(fiber.HeaderCacheControl, "no-cache")
+	c.Set(fiber.HeaderConnection, "keep-alive")
+	c.Set("X-Accel-Buffering", "no")
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		defer done()
+
+		heartbeat := time.NewTicker(sseHeartbeatInterval)
+		defer heartbeat.Stop()
+
+		fmt.Fprintf(w, "retry: 3000\n\n")
+		if err := w.Flush(); err != nil {
+			return
+		}
+
+		for {
+			select {
+			case message, ok := <-messages:
+				if !ok {
+					if endEvent != "" {
+						fmt.Fprintf(w, "event: %s\ndata: {}\n\n", endEvent)
+						_ = w.Flush()
+					}
+					return
+				}
+				payload, err := json.Marshal(message)
+				if err != nil {
+					continue
+				}
+				fmt.Fprintf(w, "data: %s\n\n", payload)
+			case <-heartbeat.C:
+				fmt.Fprintf(w, ": heartbeat\n\n")
+			}
+
+			// a failed flush means the browser went away
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
 	})
 }
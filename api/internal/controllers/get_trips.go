@@ -2,12 +2,14 @@ package controllers
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"sort"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/rs/zerolog"
@@ -17,12 +19,14 @@ import (
 	geojson "github.com/paulmach/go.geojson"
 	"github.com/pkg/errors"
 	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
 )
 
 type Trip struct {
-	ID    string    `json:"id"`
-	Start TripPoint `json:"start"`
-	End   TripPoint `json:"end"`
+	ID      string    `json:"id"`
+	Start   TripPoint `json:"start"`
+	End     TripPoint `json:"end"`
+	Purpose string    `json:"purpose,omitempty"`
 }
 
 // EstimatedLocation
@@ -30,6 +34,10 @@ type TripPoint struct {
 	Time              string  `json:"time"`
 	Location          LatLon  `json:"location"`
 	EstimatedLocation *LatLon `json:"estimatedLocation"`
+	// Place is the reverse geocoded locality of the point, filled in by us
+	Place string `json:"place,omitempty"`
+	// SavedPlace is the name of the user's saved place containing the point, filled in by us
+	SavedPlace string `json:"savedPlace,omitempty"`
 }
 
 // LatLon represents latitude and longitude coordinates.
@@ -43,10 +51,31 @@ type TimeEntry struct {
 }
 
 type TripsResponse struct {
-	Trips []Trip `json:"trips"`
+	TotalPages  int    `json:"totalPages"`
+	CurrentPage int    `json:"currentPage"`
+	Trips       []Trip `json:"trips"`
 }
 
-var TripIDToTokenIDMap = make(map[string]int64)
+// tripVehicleStore remembers the vehicle of every trip that was listed, the trip endpoints only get the trip ID
+type tripVehicleStore struct {
+	mu       sync.RWMutex
+	tokenIDs map[string]int64
+}
+
+var TripVehicles = &tripVehicleStore{tokenIDs: make(map[string]int64)}
+
+func (s *tripVehicleStore) Get(tripID string) (int64, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tokenID, found := s.tokenIDs[tripID]
+	return tokenID, found
+}
+
+func (s *tripVehicleStore) Set(tripID string, tokenID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokenIDs[tripID] = tokenID
+}
 
 type LocationData struct {
 	Longitude *float64
@@ -87,10 +116,11 @@ var SpeedGradient = []struct {
 type TripsController struct {
 	settings *config.Settings
 	logger   *zerolog.Logger
+	geocoder Geocoder
 }
 
-func NewTripsController(settings *config.Settings, logger *zerolog.Logger) TripsController {
-	return TripsController{settings: settings, logger: logger}
+func NewTripsController(settings *config.Settings, logger *zerolog.Logger, geocoder Geocoder) TripsController {
+	return TripsController{settings: settings, logger: logger, geocoder: geocoder}
 }
 
 func (t *TripsController) HandleTripsList(c *fiber.Ctx) error {
@@ -104,15 +134,16 @@ func (t *TripsController) HandleTripsList(c *fiber.Ctx) error {
 	trips, err := t.QueryTripsAPI(tokenID, t.settings, c)
 	if err != nil {
 		t.logger.Error().Err(err).Msg("Failed to query trips API")
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch trips",
-		})
+		return renderPrivilegeError(c, err, fiber.StatusInternalServerError, "Failed to fetch trips")
 	}
 
-	// Populate TripIDToTokenIDMap
-	for _, trip := range trips {
-		TripIDToTokenIDMap[trip.ID] = tokenID
+	// Populate TripVehicles
+	for i, trip := range trips {
+		TripVehicles.Set(trip.ID, tokenID)
+		trips[i].Purpose = TripPurposes.Get(trip.ID)
 	}
+	t.annotateTripPlaces(c.UserContext(), trips)
+	annotateSavedPlaces(trips, Places.ForVehicle(c.Locals("ethereum_address").(string), tokenID))
 
 	return c.Render("vehicle_trips", fiber.Map{
 		"TokenID": tokenID,
@@ -122,7 +153,7 @@ func (t *TripsController) HandleTripsList(c *fiber.Ctx) error {
 
 func (t *TripsController) QueryTripsAPI(tokenID int64, settings *config.Settings, c *fiber.Ctx) ([]Trip, error) {
 	var tripsResponse TripsResponse
-	privilegeToken, err := RequestPriviledgeToken(c, settings, tokenID)
+	privilegeToken, err := RequestPriviledgeToken(c, settings, tokenID, TripsPrivileges)
 
 	if err != nil {
 		return []Trip{}, errors.Wrap(err, "error getting privilege token")
@@ -169,7 +200,7 @@ func (t *TripsController) QueryTripsAPI(tokenID int64, settings *config.Settings
 	}
 
 	for _, trip := range latestTrips {
-		TripIDToTokenIDMap[trip.ID] = tokenID
+		TripVehicles.Set(trip.ID, tokenID)
 		if trip.Start.EstimatedLocation != nil {
 			t.logger.Debug().Msgf("Trip ID: %s, EstimatedLocation: %+v", trip.ID, *trip.Start.EstimatedLocation)
 		}
@@ -179,6 +210,65 @@ func (t *TripsController) QueryTripsAPI(tokenID int64, settings *config.Settings
 	return latestTrips, nil
 }
 
+// annotateTripPlaces fills in the start and end place names of the trips. Failures only leave the place empty.
+func (t *TripsController) annotateTripPlaces(ctx context.Context, trips []Trip) {
+	group := errgroup.Group{}
+	group.SetLimit(geocodeConcurrency)
+	for i := range trips {
+		for _, point := range []*TripPoint{&trips[i].Start, &trips[i].End} {
+			group.Go(func() error {
+				point.Place = t.describeTripPoint(ctx, *point)
+				return nil
+			})
+		}
+	}
+	_ = group.Wait()
+}
+
+// annotateSavedPlaces names the trip endpoints lying within one of the saved places
+func annotateSavedPlaces(trips []Trip, places []Place) {
+	if len(places) == 0 {
+		return
+	}
+	for i := range trips {
+		for _, point := range []*TripPoint{&trips[i].Start, &trips[i].End} {
+			if location, ok := tripPointLatLon(*point); ok {
+				if place := MatchPlace(places, location); place != nil {
+					point.SavedPlace = place.Name
+				}
+			}
+		}
+	}
+}
+
+// describeTripPoint returns the place name of a trip point, falling back to its coordinates
+func (t *TripsController) describeTripPoint(ctx context.Context, point TripPoint) string {
+	location, ok := tripPointLatLon(point)
+	if !ok {
+		return ""
+	}
+	if t.geocoder != nil {
+		place, err := t.geocoder.ReverseGeocode(ctx, location)
+		if err != nil {
+			t.logger.Warn().Err(err).Msg("Failed to reverse geocode trip point")
+		} else if place != "" {
+			return place
+		}
+	}
+	return fmt.Sprintf("%.5f, %.5f", location.Latitude, location.Longitude)
+}
+
+// tripPointLatLon returns the location of a trip point, preferring the exact location over the privacy estimated one
+func tripPointLatLon(point TripPoint) (LatLon, bool) {
+	if point.Location.Latitude != 0 || point.Location.Longitude != 0 {
+		return point.Location, true
+	}
+	if point.EstimatedLocation != nil {
+		return *point.EstimatedLocation, true
+	}
+	return LatLon{}, false
+}
+
 func queryTelemetryData(tokenID int64, startTime string, endTime string, settings *config.Settings, c *fiber.Ctx) ([]LocationData, error) {
 	graphqlQuery := fmt.Sprintf(` 
 	{
@@ -201,7 +291,7 @@ func queryTelemetryData(tokenID int64, startTime string, endTime string, setting
 		return nil, err
 	}
 
-	privilegeToken, err := RequestPriviledgeToken(c, settings, tokenID)
+	privilegeToken, err := RequestPriviledgeToken(c, settings, tokenID, TripsPrivileges)
 	if err != nil {
 		return nil, errors.Wrap(err, "error getting privilege token")
 	}
@@ -248,7 +338,7 @@ func queryTelemetryData(tokenID int64, startTime string, endTime string, setting
 }
 
 func (t *TripsController) HandleMapDataForTrip(c *fiber.Ctx, settings *config.Settings, tripID, startTime, endTime string, estimatedStart *LatLon) error {
-	tokenID, exists := TripIDToTokenIDMap[tripID]
+	tokenID, exists := TripVehicles.Get(tripID)
 	if !exists {
 		t.logger.Error().Msgf("Trip not found for tripID: %s", tripID)
 		return c.Status(fiber.StatusNotFound).SendString("Trip not found")
@@ -260,7 +350,8 @@ func (t *TripsController) HandleMapDataForTrip(c *fiber.Ctx, settings *config.Se
 	locations, err := queryTelemetryData(tokenID, startTime, endTime, settings, c)
 	if err != nil {
 		t.logger.Error().Err(err).Msg("Failed to fetch historical data")
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Failed to fetch historical data: " + err.Error()})
+		status, message := privilegeErrorStatus(err, fiber.StatusInternalServerError, "Failed to fetch historical data: "+err.Error())
+		return c.Status(status).JSON(fiber.Map{"error": message})
 	}
 
 	if len(locations) == 0 {
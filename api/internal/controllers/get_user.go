@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"time"
 
 	"github.com/dimo-network/trips-web-app/api/internal/config"
 	"github.com/gofiber/fiber/v2"
@@ -87,28 +88,63 @@ func (a *AccountController) MyAccount(c *fiber.Ctx) error {
 
 	ethAddress := c.Locals("ethereum_address").(string)
 
-	vehicles, err := QueryIdentityAPIForVehicles(ethAddress, a.settings)
+	accountVehicles, err := Vehicles.LookupAll(sessionAddresses(c), a.settings)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).SendString("Error querying identity API: " + err.Error())
 	}
 
-	if len(vehicles) == 0 {
-		vehicles, err = QuerySharedVehicles(ethAddress, a.settings)
-		if err != nil {
-			return c.Status(fiber.StatusInternalServerError).SendString("Error querying shared vehicles: " + err.Error())
+	now := time.Now()
+	vehicles := accountVehicles.All()
+	attachAccess(vehicles, now)
+
+	linkedRows := []fiber.Map{}
+	if session, found := Sessions.Get(sessionCookie); found {
+		for _, wallet := range session.Linked {
+			if now.Before(wallet.ExpiresAt) {
+				linkedRows = append(linkedRows, fiber.Map{
+					"Address":   wallet.Address,
+					"LinkedAt":  wallet.LinkedAt.Format(time.RFC3339),
+					"ExpiresAt": wallet.ExpiresAt.Format(time.RFC3339),
+				})
+			}
 		}
 	}
 
+	// the dropdown preselects the privileges held on the chosen vehicle
+	vehicleRows := make([]fiber.Map, 0, len(vehicles))
+	sharedRows := []fiber.Map{}
+	for _, vehicle := range vehicles {
+		vehicleRows = append(vehicleRows, fiber.Map{
+			"TokenID":    vehicle.TokenID,
+			"Definition": vehicle.Definition,
+			"Shared":     vehicle.Shared,
+			"Privileges": vehicle.Access.PrivilegeIDs(),
+			"Via":        vehicle.AccessAddress,
+		})
+		if vehicle.Shared {
+			sharedRows = append(sharedRows, fiber.Map{
+				"TokenID":    vehicle.TokenID,
+				"Definition": vehicle.Definition,
+				"Privileges": vehicle.Access.Privileges,
+				"Via":        vehicle.AccessAddress,
+			})
+		}
+	}
+
+	privilegeOptions := make([]fiber.Map, 0, len(VehiclePrivilegeNames))
+	for _, privilege := range SortedVehiclePrivileges() {
+		privilegeOptions = append(privilegeOptions, fiber.Map{
+			"ID":   privilege,
+			"Name": VehiclePrivilegeNames[privilege],
+		})
+	}
+
 	return c.Render("account", fiber.Map{
-		"Token": jwtToken,
-		"Privileges": fiber.Map{
-			"1": "1: All-time, non-location data",
-			"2": "Commands",
-			"3": "Current Location",
-			"4": "4: All-time location",
-			"5": "Verifiable Credentials",
-			"6": "Streams",
-		},
-		"Vehicles": vehicles,
+		"Token":          jwtToken,
+		"EthAddress":     ethAddress,
+		"LinkedWallets":  linkedRows,
+		"Privileges":     privilegeOptions,
+		"Vehicles":       vehicleRows,
+		"SharedVehicles": sharedRows,
 	})
 }
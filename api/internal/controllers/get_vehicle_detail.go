@@ -0,0 +1,352 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DIMO-Network/shared/privileges"
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	"golang.org/x/sync/errgroup"
+)
+
+// vehicleDetailTrips is how many of the latest trips are shown on the vehicle page
+const vehicleDetailTrips = 5
+
+// vehicleDetailSignals are the signals shown on the vehicle page, with their labels and units.
+// Location is left to the trips section, the signals token doesn't carry a location privilege.
+var vehicleDetailSignals = []struct {
+	Name  string
+	Label string
+	Unit  string
+}{
+	{"speed", "Speed", "km/h"},
+	{"powertrainTransmissionTravelledDistance", "Odometer", "km"},
+	{"powertrainFuelSystemRelativeLevel", "Fuel Level", "%"},
+	{"powertrainTractionBatteryStateOfChargeCurrent", "Battery Charge", "%"},
+	{"lowVoltageBatteryCurrentVoltage", "12V Battery", "V"},
+	{"exteriorAirTemperature", "Outside Temperature", "°C"},
+}
+
+// VehiclePrivilegeNames are the labels of the privileges that can be shared on a vehicle
+var VehiclePrivilegeNames = map[privileges.Privilege]string{
+	privileges.VehicleNonLocationData:            "Non-location data",
+	privileges.VehicleCommands:                   "Commands",
+	privileges.VehicleCurrentLocation:            "Current location",
+	privileges.VehicleAllTimeLocation:            "All-time location",
+	privileges.VehicleVinCredential:              "VIN credential",
+	privileges.VehicleSubscribeLiveDataPrivilege: "Live data",
+	privileges.VehicleRawData:                    "Raw data",
+	privileges.VehicleApproximateLocation:        "Approximate location",
+}
+
+// VehiclePrivilegeGrant is a privilege on the vehicle granted to an address
+type VehiclePrivilegeGrant struct {
+	ID        int64     `json:"id"`
+	User      string    `json:"user"`
+	SetAt     time.Time `json:"setAt"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// QueryVehiclePrivileges lists the privileges granted on the vehicle, including expired ones
+func QueryVehiclePrivileges(tokenID int64, settings *config.Settings) ([]VehiclePrivilegeGrant, error) {
+	var privilegesResponse struct {
+		Data struct {
+			Vehicle *struct {
+				Privileges struct {
+					Nodes []VehiclePrivilegeGrant `json:"nodes"`
+				} `json:"privileges"`
+			} `json:"vehicle"`
+		} `json:"data"`
+	}
+
+	graphqlQuery := fmt.Sprintf(`{
+		vehicle(tokenId: %d) {
+			privileges(first: 100) {
+				nodes {
+					id
+					user
+					setAt
+					expiresAt
+				}
+			}
+		}
+	}`, tokenID)
+
+	if err := queryIdentityAPI(graphqlQuery, settings, &privilegesResponse); err != nil {
+		return nil, err
+	}
+	if privilegesResponse.Data.Vehicle == nil {
+		return nil, errors.New("vehicle not found")
+	}
+
+	return privilegesResponse.Data.Vehicle.Privileges.Nodes, nil
+}
+
+type VehicleDetailController struct {
+	settings *config.Settings
+	logger   *zerolog.Logger
+	trips    *TripsController
+}
+
+func NewVehicleDetailController(settings *config.Settings, logger *zerolog.Logger, trips *TripsController) VehicleDetailController {
+	return VehicleDetailController{settings: settings, logger: logger, trips: trips}
+}
+
+// vehicleDetail collects the sections of the vehicle page. Each section loads on its own and keeps its error,
+// so one failing upstream only blanks its own section.
+type vehicleDetail struct {
+	Vehicle       *Vehicle
+	Shared        bool
+	IdentityError string
+
+	Signals      []fiber.Map
+	SignalsError string
+
+	Trips      []fiber.Map
+	TripsError string
+
+	Sharing      []fiber.Map
+	SharingError string
+}
+
+// HandleVehicleDetail renders identity, key signals, the latest trips and sharing of one vehicle
+func (v *VehicleDetailController) HandleVehicleDetail(c *fiber.Ctx) error {
+	ethAddress := c.Locals("ethereum_address").(string)
+
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
+	}
+
+	// fiber's ctx can't be used from the goroutines, fetch what needs it up front.
+	// Each section asks for its own privileges, a vehicle shared without location still shows its signals.
+	signalsToken, signalsErr := RequestPriviledgeToken(c, v.settings, tokenID, SignalsPrivileges)
+	if signalsErr != nil {
+		v.logger.Error().Err(signalsErr).Int64("tokenId", tokenID).Msg("Error obtaining privilege token for signals")
+	}
+	tripsToken, tripsErr := RequestPriviledgeToken(c, v.settings, tokenID, TripsPrivileges)
+	if tripsErr != nil {
+		v.logger.Error().Err(tripsErr).Int64("tokenId", tokenID).Msg("Error obtaining privilege token for trips")
+	}
+	places := Places.ForVehicle(ethAddress, tokenID)
+	addresses := sessionAddresses(c)
+	ctx := c.UserContext()
+
+	detail := vehicleDetail{}
+	group := errgroup.Group{}
+
+	group.Go(func() error {
+		vehicle, shared, err := FindAccessibleVehicle(addresses, tokenID, v.settings)
+		if err != nil {
+			v.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Error querying vehicle identity")
+			detail.IdentityError = "Failed to load the vehicle from the identity API"
+			detail.SharingError = "Sharing can't be shown until the vehicle loads"
+			return nil
+		}
+		if vehicle == nil {
+			return nil
+		}
+		vehicle.Access = NewVehicleAccess(*vehicle, time.Now())
+		detail.Vehicle, detail.Shared = vehicle, shared
+
+		// sharing is only listed once the vehicle is known to be accessible
+		grants, err := QueryVehiclePrivileges(tokenID, v.settings)
+		if err != nil {
+			v.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Error querying vehicle privileges")
+			detail.SharingError = "Failed to load sharing"
+			return nil
+		}
+		detail.Sharing = sharingRows(grants, time.Now())
+		return nil
+	})
+
+	group.Go(func() error {
+		if signalsErr != nil {
+			_, detail.SignalsError = privilegeErrorStatus(signalsErr, fiber.StatusInternalServerError, "No access to the vehicle's signals")
+			return nil
+		}
+		signals, err := v.keySignals(tokenID, *signalsToken)
+		if err != nil {
+			v.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Error fetching key signals")
+			detail.SignalsError = "Failed to load the latest signals"
+			return nil
+		}
+		detail.Signals = signals
+		return nil
+	})
+
+	group.Go(func() error {
+		if tripsErr != nil {
+			_, detail.TripsError = privilegeErrorStatus(tripsErr, fiber.StatusInternalServerError, "No access to the vehicle's trips")
+			return nil
+		}
+		trips, err := v.latestTrips(ctx, tokenID, *tripsToken, places)
+		if err != nil {
+			v.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Error fetching latest trips")
+			detail.TripsError = "Failed to load trips"
+			return nil
+		}
+		detail.Trips = trips
+		return nil
+	})
+
+	_ = group.Wait()
+
+	if detail.IdentityError == "" && detail.Vehicle == nil {
+		return c.Status(fiber.StatusNotFound).SendString("Vehicle not found")
+	}
+
+	return c.Render("vehicle_detail", fiber.Map{
+		"Title":   fmt.Sprintf("Vehicle %d", tokenID),
+		"TokenID": tokenID,
+		"Detail":  detail,
+	})
+}
+
+// keySignals returns the latest value of the signals shown on the vehicle page, skipping those the vehicle doesn't report
+func (v *VehicleDetailController) keySignals(tokenID int64, privilegeToken string) ([]fiber.Map, error) {
+	names := make([]string, 0, len(vehicleDetailSignals))
+	for _, signal := range vehicleDetailSignals {
+		names = append(names, signal.Name)
+	}
+
+	latest, err := FetchLatestNumericSignals(v.settings, tokenID, names, privilegeToken)
+	if err != nil {
+		return nil, err
+	}
+
+	rows := []fiber.Map{}
+	for _, signal := range vehicleDetailSignals {
+		value, ok := latest[signal.Name]
+		if !ok {
+			continue
+		}
+		rows = append(rows, fiber.Map{
+			"Label":     signal.Label,
+			"Value":     strconv.FormatFloat(value.Value, 'f', -1, 64),
+			"Unit":      signal.Unit,
+			"Timestamp": value.Timestamp.Format(time.RFC3339),
+		})
+	}
+	return rows, nil
+}
+
+// latestTrips returns the latest trips with their duration, distance and places
+func (v *VehicleDetailController) latestTrips(ctx context.Context, tokenID int64, privilegeToken string, places []Place) ([]fiber.Map, error) {
+	tripsResponse, err := fetchTripsPage(v.settings, tokenID, 1, privilegeToken)
+	if err != nil {
+		return nil, err
+	}
+
+	trips := tripsResponse.Trips
+	sort.Slice(trips, func(i, j int) bool {
+		return trips[i].End.Time > trips[j].End.Time
+	})
+	if len(trips) > vehicleDetailTrips {
+		trips = trips[:vehicleDetailTrips]
+	}
+	for _, trip := range trips {
+		TripVehicles.Set(trip.ID, tokenID)
+	}
+	v.trips.annotateTripPlaces(ctx, trips)
+	annotateSavedPlaces(trips, places)
+
+	rows := make([]fiber.Map, len(trips))
+	group := errgroup.Group{}
+	group.SetLimit(odometerQueryConcurrency)
+	for i, trip := range trips {
+		startTime, _ := time.Parse(time.RFC3339, trip.Start.Time)
+		endTime, _ := time.Parse(time.RFC3339, trip.End.Time)
+		duration := endTime.Sub(startTime)
+
+		rows[i] = fiber.Map{
+			"ID":       trip.ID,
+			"Start":    startTime.Format(time.RFC3339),
+			"Duration": formatAge(duration),
+			"From":     tripPointName(trip.Start),
+			"To":       tripPointName(trip.End),
+			"Purpose":  TripPurposes.Get(trip.ID),
+		}
+
+		row := rows[i]
+		group.Go(func() error {
+			odoStart, odoEnd, err := FetchOdometerRange(v.settings, tokenID, startTime, endTime, privilegeToken)
+			if err != nil || odoStart == nil || odoEnd == nil {
+				// the trip is still worth showing without its distance
+				return nil
+			}
+			distance := *odoEnd - *odoStart
+			row["Distance"] = fmt.Sprintf("%.1f km", distance)
+			if hours := duration.Hours(); hours > 0 {
+				row["AverageSpeed"] = fmt.Sprintf("%.0f km/h", distance/hours)
+			}
+			return nil
+		})
+	}
+	_ = group.Wait()
+
+	return rows, nil
+}
+
+// tripPointName prefers the saved place a trip point lies in over its geocoded place
+func tripPointName(point TripPoint) string {
+	if point.SavedPlace != "" {
+		return point.SavedPlace
+	}
+	return point.Place
+}
+
+// sharingRows groups the active grants per address
+func sharingRows(grants []VehiclePrivilegeGrant, now time.Time) []fiber.Map {
+	type grantee struct {
+		user      string
+		names     []string
+		expiresAt time.Time
+	}
+	byUser := map[string]*grantee{}
+	for _, grant := range grants {
+		if grant.ExpiresAt.Before(now) {
+			continue
+		}
+		user := strings.ToLower(grant.User)
+		g, ok := byUser[user]
+		if !ok {
+			g = &grantee{user: grant.User, expiresAt: grant.ExpiresAt}
+			byUser[user] = g
+		}
+		name, ok := VehiclePrivilegeNames[privileges.Privilege(grant.ID)]
+		if !ok {
+			name = fmt.Sprintf("Privilege %d", grant.ID)
+		}
+		g.names = append(g.names, name)
+		if grant.ExpiresAt.Before(g.expiresAt) {
+			g.expiresAt = grant.ExpiresAt
+		}
+	}
+
+	grantees := make([]*grantee, 0, len(byUser))
+	for _, g := range byUser {
+		sort.Strings(g.names)
+		grantees = append(grantees, g)
+	}
+	sort.Slice(grantees, func(i, j int) bool {
+		return grantees[i].user < grantees[j].user
+	})
+
+	rows := make([]fiber.Map, 0, len(grantees))
+	for _, g := range grantees {
+		rows = append(rows, fiber.Map{
+			"User":       g.user,
+			"Privileges": strings.Join(g.names, ", "),
+			"ExpiresAt":  g.expiresAt.Format(time.RFC3339),
+		})
+	}
+	return rows
+}
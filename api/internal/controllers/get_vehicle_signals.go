@@ -25,6 +25,16 @@ type SignalEntries []SignalEntry
 
 // FetchAvailableSignals retrieves a list of available signals for a given vehicle
 func FetchAvailableSignals(tokenID int64, settings *config.Settings, c *fiber.Ctx) ([]string, error) {
+	privilegeToken, err := RequestPriviledgeToken(c, settings, tokenID, SignalsPrivileges)
+	if err != nil {
+		log.Error().Err(err).Msg("Error obtaining privilege token")
+		return nil, errors.Wrap(err, "error getting privilege token")
+	}
+
+	return queryAvailableSignals(settings, tokenID, *privilegeToken)
+}
+
+func queryAvailableSignals(settings *config.Settings, tokenID int64, privilegeToken string) ([]string, error) {
 	var availableSignals struct {
 		Data struct {
 			AvailableSignals []string `json:"availableSignals"`
@@ -37,13 +47,7 @@ func FetchAvailableSignals(tokenID int64, settings *config.Settings, c *fiber.Ct
 
 	log.Info().Msgf("Sending FetchAvailableSignals query: %s", graphqlQuery)
 
-	privilegeToken, err := RequestPriviledgeToken(c, settings, tokenID)
-	if err != nil {
-		log.Error().Err(err).Msg("Error obtaining privilege token")
-		return nil, errors.Wrap(err, "error getting privilege token")
-	}
-
-	resp, err := makeGraphQLRequest(settings.TelemetryAPIURL, graphqlQuery, privilegeToken)
+	resp, err := makeGraphQLRequest(settings.TelemetryAPIURL, graphqlQuery, &privilegeToken)
 	if err != nil {
 		log.Error().Err(err).Msg("Error making request to Telemetry API for available signals")
 		return nil, err
@@ -62,6 +66,16 @@ func FetchAvailableSignals(tokenID int64, settings *config.Settings, c *fiber.Ct
 
 // FetchLatestSignalValues retrieves the latest timestamp and value for each available signal
 func FetchLatestSignalValues(tokenID int64, signalNames []string, settings *config.Settings, c *fiber.Ctx) (SignalEntries, error) {
+	privilegeToken, err := RequestPriviledgeToken(c, settings, tokenID, SignalsPrivileges)
+	if err != nil {
+		log.Error().Err(err).Msg("Error obtaining privilege token")
+		return nil, errors.Wrap(err, "error getting privilege token")
+	}
+
+	return queryLatestSignalValues(settings, tokenID, signalNames, *privilegeToken)
+}
+
+func queryLatestSignalValues(settings *config.Settings, tokenID int64, signalNames []string, privilegeToken string) (SignalEntries, error) {
 	var latestSignalData struct {
 		Data struct {
 			SignalsLatest map[string]struct {
@@ -85,13 +99,7 @@ func FetchLatestSignalValues(tokenID int64, signalNames []string, settings *conf
 
 	log.Info().Msgf("Sending FetchLatestSignalValues query: %s", graphqlQuery)
 
-	privilegeToken, err := RequestPriviledgeToken(c, settings, tokenID)
-	if err != nil {
-		log.Error().Err(err).Msg("Error obtaining privilege token")
-		return nil, errors.Wrap(err, "error getting privilege token")
-	}
-
-	resp, err := makeGraphQLRequest(settings.TelemetryAPIURL, graphqlQuery, privilegeToken)
+	resp, err := makeGraphQLRequest(settings.TelemetryAPIURL, graphqlQuery, &privilegeToken)
 	if err != nil {
 		log.Error().Err(err).Msg("Error making request to Telemetry API for latest signal values")
 		return nil, err
@@ -138,17 +146,28 @@ func (v *VehiclesController) HandleGetHistoricalData(c *fiber.Ctx) error {
 	startTime := endTime.AddDate(0, 0, -7)
 
 	// Fetch historical data with a 24-hour interval
-	entries, err := FetchHistoricalSignalValues(tokenID, signalName, startTime.Format(time.RFC3339), endTime.Format(time.RFC3339), v.settings, c)
+	entries, err := FetchHistoricalSignalValues(tokenID, signalName, "24h", startTime.Format(time.RFC3339), endTime.Format(time.RFC3339), v.settings, c)
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch historical signal values",
-		})
+		status, message := privilegeErrorStatus(err, fiber.StatusInternalServerError, "Failed to fetch historical signal values")
+		return c.Status(status).JSON(fiber.Map{"error": message})
 	}
 
 	return c.JSON(entries)
 }
 
-func FetchHistoricalSignalValues(tokenID int64, signalName string, startTime, endTime string, settings *config.Settings, c *fiber.Ctx) ([]SignalEntry, error) {
+// FetchHistoricalSignalValues retrieves the signal per interval bucket (eg. "24h" or "5m") between startTime and endTime
+func FetchHistoricalSignalValues(tokenID int64, signalName, interval string, startTime, endTime string, settings *config.Settings, c *fiber.Ctx) ([]SignalEntry, error) {
+	privilegeToken, err := RequestPriviledgeToken(c, settings, tokenID, SignalsPrivileges)
+	if err != nil {
+		log.Error().Err(err).Msg("Error obtaining privilege token")
+		return nil, errors.Wrap(err, "error getting privilege token")
+	}
+
+	return queryHistoricalSignalValues(settings, tokenID, signalName, interval, startTime, endTime, *privilegeToken)
+}
+
+// queryHistoricalSignalValues returns the MAX of the signal per interval bucket, with the bucket's start as timestamp
+func queryHistoricalSignalValues(settings *config.Settings, tokenID int64, signalName, interval string, startTime, endTime string, privilegeToken string) ([]SignalEntry, error) {
 	var historicalData struct {
 		Data struct {
 			Signals []map[string]interface{} `json:"signals"`
@@ -156,20 +175,15 @@ func FetchHistoricalSignalValues(tokenID int64, signalName string, startTime, en
 	}
 
 	graphqlQuery := fmt.Sprintf(`{
-		signals(tokenId: %d, interval: "24h", from: "%s", to: "%s") {
+		signals(tokenId: %d, interval: "%s", from: "%s", to: "%s") {
+			timestamp
 			%s(agg: MAX)
 		}
-	}`, tokenID, startTime, endTime, signalName)
+	}`, tokenID, interval, startTime, endTime, signalName)
 
 	log.Info().Msgf("Sending FetchHistoricalSignalValues query: %s", graphqlQuery)
 
-	privilegeToken, err := RequestPriviledgeToken(c, settings, tokenID)
-	if err != nil {
-		log.Error().Err(err).Msg("Error obtaining privilege token")
-		return nil, errors.Wrap(err, "error getting privilege token")
-	}
-
-	resp, err := makeGraphQLRequest(settings.TelemetryAPIURL, graphqlQuery, privilegeToken)
+	resp, err := makeGraphQLRequest(settings.TelemetryAPIURL, graphqlQuery, &privilegeToken)
 	if err != nil {
 		log.Error().Err(err).Msg("Error making request to Telemetry API for historical values")
 		return nil, err
@@ -185,10 +199,11 @@ func FetchHistoricalSignalValues(tokenID int64, signalName string, startTime, en
 	entries := []SignalEntry{}
 	for _, signal := range historicalData.Data.Signals {
 		if value, ok := signal[signalName]; ok {
+			timestamp, _ := signal["timestamp"].(string)
 			entry := SignalEntry{
 				SignalName: signalName,
 				Value:      value,
-				Timestamp:  "", // No specific timestamp with aggregation
+				Timestamp:  timestamp,
 			}
 			entries = append(entries, entry)
 			log.Info().Msgf("Parsed historical signal entry: %v", entry)
@@ -225,3 +240,134 @@ func makeGraphQLRequest(url, graphqlQuery string, privilegeToken *string) ([]byt
 
 	return io.ReadAll(resp.Body)
 }
+
+// FetchLatestLocation returns the last known location of the vehicle and when it was recorded
+func FetchLatestLocation(settings *config.Settings, tokenID int64, privilegeToken string) (*LatLon, time.Time, error) {
+	var latestLocation struct {
+		Data struct {
+			SignalsLatest struct {
+				Latitude *struct {
+					Timestamp time.Time `json:"timestamp"`
+					Value     float64   `json:"value"`
+				} `json:"currentLocationLatitude"`
+				Longitude *struct {
+					Timestamp time.Time `json:"timestamp"`
+					Value     float64   `json:"value"`
+				} `json:"currentLocationLongitude"`
+			} `json:"signalsLatest"`
+		} `json:"data"`
+	}
+
+	graphqlQuery := fmt.Sprintf(`{
+		signalsLatest(tokenId: %d) {
+			currentLocationLatitude { timestamp value }
+			currentLocationLongitude { timestamp value }
+		}
+	}`, tokenID)
+
+	resp, err := makeGraphQLRequest(settings.TelemetryAPIURL, graphqlQuery, &privilegeToken)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	if err := json.Unmarshal(resp, &latestLocation); err != nil {
+		return nil, time.Time{}, errors.Wrap(err, "error parsing latest location response")
+	}
+
+	latest := latestLocation.Data.SignalsLatest
+	if latest.Latitude == nil || latest.Longitude == nil {
+		return nil, time.Time{}, nil
+	}
+
+	return &LatLon{Latitude: latest.Latitude.Value, Longitude: latest.Longitude.Value}, latest.Latitude.Timestamp, nil
+}
+
+// NumericSignal is the latest value of a signal that can be compared against a threshold
+type NumericSignal struct {
+	Value     float64
+	Timestamp time.Time
+}
+
+// FetchLatestNumericSignals returns the latest values of the signals, skipping those without data or with non numeric values
+func FetchLatestNumericSignals(settings *config.Settings, tokenID int64, signalNames []string, privilegeToken string) (map[string]NumericSignal, error) {
+	var latestSignalData struct {
+		Data struct {
+			SignalsLatest map[string]*struct {
+				Timestamp time.Time `json:"timestamp"`
+				Value     any       `json:"value"`
+			} `json:"signalsLatest"`
+		} `json:"data"`
+	}
+
+	signalsQuery := ""
+	for _, signal := range signalNames {
+		signalsQuery += fmt.Sprintf("%s { timestamp value } ", signal)
+	}
+
+	graphqlQuery := fmt.Sprintf(`{
+		signalsLatest(tokenId: %d) {
+			%s
+		}
+	}`, tokenID, signalsQuery)
+
+	resp, err := makeGraphQLRequest(settings.TelemetryAPIURL, graphqlQuery, &privilegeToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp, &latestSignalData); err != nil {
+		return nil, errors.Wrap(err, "error parsing latest signal values response")
+	}
+
+	signals := make(map[string]NumericSignal, len(latestSignalData.Data.SignalsLatest))
+	for name, signal := range latestSignalData.Data.SignalsLatest {
+		if signal == nil {
+			continue
+		}
+		if value, ok := signal.Value.(float64); ok {
+			signals[name] = NumericSignal{Value: value, Timestamp: signal.Timestamp}
+		}
+	}
+	return signals, nil
+}
+
+// FetchSignalAggregate aggregates the signal over [from, to] in a single bucket. agg is a telemetry aggregation such as MIN or MAX.
+// Returns nil when the vehicle sent no data in the window.
+func FetchSignalAggregate(settings *config.Settings, tokenID int64, signalName, agg string, from, to time.Time, privilegeToken string) (*float64, error) {
+	var aggregateData struct {
+		Data struct {
+			Signals []struct {
+				Value *float64 `json:"value"`
+			} `json:"signals"`
+		} `json:"data"`
+	}
+
+	intervalSeconds := int64(to.Sub(from).Seconds()) + 1
+
+	graphqlQuery := fmt.Sprintf(`{
+		signals(tokenId: %d, interval: "%ds", from: "%s", to: "%s") {
+			value: %s(agg: %s)
+		}
+	}`, tokenID, intervalSeconds, from.UTC().Format(time.RFC3339), to.UTC().Add(time.Second).Format(time.RFC3339), signalName, agg)
+
+	resp, err := makeGraphQLRequest(settings.TelemetryAPIURL, graphqlQuery, &privilegeToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(resp, &aggregateData); err != nil {
+		return nil, errors.Wrap(err, "error parsing signal aggregate response")
+	}
+
+	// buckets may not line up with the window, so combine them the same way
+	var result *float64
+	for _, bucket := range aggregateData.Data.Signals {
+		if bucket.Value == nil {
+			continue
+		}
+		if result == nil || (agg == "MIN" && *bucket.Value < *result) || (agg == "MAX" && *bucket.Value > *result) {
+			result = bucket.Value
+		}
+	}
+	return result, nil
+}
@@ -7,13 +7,30 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"time"
 
 	"github.com/rs/zerolog"
 
 	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/gofiber/contrib/websocket"
 	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+)
+
+const (
+	// recentVehicleAlerts is how many alerts are shown on each vehicle card
+	recentVehicleAlerts = 3
+
+	// liveSignalsPingInterval keeps idle live signal connections from being closed by proxies
+	liveSignalsPingInterval = 30 * time.Second
+
+	// identityPageSize is the largest page the identity API serves
+	identityPageSize = 100
+
+	// maxIdentityPages bounds the cursor loop in case the identity API keeps returning the same cursor
+	maxIdentityPages = 100
 )
 
 type GraphQLRequest struct {
@@ -37,17 +54,28 @@ type Vehicle struct {
 			Name string `json:"name"`
 		} `json:"manufacturer"`
 	} `json:"aftermarketDevice"`
-	SignalEntries []SignalEntry `json:"signalEntries"`
-	Trips         []Trip        `json:"trips"`
+	// Privileges are the grants of the session address, only queried for shared vehicles
+	Privileges struct {
+		Nodes []VehiclePrivilegeGrant `json:"nodes"`
+	} `json:"privileges"`
+	// Shared is set on vehicles shared with the session address rather than owned by it
+	Shared bool `json:"-"`
+	// AccessAddress is the session address that owns the vehicle or that it is shared with
+	AccessAddress string         `json:"-"`
+	SignalEntries []SignalEntry  `json:"signalEntries"`
+	Trips         []Trip         `json:"trips"`
+	Alerts        []Alert        `json:"alerts,omitempty"`
+	Access        *VehicleAccess `json:"access,omitempty"`
 }
 
 type VehiclesController struct {
 	settings *config.Settings
 	logger   *zerolog.Logger
+	signals  *SignalPoller
 }
 
-func NewVehiclesController(settings *config.Settings, logger *zerolog.Logger) VehiclesController {
-	return VehiclesController{settings: settings, logger: logger}
+func NewVehiclesController(settings *config.Settings, logger *zerolog.Logger, signals *SignalPoller) VehiclesController {
+	return VehiclesController{settings: settings, logger: logger, signals: signals}
 }
 
 func (v *VehiclesController) HandleGiveFeedback(settings *config.Settings) fiber.Handler {
@@ -64,14 +92,14 @@ func (v *VehiclesController) HandleGiveFeedback(settings *config.Settings) fiber
 		}
 
 		var deviceType string
-		vehicles, err := QueryIdentityAPIForVehicles(ethAddress, settings)
+		accountVehicles, err := Vehicles.Lookup(ethAddress, settings)
 		if err != nil {
 			v.logger.Error().Err(err).Msg("Error querying My Vehicles")
 			return c.Status(fiber.StatusInternalServerError).SendString("Error querying my vehicles: " + err.Error())
 		}
 
-		if len(vehicles) > 0 {
-			aftermarketDevice := vehicles[0].AftermarketDevice
+		if len(accountVehicles.Owned) > 0 {
+			aftermarketDevice := accountVehicles.Owned[0].AftermarketDevice
 			if aftermarketDevice.Address != "" && aftermarketDevice.Serial != "" && aftermarketDevice.Manufacturer.Name != "" {
 				deviceType = fmt.Sprintf("%s: %s", aftermarketDevice.Manufacturer.Name, aftermarketDevice.Serial)
 			}
@@ -85,41 +113,117 @@ func (v *VehiclesController) HandleGiveFeedback(settings *config.Settings) fiber
 	}
 }
 
+// HandleGetVehicles renders the owned and shared vehicles, searched, sorted and paged on the server.
+// Query params: q (make, model, year or serial), sort (tokenId, make, model or year), order (asc or desc),
+// per_page, page and shared_page, view (owned or shared)
 func (v *VehiclesController) HandleGetVehicles(c *fiber.Ctx) error {
 	ethAddress := c.Locals("ethereum_address").(string)
 
-	sessionCookie := c.Cookies("session_id")
-	if sessionCookie == "" {
-		v.logger.Warn().Msg("No session_id cookie")
-		return c.Render("session_expired", fiber.Map{})
-	}
-	jwtToken, found := CacheInstance.Get(sessionCookie)
-	if !found {
-		v.logger.Warn().Msg("Session expired")
-		return c.Render("session_expired", fiber.Map{})
-	}
-
-	vehicles, err := QueryIdentityAPIForVehicles(ethAddress, v.settings)
+	accountVehicles, err := Vehicles.LookupAll(sessionAddresses(c), v.settings)
 	if err != nil {
-		v.logger.Error().Err(err).Msg("Error querying My Vehicles")
-		return c.Status(fiber.StatusInternalServerError).SendString("Error querying my vehicles: " + err.Error())
+		v.logger.Error().Err(err).Msg("Error querying vehicles")
+		return c.Status(fiber.StatusInternalServerError).SendString("Error querying vehicles: " + err.Error())
 	}
+	vehicles, sharedVehicles := accountVehicles.Owned, accountVehicles.Shared
 
-	sharedVehicles, err := QuerySharedVehicles(ethAddress, v.settings)
-	if err != nil {
-		v.logger.Error().Err(err).Msg("Error querying Shared Vehicles")
-		return c.Status(fiber.StatusInternalServerError).SendString("Error querying shared vehicles: " + err.Error())
+	search := c.Query("q")
+	sortKey := c.Query("sort", "tokenId")
+	if _, ok := VehicleSortKeys[sortKey]; !ok {
+		sortKey = "tokenId"
+	}
+	order := c.Query("order", "asc")
+	if order != "desc" {
+		order = "asc"
 	}
+	perPage := c.QueryInt("per_page", defaultVehiclesPerPage)
+	if !slices.Contains(VehiclesPerPageOptions, perPage) {
+		perPage = defaultVehiclesPerPage
+	}
+	view := c.Query("view", "owned")
+	if view != "shared" {
+		view = "owned"
+	}
+
+	vehicles = SearchVehicles(vehicles, search)
+	sharedVehicles = SearchVehicles(sharedVehicles, search)
+	SortVehicles(vehicles, sortKey, order == "desc")
+	SortVehicles(sharedVehicles, sortKey, order == "desc")
+
+	ownedPage := PaginateVehicles(vehicles, c.QueryInt("page", 1), perPage)
+	sharedPage := PaginateVehicles(sharedVehicles, c.QueryInt("shared_page", 1), perPage)
+
+	attachRecentAlerts(ethAddress, ownedPage.Vehicles)
+	attachRecentAlerts(ethAddress, sharedPage.Vehicles)
+	now := time.Now()
+	attachAccess(ownedPage.Vehicles, now)
+	attachAccess(sharedPage.Vehicles, now)
+
+	query := url.Values{}
+	query.Set("q", search)
+	query.Set("sort", sortKey)
+	query.Set("order", order)
+	query.Set("per_page", strconv.Itoa(perPage))
+	query.Set("page", strconv.Itoa(ownedPage.Page))
+	query.Set("shared_page", strconv.Itoa(sharedPage.Page))
 
 	return c.Render("vehicles", fiber.Map{
 		"Title":          "My Vehicles",
-		"Vehicles":       vehicles,
-		"SharedVehicles": sharedVehicles,
+		"Vehicles":       ownedPage.Vehicles,
+		"SharedVehicles": sharedPage.Vehicles,
 		"EthAddress":     ethAddress,
-		"Token":          jwtToken,
+		"LinkedWallets":  sessionAddresses(c)[1:],
+		"Search":         search,
+		"Sort":           sortKey,
+		"Order":          order,
+		"PerPage":        perPage,
+		"PerPageOptions": VehiclesPerPageOptions,
+		"View":           view,
+		"OwnedPager":     vehiclePager(ownedPage, query, "page", "owned"),
+		"SharedPager":    vehiclePager(sharedPage, query, "shared_page", "shared"),
 	})
 }
 
+// vehiclePager links the previous and next pages of one list, keeping the search, sort and the other list's page
+func vehiclePager(page VehiclePage, query url.Values, pageParam, view string) fiber.Map {
+	link := func(target int) string {
+		values := url.Values{}
+		for key, value := range query {
+			values[key] = value
+		}
+		values.Set(pageParam, strconv.Itoa(target))
+		values.Set("view", view)
+		return "/vehicles/me?" + values.Encode()
+	}
+
+	pager := fiber.Map{
+		"Page":       page.Page,
+		"TotalPages": page.TotalPages,
+		"Total":      page.Total,
+	}
+	if page.Page > 1 {
+		pager["PrevURL"] = link(page.Page - 1)
+	}
+	if page.Page < page.TotalPages {
+		pager["NextURL"] = link(page.Page + 1)
+	}
+	return pager
+}
+
+// HandleRefreshVehicles drops the cached vehicles of the session's wallets so the next page load queries the identity API
+func (v *VehiclesController) HandleRefreshVehicles(c *fiber.Ctx) error {
+	for _, address := range sessionAddresses(c) {
+		Vehicles.Invalidate(address)
+	}
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// attachRecentAlerts adds the latest alert events of each vehicle for the vehicles page
+func attachRecentAlerts(ethAddress string, vehicles []Vehicle) {
+	for i := range vehicles {
+		vehicles[i].Alerts = Alerts.List(ethAddress, vehicles[i].TokenID, recentVehicleAlerts)
+	}
+}
+
 func (v *VehiclesController) HandleVehicleSignals(c *fiber.Ctx) error {
 	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
 	if err != nil {
@@ -131,9 +235,7 @@ func (v *VehiclesController) HandleVehicleSignals(c *fiber.Ctx) error {
 	signalNames, err := FetchAvailableSignals(tokenID, v.settings, c)
 	if err != nil {
 		v.logger.Error().Err(err).Msg("Failed to fetch available signals")
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "Failed to fetch available signals",
-		})
+		return renderPrivilegeError(c, err, fiber.StatusInternalServerError, "Failed to fetch available signals")
 	}
 
 	telemetrySignals, err := FetchLatestSignalValues(tokenID, signalNames, v.settings, c)
@@ -144,47 +246,222 @@ func (v *VehiclesController) HandleVehicleSignals(c *fiber.Ctx) error {
 		})
 	}
 
+	privilegeSummaryText := ""
+	vehicle, _, err := FindAccessibleVehicle(sessionAddresses(c), tokenID, v.settings)
+	if err != nil {
+		// the signals are already loaded, the privileges line is just left out
+		v.logger.Warn().Err(err).Int64("tokenId", tokenID).Msg("Failed to look up the privileges on the vehicle")
+	} else if vehicle != nil {
+		privilegeSummaryText = privilegeSummary(NewVehicleAccess(*vehicle, time.Now()))
+	}
+
 	return c.Render("vehicle_signals", fiber.Map{
 		"TokenID":          tokenID,
 		"SignalEntries":    telemetrySignals,
 		"AvailableSignals": signalNames,
-		"Privileges":       []any{},
+		"Privileges":       privilegeSummaryText,
 	})
 }
 
+// HandleLiveSignalsUpgrade checks the session holds the signals privilege on the vehicle before the live signals
+// WebSocket is opened
+func (v *VehiclesController) HandleLiveSignalsUpgrade(c *fiber.Ctx) error {
+	if !websocket.IsWebSocketUpgrade(c) {
+		return c.Status(fiber.StatusUpgradeRequired).JSON(fiber.Map{"error": "WebSocket upgrade required"})
+	}
+
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
+	}
+
+	vehicle, err := FindVehicleWithPrivileges(sessionAddresses(c), tokenID, SignalsPrivileges, v.settings)
+	if err != nil {
+		status, message := privilegeErrorStatus(err, fiber.StatusInternalServerError, "Error querying vehicles")
+		return c.Status(status).JSON(fiber.Map{"error": message})
+	}
+	if vehicle == nil {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{"error": "No access to this vehicle"})
+	}
+
+	accessToken, err := vehicleAccessToken(c, *vehicle)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Session expired"})
+	}
+
+	c.Locals("tokenID", tokenID)
+	c.Locals("accessToken", accessToken)
+	return c.Next()
+}
+
+// HandleLiveSignals sends the vehicle's signals over the WebSocket: a snapshot first, then only the signals that changed
+func (v *VehiclesController) HandleLiveSignals(conn *websocket.Conn) {
+	tokenID := conn.Locals("tokenID").(int64)
+	accessToken := conn.Locals("accessToken").(string)
+
+	updates, unsubscribe, err := v.signals.Subscribe(tokenID, accessToken)
+	if err != nil {
+		v.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Failed to get privilege token for live signals")
+		_, message := privilegeErrorStatus(err, 0, "Failed to get access to the vehicle")
+		_ = conn.WriteJSON(SignalUpdate{Type: SignalUpdateError, Error: message})
+		return
+	}
+	defer unsubscribe()
+
+	// the browser only ever sends close frames, reading is how we notice it went away
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(liveSignalsPingInterval)
+	defer ping.Stop()
+
+	for {
+		select {
+		case <-closed:
+			return
+		case update, ok := <-updates:
+			if !ok {
+				return
+			}
+			if err := conn.WriteJSON(update); err != nil {
+				return
+			}
+		case <-ping.C:
+			if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(5*time.Second)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// HandleAvailableSignals lists the signal names the vehicle reports, as JSON
+func (v *VehiclesController) HandleAvailableSignals(c *fiber.Ctx) error {
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "Invalid token ID",
+		})
+	}
+
+	signalNames, err := FetchAvailableSignals(tokenID, v.settings, c)
+	if err != nil {
+		v.logger.Error().Err(err).Msg("Failed to fetch available signals")
+		status, message := privilegeErrorStatus(err, fiber.StatusInternalServerError, "Failed to fetch available signals")
+		return c.Status(status).JSON(fiber.Map{"error": message})
+	}
+
+	return c.JSON(signalNames)
+}
+
 func QueryIdentityAPIForVehicles(ethAddress string, settings *config.Settings) ([]Vehicle, error) {
-	graphqlQuery := `{
-        vehicles(first: 50, filterBy: { owner: "` + ethAddress + `" }) {
-            nodes {
-                tokenId,
-                earnings {
-                    totalTokens
-                },
-                definition {
-                    make,
-                    model,
-                    year
-                },
-                aftermarketDevice {
-                    address,
-                    serial,
-                    manufacturer {
-                        name
-                    }
+	return fetchAllVehicles(`owner: "`+ethAddress+`"`, "", settings)
+}
+
+// QuerySharedVehicles returns the vehicles shared with the address, with the privileges it holds on each
+func QuerySharedVehicles(ethAddress string, settings *config.Settings) ([]Vehicle, error) {
+	privilegeFields := `privileges(first: 100, filterBy: { user: "` + ethAddress + `" }) {
+                nodes {
+                    id
+                    user
+                    setAt
+                    expiresAt
                 }
-            }
-        }
-    }`
+            }`
+	vehicles, err := fetchAllVehicles(`privileged: "`+ethAddress+`"`, privilegeFields, settings)
+	if err != nil {
+		return nil, err
+	}
+	for i := range vehicles {
+		vehicles[i].Shared = true
+	}
+	return vehicles, nil
+}
 
-	return fetchVehiclesWithQuery(graphqlQuery, settings)
+// AccessibleTokenIDs returns the vehicles the address owns or has been shared
+func AccessibleTokenIDs(ethAddresses []string, settings *config.Settings) (map[int64]bool, error) {
+	accountVehicles, err := Vehicles.LookupAll(ethAddresses, settings)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenIDs := make(map[int64]bool, len(accountVehicles.Owned)+len(accountVehicles.Shared))
+	for _, vehicle := range accountVehicles.All() {
+		tokenIDs[vehicle.TokenID] = true
+	}
+	return tokenIDs, nil
 }
 
-func QuerySharedVehicles(ethAddress string, settings *config.Settings) ([]Vehicle, error) {
-	graphqlQuery := `{
-        vehicles(first: 50, filterBy: {privileged: "` + ethAddress + `" }) {
+// FindAccessibleVehicle returns the vehicle if one of the addresses owns it or it is shared with one, nil otherwise
+func FindAccessibleVehicle(ethAddresses []string, tokenID int64, settings *config.Settings) (*Vehicle, bool, error) {
+	accountVehicles, err := Vehicles.LookupAll(ethAddresses, settings)
+	if err != nil {
+		return nil, false, err
+	}
+	for _, vehicle := range accountVehicles.Owned {
+		if vehicle.TokenID == tokenID {
+			return &vehicle, false, nil
+		}
+	}
+	for _, vehicle := range accountVehicles.Shared {
+		if vehicle.TokenID == tokenID {
+			return &vehicle, true, nil
+		}
+	}
+	return nil, false, nil
+}
+
+// fetchAllVehicles follows the identity API cursor until every vehicle matching the filter is loaded.
+// extraFields are queried on each vehicle next to the common ones.
+func fetchAllVehicles(filter, extraFields string, settings *config.Settings) ([]Vehicle, error) {
+	vehicles := []Vehicle{}
+	cursor := ""
+	for page := 0; page < maxIdentityPages; page++ {
+		nodes, pageInfo, err := fetchVehiclesPage(filter, extraFields, cursor, settings)
+		if err != nil {
+			return nil, err
+		}
+		vehicles = append(vehicles, nodes...)
+		if !pageInfo.HasNextPage || pageInfo.EndCursor == "" {
+			return vehicles, nil
+		}
+		cursor = pageInfo.EndCursor
+	}
+	return nil, errors.Errorf("more than %d vehicles match %s", maxIdentityPages*identityPageSize, filter)
+}
+
+type identityPageInfo struct {
+	HasNextPage bool   `json:"hasNextPage"`
+	EndCursor   string `json:"endCursor"`
+}
+
+func fetchVehiclesPage(filter, extraFields, cursor string, settings *config.Settings) ([]Vehicle, identityPageInfo, error) {
+	var vehicleResponse struct {
+		Data struct {
+			Vehicles struct {
+				Nodes    []Vehicle        `json:"nodes"`
+				PageInfo identityPageInfo `json:"pageInfo"`
+			} `json:"vehicles"`
+		} `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+
+	after := ""
+	if cursor != "" {
+		after = fmt.Sprintf(", after: %q", cursor)
+	}
+	graphqlQuery := fmt.Sprintf(`{
+        vehicles(first: %d%s, filterBy: { %s }) {
             nodes {
                 tokenId,
-                name,
                 earnings {
                     totalTokens
                 },
@@ -200,52 +477,51 @@ func QuerySharedVehicles(ethAddress string, settings *config.Settings) ([]Vehicl
                         name
                     }
                 }
+                %s
+            }
+            pageInfo {
+                hasNextPage
+                endCursor
             }
         }
-    }`
+    }`, identityPageSize, after, filter, extraFields)
 
-	return fetchVehiclesWithQuery(graphqlQuery, settings)
+	if err := queryIdentityAPI(graphqlQuery, settings, &vehicleResponse); err != nil {
+		return nil, identityPageInfo{}, err
+	}
+	// a failing page must not pass for the end of the list
+	if len(vehicleResponse.Errors) > 0 {
+		return nil, identityPageInfo{}, errors.New(vehicleResponse.Errors[0].Message)
+	}
+
+	return vehicleResponse.Data.Vehicles.Nodes, vehicleResponse.Data.Vehicles.PageInfo, nil
 }
 
-func fetchVehiclesWithQuery(query string, settings *config.Settings) ([]Vehicle, error) {
+// queryIdentityAPI posts the GraphQL query to the identity API and decodes the response into result
+func queryIdentityAPI(query string, settings *config.Settings, result any) error {
 	requestPayload := GraphQLRequest{Query: query}
 	payloadBytes, err := json.Marshal(requestPayload)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	req, err := http.NewRequest("POST", settings.IdentityAPIURL, bytes.NewBuffer(payloadBytes))
 	if err != nil {
-		return nil, err
+		return err
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
 
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	var vehicleResponse struct {
-		Data struct {
-			Vehicles struct {
-				Nodes []Vehicle `json:"nodes"`
-			} `json:"vehicles"`
-		} `json:"data"`
-	}
-
-	if err := json.Unmarshal(body, &vehicleResponse); err != nil {
-		return nil, err
-	}
-
-	vehicles := make([]Vehicle, 0, len(vehicleResponse.Data.Vehicles.Nodes))
-	vehicles = append(vehicles, vehicleResponse.Data.Vehicles.Nodes...)
-
-	return vehicles, nil
+	return json.Unmarshal(body, result)
 }
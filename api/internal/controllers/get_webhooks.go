@@ -0,0 +1,289 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/rs/zerolog"
+)
+
+type WebhooksController struct {
+	settings *config.Settings
+	logger   *zerolog.Logger
+	client   *WebhooksClient
+	// replayAllowedHosts may be replayed to even though they aren't public, e.g. a consumer on localhost
+	replayAllowedHosts map[string]bool
+}
+
+func NewWebhooksController(settings *config.Settings, logger *zerolog.Logger) WebhooksController {
+	replayAllowedHosts := map[string]bool{}
+	for _, host := range strings.Split(settings.WebhookReplayAllowedHosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			replayAllowedHosts[strings.ToLower(host)] = true
+		}
+	}
+	return WebhooksController{
+		settings:           settings,
+		logger:             logger,
+		client:             NewWebhooksClient(settings.WebhooksAPIURL),
+		replayAllowedHosts: replayAllowedHosts,
+	}
+}
+
+func (w *WebhooksController) HandleListWebhooks(c *fiber.Ctx) error {
+	accessToken, err := sessionAccessToken(c)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Session expired"})
+	}
+
+	webhooks, err := w.client.ListWebhooks(c.Context(), accessToken)
+	if err != nil {
+		return w.handleError(c, err, "Failed to list webhooks")
+	}
+
+	return c.JSON(webhooks)
+}
+
+func (w *WebhooksController) HandleListSubscriptions(c *fiber.Ctx) error {
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid token ID"})
+	}
+
+	accessToken, err := vehicleAccessTokenByID(c, w.settings, tokenID)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Session expired"})
+	}
+
+	subscriptions, err := w.client.ListSubscriptions(c.Context(), accessToken, tokenID)
+	if err != nil {
+		return w.handleError(c, err, "Failed to list webhook subscriptions")
+	}
+
+	return c.JSON(subscriptions)
+}
+
+func (w *WebhooksController) HandleSubscribe(c *fiber.Ctx) error {
+	tokenID, eventID, err := webhookSubscriptionParams(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	accessToken, err := vehicleAccessTokenByID(c, w.settings, tokenID)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Session expired"})
+	}
+
+	if err := w.client.Subscribe(c.Context(), accessToken, tokenID, eventID); err != nil {
+		return w.handleError(c, err, "Failed to subscribe to webhook")
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{"message": "Webhook subscribed successfully"})
+}
+
+func (w *WebhooksController) HandleUnsubscribe(c *fiber.Ctx) error {
+	tokenID, eventID, err := webhookSubscriptionParams(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+
+	accessToken, err := vehicleAccessTokenByID(c, w.settings, tokenID)
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Session expired"})
+	}
+
+	if err := w.client.Unsubscribe(c.Context(), accessToken, tokenID, eventID); err != nil {
+		return w.handleError(c, err, "Failed to unsubscribe from webhook")
+	}
+
+	return c.JSON(fiber.Map{"message": "Webhook unsubscribed successfully"})
+}
+
+// handleError answers with the normalized status and message of the webhooks service, anything else is a 500
+func (w *WebhooksController) handleError(c *fiber.Ctx, err error, msg string) error {
+	var serviceErr *WebhookServiceError
+	if errors.As(err, &serviceErr) {
+		if serviceErr.Status >= fiber.StatusInternalServerError {
+			w.logger.Error().Err(err).Msg(msg)
+		}
+		return c.Status(serviceErr.Status).JSON(fiber.Map{"error": serviceErr.Message})
+	}
+
+	w.logger.Error().Err(err).Msg(msg)
+	return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": msg})
+}
+
+func webhookSubscriptionParams(c *fiber.Ctx) (int64, string, error) {
+	tokenID, err := strconv.ParseInt(c.Params("tokenid"), 10, 64)
+	if err != nil {
+		return 0, "", errors.New("Invalid token ID")
+	}
+	eventID := c.Params("eventID")
+	if eventID == "" {
+		return 0, "", errors.New("Event ID is required")
+	}
+	return tokenID, eventID, nil
+}
+
+// sessionAccessToken returns the JWT of the current session
+func sessionAccessToken(c *fiber.Ctx) (string, error) {
+	jwtToken, found := CacheInstance.Get(c.Cookies("session_id"))
+	if !found {
+		return "", errors.New("session not found")
+	}
+	accessToken, ok := jwtToken.(string)
+	if !ok {
+		return "", errors.New("JWT token value is not valid")
+	}
+	return accessToken, nil
+}
+
+// WebhookReplayRequest is the JSON payload to resend a received event
+type WebhookReplayRequest struct {
+	URL string `json:"url"`
+}
+
+// HandleReceiveWebhook is the public endpoint registered with DIMO. The vehicle comes from the payload,
+// or from a tokenId query param when the payload doesn't carry it.
+func (w *WebhooksController) HandleReceiveWebhook(c *fiber.Ctx) error {
+	if w.settings.WebhookReceiverSecret == "" {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{"error": "Webhook receiver is not configured"})
+	}
+
+	payload := append([]byte(nil), c.Body()...)
+	if !VerifyWebhookSignature(w.settings.WebhookReceiverSecret, payload, c.Get(WebhookSignatureHeader)) {
+		w.logger.Warn().Str("ip", c.IP()).Msg("Rejected webhook with invalid signature")
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{"error": "Invalid signature"})
+	}
+
+	tokenID, eventType, err := ParseWebhookEvent(payload)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": err.Error()})
+	}
+	if tokenID == 0 {
+		tokenID = int64(c.QueryInt("tokenId"))
+	}
+	if tokenID <= 0 {
+		return c.Status(fiber.StatusUnprocessableEntity).JSON(fiber.Map{"error": "Could not determine the vehicle of the event"})
+	}
+
+	headers := make(map[string]string)
+	c.Request().Header.VisitAll(func(key, value []byte) {
+		name := string(key)
+		if name == fiber.HeaderAuthorization || name == fiber.HeaderCookie {
+			return
+		}
+		headers[name] = string(value)
+	})
+
+	event := WebhookEvents.Add(WebhookEvent{
+		TokenID:     tokenID,
+		Type:        eventType,
+		Payload:     payload,
+		Headers:     headers,
+		ContentType: c.Get(fiber.HeaderContentType),
+		ReceivedAt:  time.Now().UTC(),
+	})
+
+	return c.JSON(fiber.Map{"id": event.ID})
+}
+
+// HandleWebhookInbox renders the received events of the user's vehicles. Query params: tokenId, type, q
+func (w *WebhooksController) HandleWebhookInbox(c *fiber.Ctx) error {
+	tokenIDs, err := AccessibleTokenIDs(sessionAddresses(c), w.settings)
+	if err != nil {
+		w.logger.Error().Err(err).Msg("Error querying vehicles for webhook inbox")
+		return c.Status(fiber.StatusInternalServerError).SendString("Error querying vehicles: " + err.Error())
+	}
+
+	filter := WebhookEventFilter{
+		TokenID: int64(c.QueryInt("tokenId")),
+		Type:    c.Query("type"),
+		Query:   c.Query("q"),
+	}
+
+	events := WebhookEvents.List(tokenIDs, filter, 100)
+	rows := make([]fiber.Map, 0, len(events))
+	for _, event := range events {
+		rows = append(rows, fiber.Map{
+			"ID":         event.ID,
+			"TokenID":    event.TokenID,
+			"Type":       event.Type,
+			"ReceivedAt": event.ReceivedAt.Format(time.RFC3339),
+			"Payload":    prettyJSON(event.Payload),
+			"Headers":    event.Headers,
+		})
+	}
+
+	vehicleIDs := make([]int64, 0, len(tokenIDs))
+	for tokenID := range tokenIDs {
+		vehicleIDs = append(vehicleIDs, tokenID)
+	}
+	slices.Sort(vehicleIDs)
+
+	filterTokenID := ""
+	if filter.TokenID != 0 {
+		filterTokenID = strconv.FormatInt(filter.TokenID, 10)
+	}
+
+	return c.Render("webhook_inbox", fiber.Map{
+		"Title":         "Webhook Inbox",
+		"Events":        rows,
+		"VehicleIDs":    vehicleIDs,
+		"Types":         WebhookEvents.Types(tokenIDs),
+		"FilterTokenID": filterTokenID,
+		"FilterType":    filter.Type,
+		"FilterQuery":   filter.Query,
+		"ReceiverURL":   c.BaseURL() + "/webhooks/receive",
+		"Configured":    w.settings.WebhookReceiverSecret != "",
+	})
+}
+
+// HandleReplayWebhookEvent resends a received event to the given URL, eg. a consumer under development. Only public
+// addresses are reached, see publicHTTPClient, unless the host is listed in WEBHOOK_REPLAY_ALLOWED_HOSTS.
+func (w *WebhooksController) HandleReplayWebhookEvent(c *fiber.Ctx) error {
+	var req WebhookReplayRequest
+	if err := c.BodyParser(&req); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid request payload"})
+	}
+	if err := validateHTTPURL(req.URL); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{"error": "Invalid replay URL"})
+	}
+
+	event, ok := WebhookEvents.Get(c.Params("eventID"))
+	if !ok {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Event not found"})
+	}
+
+	tokenIDs, err := AccessibleTokenIDs(sessionAddresses(c), w.settings)
+	if err != nil {
+		w.logger.Error().Err(err).Msg("Error querying vehicles for webhook replay")
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{"error": "Error querying vehicles"})
+	}
+	if !tokenIDs[event.TokenID] {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{"error": "Event not found"})
+	}
+
+	result, err := ReplayWebhookEvent(c.Context(), event, req.URL, w.replayAllowedHosts)
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{"error": "Replay failed: " + err.Error()})
+	}
+
+	return c.JSON(result)
+}
+
+// prettyJSON indents the payload for display, leaving anything that isn't JSON as is
+func prettyJSON(payload []byte) string {
+	var out bytes.Buffer
+	if err := json.Indent(&out, payload, "", "  "); err != nil {
+		return string(payload)
+	}
+	return out.String()
+}
@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/pkg/errors"
+)
+
+// jwksRefreshInterval keeps tokens naming unknown keys from fetching the key set on every request
+const jwksRefreshInterval = 5 * time.Minute
+
+// JWKS verifies JWTs against the keys DIMO's auth server publishes at TOKEN_EXCHANGE_JWK_KEY_SET_URL. The keys are
+// fetched again when a token names one it doesn't know yet, so rotating them needs no restart.
+type JWKS struct {
+	url      string
+	audience string
+	client   *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]any
+	fetchedAt time.Time
+}
+
+func NewJWKS(settings *config.Settings) *JWKS {
+	return &JWKS{
+		url:      settings.TokenExchangeJWTKeySetURL,
+		audience: settings.ClientID,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Verify checks the signature, expiry and audience of the JWT
+func (k *JWKS) Verify(accessToken string) error {
+	options := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "ES256", "ES384", "ES512"}),
+		jwt.WithExpirationRequired(),
+	}
+	if k.audience != "" {
+		options = append(options, jwt.WithAudience(k.audience))
+	}
+	if _, err := jwt.Parse(accessToken, k.key, options...); err != nil {
+		return errors.Wrap(err, "invalid token")
+	}
+	return nil
+}
+
+// key returns the public key the token header names
+func (k *JWKS) key(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if key, found := k.keys[kid]; found {
+		return key, nil
+	}
+	if time.Since(k.fetchedAt) < jwksRefreshInterval {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+	if err := k.refreshLocked(); err != nil {
+		return nil, err
+	}
+	if key, found := k.keys[kid]; found {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func (k *JWKS) refreshLocked() error {
+	if k.url == "" {
+		return errors.New("TOKEN_EXCHANGE_JWK_KEY_SET_URL is not set")
+	}
+	// failures count as a fetch too, an unreachable auth server isn't asked again for every token
+	k.fetchedAt = time.Now()
+
+	resp, err := k.client.Get(k.url)
+	if err != nil {
+		return errors.Wrap(err, "failed to fetch the JWT signing keys")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to fetch the JWT signing keys: status code %d", resp.StatusCode)
+	}
+
+	var keySet struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&keySet); err != nil {
+		return errors.Wrap(err, "failed to decode the JWT signing keys")
+	}
+
+	keys := make(map[string]any, len(keySet.Keys))
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	k.keys = keys
+	return nil
+}
+
+func (jwk jsonWebKey) publicKey() (any, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64URLInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64URLInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64URLInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64URLInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+	}
+}
+
+func base64URLInt(value string) (*big.Int, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid key parameter")
+	}
+	return new(big.Int).SetBytes(decoded), nil
+}
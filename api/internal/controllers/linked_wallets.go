@@ -0,0 +1,161 @@
+package controllers
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/pkg/errors"
+)
+
+// LinkedWallet is another address the session verified with a challenge of its own. The vehicles it owns or that are
+// shared with it are listed next to the ones of the address the session signed in with.
+type LinkedWallet struct {
+	Address  string
+	LinkedAt time.Time
+	// ExpiresAt is the exp of the wallet's JWT, the wallet drops out of the session after it
+	ExpiresAt time.Time
+	// accessToken is exchanged for privilege tokens on the vehicles the wallet gives access to
+	accessToken string
+}
+
+// Addresses returns the address the session signed in with followed by its linked wallets that haven't expired
+func (s Session) Addresses(now time.Time) []string {
+	addresses := []string{s.Address}
+	for _, wallet := range s.Linked {
+		if now.Before(wallet.ExpiresAt) {
+			addresses = append(addresses, wallet.Address)
+		}
+	}
+	return addresses
+}
+
+// Link adds the wallet of the JWT to the session, linking it again replaces its JWT
+func (s *SessionStore) Link(id, accessToken string) (Session, error) {
+	ethAddress, err := ExtractEthereumAddressFromToken(accessToken)
+	if err != nil {
+		return Session{}, err
+	}
+	now := time.Now().UTC()
+	expiresAt, found := jwtExpiry(accessToken)
+	if !found {
+		expiresAt = now.Add(sessionMaxLifetime)
+	}
+	if !now.Before(expiresAt) {
+		return Session{}, errors.New("token has expired")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	session, found := s.sessions[id]
+	if !found {
+		return Session{}, errors.New("session expired")
+	}
+	if strings.EqualFold(session.Address, ethAddress) {
+		return Session{}, errors.New("the session is already signed in with this wallet")
+	}
+
+	// sessions are handed out by value, the slice is replaced rather than changed in place
+	linked := slices.DeleteFunc(slices.Clone(session.Linked), func(wallet LinkedWallet) bool {
+		return strings.EqualFold(wallet.Address, ethAddress)
+	})
+	session.Linked = append(linked, LinkedWallet{
+		Address:     ethAddress,
+		LinkedAt:    now,
+		ExpiresAt:   expiresAt,
+		accessToken: accessToken,
+	})
+	return *session, nil
+}
+
+// Unlink removes the wallet from the session, drops its privilege tokens and stops the geofence subscriptions and
+// alert rules polling with its JWT
+func (s *SessionStore) Unlink(id, ethAddress string) (Session, bool) {
+	s.mu.Lock()
+	session, found := s.sessions[id]
+	if !found {
+		s.mu.Unlock()
+		return Session{}, false
+	}
+
+	var unlinked *LinkedWallet
+	session.Linked = slices.DeleteFunc(slices.Clone(session.Linked), func(wallet LinkedWallet) bool {
+		if strings.EqualFold(wallet.Address, ethAddress) {
+			PrivilegeTokens.InvalidateAddress(wallet.Address)
+			unlinked = &wallet
+			return true
+		}
+		return false
+	})
+	updated := *session
+	s.mu.Unlock()
+
+	if unlinked == nil {
+		return updated, false
+	}
+	GeofenceSubscriptions.signOut(id, unlinked.accessToken)
+	AlertRules.signOut(id, unlinked.accessToken)
+	return updated, true
+}
+
+// AccessToken returns the JWT the session holds for one of its addresses
+func (s *SessionStore) AccessToken(id, ethAddress string) (string, bool) {
+	session, found := s.Get(id)
+	if !found {
+		return "", false
+	}
+	if strings.EqualFold(session.Address, ethAddress) {
+		jwtToken, found := CacheInstance.Get(id)
+		if !found {
+			return "", false
+		}
+		accessToken, ok := jwtToken.(string)
+		return accessToken, ok
+	}
+
+	now := time.Now()
+	for _, wallet := range session.Linked {
+		if strings.EqualFold(wallet.Address, ethAddress) && now.Before(wallet.ExpiresAt) {
+			return wallet.accessToken, true
+		}
+	}
+	return "", false
+}
+
+// sessionAddresses returns the addresses of the current session, set by AuthMiddleware
+func sessionAddresses(c *fiber.Ctx) []string {
+	if addresses, ok := c.Locals("ethereum_addresses").([]string); ok {
+		return addresses
+	}
+	if ethAddress, ok := c.Locals("ethereum_address").(string); ok {
+		return []string{ethAddress}
+	}
+	return nil
+}
+
+// vehicleAccessToken returns the JWT of the session's wallet that gives access to the vehicle
+func vehicleAccessToken(c *fiber.Ctx, vehicle Vehicle) (string, error) {
+	if vehicle.AccessAddress != "" {
+		if accessToken, found := Sessions.AccessToken(c.Cookies(sessionCookieName), vehicle.AccessAddress); found {
+			return accessToken, nil
+		}
+	}
+	return sessionAccessToken(c)
+}
+
+// vehicleAccessTokenByID is vehicleAccessToken for a vehicle known by its token ID. Vehicles the session can't see get
+// the JWT of the session, the APIs will refuse it.
+func vehicleAccessTokenByID(c *fiber.Ctx, settings *config.Settings, tokenID int64) (string, error) {
+	if addresses := sessionAddresses(c); len(addresses) > 1 {
+		vehicle, _, err := FindAccessibleVehicle(addresses, tokenID, settings)
+		if err != nil {
+			return "", err
+		}
+		if vehicle != nil {
+			return vehicleAccessToken(c, *vehicle)
+		}
+	}
+	return sessionAccessToken(c)
+}
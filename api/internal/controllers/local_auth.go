@@ -0,0 +1,172 @@
+package controllers
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// localChallengeTTL is how long the wallet has to sign a challenge
+	localChallengeTTL = 5 * time.Minute
+	// localMaxPendingChallenges caps the challenges waiting for a signature, new ones are refused beyond it
+	localMaxPendingChallenges = 10000
+	// localAuthDefaultChainID is Polygon, where DIMO's contracts live
+	localAuthDefaultChainID = 137
+
+	localAuthStatement = "Sign in to the DIMO Trips Sandbox."
+)
+
+// ErrTooManyChallenges is returned while localMaxPendingChallenges challenges wait for their signature
+var ErrTooManyChallenges = errors.New("too many pending challenges, try again in a few minutes")
+
+// LocalAuthProvider issues Sign-In with Ethereum (EIP-4361) challenges and verifies their signatures itself, so the app
+// runs without DIMO's auth server. Its JWTs carry the same ethereum_address claim as DIMO's, but DIMO's APIs don't
+// accept them, so privilege tokens can't be exchanged with them.
+type LocalAuthProvider struct {
+	domain     string
+	uri        string
+	chainID    int
+	signingKey []byte
+
+	mu         sync.Mutex
+	challenges map[string]localChallenge
+}
+
+// localChallenge is a challenge waiting for its signature, each can be submitted once
+type localChallenge struct {
+	address   common.Address
+	message   string
+	expiresAt time.Time
+}
+
+// NewLocalAuthProvider signs JWTs with a key made at startup, sessions don't outlive the process anyway
+func NewLocalAuthProvider(settings *config.Settings) (*LocalAuthProvider, error) {
+	uri := settings.LocalAuthURI
+	if uri == "" {
+		uri = "http://localhost:" + settings.Port
+	}
+	parsed, err := url.Parse(uri)
+	if err != nil || parsed.Host == "" {
+		return nil, fmt.Errorf("invalid LOCAL_AUTH_URI: %s", uri)
+	}
+	chainID := settings.LocalAuthChainID
+	if chainID == 0 {
+		chainID = localAuthDefaultChainID
+	}
+
+	signingKey := make([]byte, 32)
+	if _, err := rand.Read(signingKey); err != nil {
+		return nil, errors.Wrap(err, "failed to generate the local auth signing key")
+	}
+
+	return &LocalAuthProvider{
+		domain:     parsed.Host,
+		uri:        uri,
+		chainID:    chainID,
+		signingKey: signingKey,
+		challenges: make(map[string]localChallenge),
+	}, nil
+}
+
+func (p *LocalAuthProvider) GenerateChallenge(address string) (ChallengeResponse, error) {
+	if !common.IsHexAddress(address) {
+		return ChallengeResponse{}, errors.New("Invalid address")
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return ChallengeResponse{}, errors.Wrap(err, "failed to generate nonce")
+	}
+
+	now := time.Now().UTC()
+	challenge := localChallenge{
+		address:   common.HexToAddress(address),
+		expiresAt: now.Add(localChallengeTTL),
+	}
+	challenge.message = p.siweMessage(challenge.address, hex.EncodeToString(nonce), now, challenge.expiresAt)
+	state := uuid.New().String()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for id, pending := range p.challenges {
+		if now.After(pending.expiresAt) {
+			delete(p.challenges, id)
+		}
+	}
+	if len(p.challenges) >= localMaxPendingChallenges {
+		return ChallengeResponse{}, ErrTooManyChallenges
+	}
+	p.challenges[state] = challenge
+
+	return ChallengeResponse{State: state, Challenge: challenge.message}, nil
+}
+
+// SubmitChallenge checks the challenge was signed by the address it was issued for and issues a JWT for it
+func (p *LocalAuthProvider) SubmitChallenge(signatureReq SignatureRequest) (string, error) {
+	p.mu.Lock()
+	challenge, found := p.challenges[signatureReq.State]
+	delete(p.challenges, signatureReq.State)
+	p.mu.Unlock()
+
+	now := time.Now().UTC()
+	if !found || now.After(challenge.expiresAt) {
+		return "", errors.New("Challenge not found or expired")
+	}
+
+	signer, err := recoverPersonalSigner([]byte(challenge.message), signatureReq.Signature)
+	if err != nil {
+		return "", err
+	}
+	if signer != challenge.address {
+		return "", fmt.Errorf("Challenge was signed by %s instead of %s", signer.Hex(), challenge.address.Hex())
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"iss":              p.uri,
+		"sub":              challenge.address.Hex(),
+		"iat":              now.Unix(),
+		"exp":              now.Add(sessionMaxLifetime).Unix(),
+		"ethereum_address": challenge.address.Hex(),
+	})
+	return token.SignedString(p.signingKey)
+}
+
+// VerifyToken checks the JWT was signed with the key of this process, JWTs of DIMO's auth server aren't accepted
+func (p *LocalAuthProvider) VerifyToken(accessToken string) error {
+	_, err := jwt.Parse(accessToken, func(*jwt.Token) (any, error) {
+		return p.signingKey, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}), jwt.WithIssuer(p.uri), jwt.WithExpirationRequired())
+	if err != nil {
+		return errors.Wrap(err, "invalid token")
+	}
+	return nil
+}
+
+// siweMessage formats the challenge as EIP-4361 asks, wallets that know the format show it as a sign-in request
+func (p *LocalAuthProvider) siweMessage(address common.Address, nonce string, issuedAt, expiresAt time.Time) string {
+	lines := []string{
+		fmt.Sprintf("%s wants you to sign in with your Ethereum account:", p.domain),
+		address.Hex(),
+		"",
+		localAuthStatement,
+		"",
+		"URI: " + p.uri,
+		"Version: 1",
+		fmt.Sprintf("Chain ID: %d", p.chainID),
+		"Nonce: " + nonce,
+		"Issued At: " + issuedAt.Format(time.RFC3339),
+		"Expiration Time: " + expiresAt.Format(time.RFC3339),
+	}
+	return strings.Join(lines, "\n")
+}
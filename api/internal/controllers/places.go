@@ -0,0 +1,233 @@
+package controllers
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	PlaceShapeCircle  = "circle"
+	PlaceShapePolygon = "polygon"
+)
+
+// Place is a named area saved by a user, either a circle or a polygon.
+// Places without a TokenID apply to every vehicle of the account.
+type Place struct {
+	ID           string    `json:"id"`
+	Owner        string    `json:"owner"`
+	TokenID      *int64    `json:"tokenId,omitempty"`
+	Name         string    `json:"name"`
+	Shape        string    `json:"shape"`
+	Center       *LatLon   `json:"center,omitempty"`
+	RadiusMeters float64   `json:"radiusMeters,omitempty"`
+	Polygon      []LatLon  `json:"polygon,omitempty"`
+	CreatedAt    time.Time `json:"createdAt"`
+}
+
+// Validate checks the place has a name and a well formed shape
+func (p *Place) Validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return errors.New("name is required")
+	}
+	switch p.Shape {
+	case PlaceShapeCircle:
+		if p.Center == nil {
+			return errors.New("center is required for a circle")
+		}
+		if p.RadiusMeters <= 0 {
+			return errors.New("radiusMeters must be positive")
+		}
+	case PlaceShapePolygon:
+		if len(p.Polygon) < 3 {
+			return errors.New("a polygon needs at least 3 points")
+		}
+	default:
+		return errors.New("shape must be circle or polygon")
+	}
+	return nil
+}
+
+// Contains reports whether the location lies within the place
+func (p *Place) Contains(location LatLon) bool {
+	switch p.Shape {
+	case PlaceShapeCircle:
+		return p.Center != nil && HaversineKm(*p.Center, location)*1000 <= p.RadiusMeters
+	case PlaceShapePolygon:
+		return polygonContains(p.Polygon, location)
+	}
+	return false
+}
+
+// AppliesTo reports whether the place is an account wide place or belongs to the vehicle
+func (p *Place) AppliesTo(tokenID int64) bool {
+	return p.TokenID == nil || *p.TokenID == tokenID
+}
+
+// polygonContains uses ray casting, treating lat/lon as planar which is fine at geofence scale
+func polygonContains(polygon []LatLon, location LatLon) bool {
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Latitude > location.Latitude) != (b.Latitude > location.Latitude) {
+			crossLon := (b.Longitude-a.Longitude)*(location.Latitude-a.Latitude)/(b.Latitude-a.Latitude) + a.Longitude
+			if location.Longitude < crossLon {
+				inside = !inside
+			}
+		}
+	}
+	return inside
+}
+
+// PlaceStore holds saved places in memory
+type PlaceStore struct {
+	mu     sync.RWMutex
+	places map[string]Place
+}
+
+var Places = NewPlaceStore()
+
+func NewPlaceStore() *PlaceStore {
+	return &PlaceStore{places: make(map[string]Place)}
+}
+
+// Create validates and stores a new place, assigning its ID
+func (s *PlaceStore) Create(place Place) (Place, error) {
+	if err := place.Validate(); err != nil {
+		return Place{}, err
+	}
+	place.ID = uuid.New().String()
+	place.Owner = strings.ToLower(place.Owner)
+	place.CreatedAt = time.Now().UTC()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.places[place.ID] = place
+
+	return place, nil
+}
+
+// Get returns the place if it exists and belongs to owner
+func (s *PlaceStore) Get(owner, placeID string) (Place, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	place, ok := s.places[placeID]
+	if !ok || place.Owner != strings.ToLower(owner) {
+		return Place{}, false
+	}
+	return place, true
+}
+
+// Delete removes the place if it belongs to owner
+func (s *PlaceStore) Delete(owner, placeID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	place, ok := s.places[placeID]
+	if !ok || place.Owner != strings.ToLower(owner) {
+		return false
+	}
+	delete(s.places, placeID)
+	return true
+}
+
+// List returns all places of the owner sorted by name
+func (s *PlaceStore) List(owner string) []Place {
+	owner = strings.ToLower(owner)
+
+	s.mu.RLock()
+	places := make([]Place, 0)
+	for _, place := range s.places {
+		if place.Owner == owner {
+			places = append(places, place)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(places, func(i, j int) bool {
+		return places[i].Name < places[j].Name
+	})
+	return places
+}
+
+// ForVehicle returns the places of the owner that apply to the vehicle
+func (s *PlaceStore) ForVehicle(owner string, tokenID int64) []Place {
+	all := s.List(owner)
+	places := make([]Place, 0, len(all))
+	for _, place := range all {
+		if place.AppliesTo(tokenID) {
+			places = append(places, place)
+		}
+	}
+	return places
+}
+
+// MatchPlace returns the first of places containing the location. Vehicle specific places win over account wide ones.
+func MatchPlace(places []Place, location LatLon) *Place {
+	var match *Place
+	for i := range places {
+		if !places[i].Contains(location) {
+			continue
+		}
+		if places[i].TokenID != nil {
+			return &places[i]
+		}
+		if match == nil {
+			match = &places[i]
+		}
+	}
+	return match
+}
+
+// PlaceVisit is a stay of a vehicle at a place. Arrival or Departure is zero when it lies outside the looked at trips.
+type PlaceVisit struct {
+	Arrival         time.Time     `json:"arrival"`
+	Departure       time.Time     `json:"departure"`
+	ArrivalTripID   string        `json:"arrivalTripId,omitempty"`
+	DepartureTripID string        `json:"departureTripId,omitempty"`
+	Dwell           time.Duration `json:"dwell"`
+	// Ongoing is set when the vehicle is still at the place
+	Ongoing bool `json:"ongoing"`
+}
+
+// ComputePlaceVisits derives visits from trip endpoints: a trip ending in the place is an arrival and the
+// next trip starting in it is the departure. Trips must be sorted by start time, oldest first.
+func ComputePlaceVisits(place Place, trips []Trip) []PlaceVisit {
+	visits := make([]PlaceVisit, 0)
+	var current *PlaceVisit
+
+	for _, trip := range trips {
+		if start, ok := tripPointLatLon(trip.Start); ok && place.Contains(start) {
+			departure, _ := time.Parse(time.RFC3339, trip.Start.Time)
+			if current == nil {
+				// the vehicle was already there when the looked at trips begin
+				current = &PlaceVisit{}
+			}
+			current.Departure = departure
+			current.DepartureTripID = trip.ID
+			if !current.Arrival.IsZero() {
+				current.Dwell = departure.Sub(current.Arrival)
+			}
+			visits = append(visits, *current)
+			current = nil
+		} else if current != nil {
+			// the trip left from somewhere else, we missed the departure
+			visits = append(visits, *current)
+			current = nil
+		}
+
+		if end, ok := tripPointLatLon(trip.End); ok && place.Contains(end) {
+			arrival, _ := time.Parse(time.RFC3339, trip.End.Time)
+			current = &PlaceVisit{Arrival: arrival, ArrivalTripID: trip.ID}
+		}
+	}
+
+	if current != nil {
+		visits = append(visits, *current)
+	}
+
+	return visits
+}
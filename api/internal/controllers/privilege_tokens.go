@@ -0,0 +1,229 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DIMO-Network/shared/privileges"
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// privilegeTokenRefreshBefore is how long before expiry a token in use is exchanged again in the background
+	privilegeTokenRefreshBefore = time.Minute
+
+	// privilegeTokenMinRemaining is the least lifetime a token must have left to be handed out,
+	// a request shouldn't start with a token that expires halfway through
+	privilegeTokenMinRemaining = 10 * time.Second
+
+	// privilegeTokenIdle drops tokens nobody asked for in this long instead of refreshing them
+	privilegeTokenIdle = 10 * time.Minute
+
+	// privilegeTokenDefaultTTL is used when a token doesn't carry an exp claim
+	privilegeTokenDefaultTTL = 30 * time.Second
+
+	privilegeTokenSweepInterval = 10 * time.Second
+)
+
+// privilegeTokenKey identifies a shared token. The address comes from the session's JWT, which was verified when
+// the session started or linked the wallet.
+type privilegeTokenKey struct {
+	address    string
+	tokenID    int64
+	privileges string
+}
+
+func (k privilegeTokenKey) String() string {
+	return fmt.Sprintf("%s_%d_%s", k.address, k.tokenID, k.privileges)
+}
+
+type managedPrivilegeToken struct {
+	token     string
+	expiresAt time.Time
+	lastUsed  time.Time
+	// accessToken and settings are what the background refresh exchanges with
+	accessToken string
+	settings    *config.Settings
+	required    []privileges.Privilege
+}
+
+// PrivilegeTokenManager shares privilege tokens per (address, vehicle, privilege set) until shortly before they expire,
+// refreshes the ones in use in the background and collapses concurrent exchanges of the same token into one.
+type PrivilegeTokenManager struct {
+	mu     sync.Mutex
+	tokens map[privilegeTokenKey]*managedPrivilegeToken
+	// generations counts the invalidations per address, an exchange started before one doesn't store its token
+	generations map[string]uint64
+	exchanges   singleflight.Group
+}
+
+func NewPrivilegeTokenManager() *PrivilegeTokenManager {
+	return &PrivilegeTokenManager{
+		tokens:      make(map[privilegeTokenKey]*managedPrivilegeToken),
+		generations: make(map[string]uint64),
+	}
+}
+
+// PrivilegeTokens is the token manager every feature gets its privilege tokens from
+var PrivilegeTokens = NewPrivilegeTokenManager()
+
+// Get returns a privilege token on the vehicle for the access token, exchanging one only when there's no shared token
+// with enough lifetime left
+func (m *PrivilegeTokenManager) Get(settings *config.Settings, accessToken string, tokenID int64, required []privileges.Privilege) (string, error) {
+	key, err := newPrivilegeTokenKey(accessToken, tokenID, required)
+	if err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	generation := m.generations[key.address]
+	if managed, ok := m.tokens[key]; ok && now.Add(privilegeTokenMinRemaining).Before(managed.expiresAt) {
+		managed.lastUsed = now
+		token := managed.token
+		m.mu.Unlock()
+		return token, nil
+	}
+	m.mu.Unlock()
+
+	return m.exchange(key, generation, settings, accessToken, required)
+}
+
+// Invalidate drops the token so the next Get exchanges a new one, e.g. after the telemetry API rejected it
+func (m *PrivilegeTokenManager) Invalidate(accessToken string, tokenID int64, required []privileges.Privilege) {
+	key, err := newPrivilegeTokenKey(accessToken, tokenID, required)
+	if err != nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.tokens, key)
+	m.exchanges.Forget(exchangeKey(key, m.generations[key.address]))
+}
+
+// InvalidateAddress drops every token of the address, e.g. when a session signed in with it ends. Exchanges still
+// running for the address don't store their token.
+func (m *PrivilegeTokenManager) InvalidateAddress(ethAddress string) {
+	address := strings.ToLower(ethAddress)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.generations[address]++
+	for key := range m.tokens {
+		if key.address == address {
+			delete(m.tokens, key)
+		}
+	}
+}
+
+// Run refreshes the tokens in use before they expire and drops the idle ones until ctx is done
+func (m *PrivilegeTokenManager) Run(ctx context.Context) {
+	ticker := time.NewTicker(privilegeTokenSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.sweep(time.Now())
+		}
+	}
+}
+
+func (m *PrivilegeTokenManager) sweep(now time.Time) {
+	type refresh struct {
+		key        privilegeTokenKey
+		generation uint64
+		managed    managedPrivilegeToken
+	}
+	refreshes := []refresh{}
+
+	m.mu.Lock()
+	for key, managed := range m.tokens {
+		if now.Sub(managed.lastUsed) > privilegeTokenIdle {
+			delete(m.tokens, key)
+			continue
+		}
+		if now.Add(privilegeTokenRefreshBefore).After(managed.expiresAt) {
+			refreshes = append(refreshes, refresh{key: key, generation: m.generations[key.address], managed: *managed})
+		}
+	}
+	m.mu.Unlock()
+
+	for _, r := range refreshes {
+		if _, err := m.exchange(r.key, r.generation, r.managed.settings, r.managed.accessToken, r.managed.required); err != nil {
+			// the session may have ended, the next request exchanges or fails on its own
+			log.Warn().Err(err).Int64("tokenId", r.key.tokenID).Str("privileges", r.key.privileges).Msg("Failed to refresh privilege token")
+			if now.After(r.managed.expiresAt) {
+				m.mu.Lock()
+				delete(m.tokens, r.key)
+				m.mu.Unlock()
+			}
+		}
+	}
+}
+
+// exchange trades the access token for a new privilege token, concurrent exchanges of the same key share one request.
+// The token is only stored while the address is still at the generation the exchange started with.
+func (m *PrivilegeTokenManager) exchange(key privilegeTokenKey, generation uint64, settings *config.Settings, accessToken string, required []privileges.Privilege) (string, error) {
+	token, err, _ := m.exchanges.Do(exchangeKey(key, generation), func() (any, error) {
+		token, err := ExchangePrivilegeToken(settings, accessToken, key.tokenID, required)
+		if err != nil {
+			return "", err
+		}
+
+		now := time.Now()
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.generations[key.address] != generation {
+			return "", errors.New("the session signed out while the privilege token was exchanged")
+		}
+		lastUsed := now
+		if previous, ok := m.tokens[key]; ok {
+			// a background refresh doesn't count as use
+			lastUsed = previous.lastUsed
+		}
+		m.tokens[key] = &managedPrivilegeToken{
+			token:       token,
+			expiresAt:   privilegeTokenExpiry(token, now),
+			lastUsed:    lastUsed,
+			accessToken: accessToken,
+			settings:    settings,
+			required:    required,
+		}
+		return token, nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token.(string), nil
+}
+
+func newPrivilegeTokenKey(accessToken string, tokenID int64, required []privileges.Privilege) (privilegeTokenKey, error) {
+	ethAddress, err := ExtractEthereumAddressFromToken(accessToken)
+	if err != nil {
+		return privilegeTokenKey{}, err
+	}
+	sorted := slices.Clone(required)
+	slices.Sort(sorted)
+	return privilegeTokenKey{address: strings.ToLower(ethAddress), tokenID: tokenID, privileges: privilegesKey(sorted)}, nil
+}
+
+func exchangeKey(key privilegeTokenKey, generation uint64) string {
+	return fmt.Sprintf("%s_%d", key, generation)
+}
+
+// privilegeTokenExpiry reads the exp claim of the token, the signature is the APIs' business
+func privilegeTokenExpiry(token string, now time.Time) time.Time {
+	if exp, found := jwtExpiry(token); found {
+		return exp
+	}
+	return now.Add(privilegeTokenDefaultTTL)
+}
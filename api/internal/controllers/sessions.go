@@ -0,0 +1,277 @@
+package controllers
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+const (
+	// sessionIdleTimeout is how long a session lasts without activity, every authenticated request extends it
+	sessionIdleTimeout = 2 * time.Hour
+	// sessionMaxLifetime is how long a session lasts after login however active it is, and never past the JWT's exp
+	sessionMaxLifetime = 12 * time.Hour
+
+	sessionCookieName = "session_id"
+)
+
+// Session describes a login for the active sessions page. The JWT stays in CacheInstance under the session ID.
+type Session struct {
+	// ID is the session_id cookie value, never shown on a page
+	ID string
+	// Handle identifies the session on the sessions page and when revoking it
+	Handle    string
+	Address   string
+	UserAgent string
+	IP        string
+	CreatedAt time.Time
+	// AuthenticatedAt is when the wallet last signed a challenge for the session, at login or when renewing it
+	AuthenticatedAt time.Time
+	// ExpiresAt is when the session ends without further activity
+	ExpiresAt time.Time
+	// MaxExpiresAt is when the session ends anyway unless it is renewed with a new challenge
+	MaxExpiresAt time.Time
+	// Linked are the other wallets the session signed in with, see LinkedWallet
+	Linked []LinkedWallet
+}
+
+// SessionStore keeps track of the sessions in CacheInstance so they can be listed and ended
+type SessionStore struct {
+	mu       sync.RWMutex
+	sessions map[string]*Session
+}
+
+var Sessions = NewSessionStore()
+
+func NewSessionStore() *SessionStore {
+	return &SessionStore{sessions: make(map[string]*Session)}
+}
+
+// Start stores the JWT under a new session ID and returns the session, expired JWTs are refused
+func (s *SessionStore) Start(accessToken, userAgent, ip string) (Session, error) {
+	now := time.Now().UTC()
+	session := Session{
+		ID:        uuid.New().String(),
+		Handle:    uuid.New().String(),
+		UserAgent: userAgent,
+		IP:        ip,
+		CreatedAt: now,
+	}
+	if ethAddress, err := ExtractEthereumAddressFromToken(accessToken); err == nil {
+		session.Address = ethAddress
+	}
+	if err := session.authenticate(accessToken, now); err != nil {
+		return Session{}, err
+	}
+
+	CacheInstance.Set(session.ID, accessToken, session.ExpiresAt.Sub(now))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+	s.sessions[session.ID] = &session
+	return session, nil
+}
+
+// Get returns the live session with the ID without extending it
+func (s *SessionStore) Get(id string) (Session, bool) {
+	if _, found := CacheInstance.Get(id); !found {
+		return Session{}, false
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	session, found := s.sessions[id]
+	if !found {
+		return Session{}, false
+	}
+	return *session, true
+}
+
+// Touch extends the session by the idle timeout, up to its maximum expiry. Sessions past it are ended.
+func (s *SessionStore) Touch(id string) (Session, bool) {
+	jwtToken, found := CacheInstance.Get(id)
+	if !found {
+		return Session{}, false
+	}
+
+	now := time.Now().UTC()
+	s.mu.Lock()
+	session, found := s.sessions[id]
+	if !found {
+		s.mu.Unlock()
+		return Session{}, false
+	}
+	if !now.Before(session.MaxExpiresAt) {
+		s.mu.Unlock()
+		s.End(id)
+		return Session{}, false
+	}
+	session.ExpiresAt = minTime(now.Add(sessionIdleTimeout), session.MaxExpiresAt)
+	touched := *session
+	s.mu.Unlock()
+
+	CacheInstance.Set(id, jwtToken, touched.ExpiresAt.Sub(now))
+	return touched, true
+}
+
+// Renew swaps the JWT of the session for one from a new challenge of the same wallet, which restarts its maximum
+// lifetime while keeping the session ID, so the browser's cookie and page stay as they are
+func (s *SessionStore) Renew(id, accessToken string) (Session, error) {
+	if _, found := CacheInstance.Get(id); !found {
+		return Session{}, errors.New("session expired")
+	}
+	ethAddress, err := ExtractEthereumAddressFromToken(accessToken)
+	if err != nil {
+		return Session{}, err
+	}
+
+	now := time.Now().UTC()
+	s.mu.Lock()
+	session, found := s.sessions[id]
+	if !found {
+		s.mu.Unlock()
+		return Session{}, errors.New("session expired")
+	}
+	if !strings.EqualFold(session.Address, ethAddress) {
+		s.mu.Unlock()
+		return Session{}, fmt.Errorf("challenge was signed by %s, not by the wallet of the session", ethAddress)
+	}
+	renewed := *session
+	if err := renewed.authenticate(accessToken, now); err != nil {
+		s.mu.Unlock()
+		return Session{}, err
+	}
+	*session = renewed
+	s.mu.Unlock()
+
+	CacheInstance.Set(id, accessToken, renewed.ExpiresAt.Sub(now))
+	return renewed, nil
+}
+
+// End deletes the session and the privilege tokens of its addresses, and stops the geofence subscriptions and alert
+// rules it created. Unknown IDs are ignored.
+func (s *SessionStore) End(id string) {
+	CacheInstance.Delete(id)
+
+	s.mu.Lock()
+	if session, found := s.sessions[id]; found {
+		session.invalidatePrivilegeTokens()
+	}
+	delete(s.sessions, id)
+	s.mu.Unlock()
+
+	GeofenceSubscriptions.signOut(id, "")
+	AlertRules.signOut(id, "")
+}
+
+// List returns the live sessions of the address, newest first
+func (s *SessionStore) List(ethAddress string) []Session {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.pruneLocked()
+
+	sessions := []Session{}
+	for _, session := range s.sessions {
+		if strings.EqualFold(session.Address, ethAddress) {
+			sessions = append(sessions, *session)
+		}
+	}
+	slices.SortFunc(sessions, func(a, b Session) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+	return sessions
+}
+
+// FindByHandle returns the session of the address with the handle
+func (s *SessionStore) FindByHandle(ethAddress, handle string) (Session, bool) {
+	for _, session := range s.List(ethAddress) {
+		if session.Handle == handle {
+			return session, true
+		}
+	}
+	return Session{}, false
+}
+
+// pruneLocked drops the sessions CacheInstance no longer has, e.g. because they expired, with their privilege tokens
+func (s *SessionStore) pruneLocked() {
+	for id, session := range s.sessions {
+		if _, found := CacheInstance.Get(id); !found {
+			session.invalidatePrivilegeTokens()
+			delete(s.sessions, id)
+		}
+	}
+}
+
+// invalidatePrivilegeTokens drops the privilege tokens of the session's address and its linked wallets
+func (s *Session) invalidatePrivilegeTokens() {
+	PrivilegeTokens.InvalidateAddress(s.Address)
+	for _, wallet := range s.Linked {
+		PrivilegeTokens.InvalidateAddress(wallet.Address)
+	}
+}
+
+// CanExtend tells whether activity still extends the session, or it needs a new challenge to last longer
+func (s Session) CanExtend() bool {
+	return s.ExpiresAt.Before(s.MaxExpiresAt)
+}
+
+// authenticate restarts the lifetime of the session for a JWT the wallet just obtained
+func (s *Session) authenticate(accessToken string, now time.Time) error {
+	maxExpiresAt := now.Add(sessionMaxLifetime)
+	if exp, found := jwtExpiry(accessToken); found {
+		maxExpiresAt = minTime(maxExpiresAt, exp)
+	}
+	if !now.Before(maxExpiresAt) {
+		return errors.New("token has expired")
+	}
+
+	s.AuthenticatedAt = now
+	s.MaxExpiresAt = maxExpiresAt
+	s.ExpiresAt = minTime(now.Add(sessionIdleTimeout), maxExpiresAt)
+	return nil
+}
+
+func minTime(a, b time.Time) time.Time {
+	if a.Before(b) {
+		return a
+	}
+	return b
+}
+
+// setSessionCookie issues the session cookie from the server so scripts never handle it: HTTP only, Secure unless
+// SESSION_COOKIE_INSECURE is set, and SameSite=Lax so links into the app keep the session while cross-site posts don't.
+// It lives until the maximum expiry, the idle timeout is enforced by the server.
+func setSessionCookie(c *fiber.Ctx, settings *config.Settings, session Session) {
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookieName,
+		Value:    session.ID,
+		Path:     "/",
+		Domain:   settings.SessionCookieDomain,
+		Expires:  session.MaxExpiresAt,
+		Secure:   !settings.SessionCookieInsecure,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+// clearSessionCookie expires the session cookie, it has to match the domain and path it was issued for
+func clearSessionCookie(c *fiber.Ctx, settings *config.Settings) {
+	c.Cookie(&fiber.Cookie{
+		Name:     sessionCookieName,
+		Value:    "",
+		Path:     "/",
+		Domain:   settings.SessionCookieDomain,
+		Expires:  time.Unix(0, 0),
+		Secure:   !settings.SessionCookieInsecure,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
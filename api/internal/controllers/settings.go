@@ -37,8 +37,12 @@ func (v *SettingsController) GetSettings(c *fiber.Ctx) error {
 
 func (v *SettingsController) GetPublicSettings(c *fiber.Ctx) error {
 	payload := PublicSettingsResponse{
-		ClientID: v.settings.ClientID,
-		LoginURL: v.settings.LoginURL.String(),
+		ClientID:     v.settings.ClientID,
+		LoginURL:     v.settings.LoginURL.String(),
+		AuthProvider: v.settings.AuthProvider,
+	}
+	if payload.AuthProvider == "" {
+		payload.AuthProvider = "dimo"
 	}
 	return c.JSON(payload)
 }
@@ -50,4 +54,6 @@ type SettingsResponse struct {
 type PublicSettingsResponse struct {
 	ClientID string `json:"clientId"`
 	LoginURL string `json:"loginUrl"`
+	// AuthProvider is "local" when the login page signs in with the browser wallet instead of DIMO's login
+	AuthProvider string `json:"authProvider"`
 }
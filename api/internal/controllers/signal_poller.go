@@ -0,0 +1,283 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// signalSubscriberBuffer is how many updates a slow browser may lag behind before it is resynced with a snapshot
+	signalSubscriberBuffer = 16
+
+	SignalUpdateSnapshot = "snapshot"
+	SignalUpdateChanges  = "update"
+	SignalUpdateError    = "error"
+)
+
+// SignalUpdate is sent to live signal viewers: a snapshot with every signal when they connect, then only the signals that changed
+type SignalUpdate struct {
+	Type    string        `json:"type"`
+	Signals []SignalEntry `json:"signals,omitempty"`
+	Error   string        `json:"error,omitempty"`
+}
+
+// SignalPoller polls signalsLatest once per vehicle, no matter how many viewers it has, and fans the changes out.
+// The poll starts with the first viewer and stops after the last one leaves.
+type SignalPoller struct {
+	settings *config.Settings
+	logger   *zerolog.Logger
+	interval time.Duration
+
+	mu    sync.Mutex
+	polls map[int64]*signalPoll
+}
+
+type signalPoll struct {
+	cancel      context.CancelFunc
+	subscribers map[chan SignalUpdate]*signalSubscriber
+	latest      map[string]SignalEntry
+}
+
+type signalSubscriber struct {
+	// accessToken is the viewer's session JWT, any authorized viewer's token can be used to poll
+	accessToken string
+	// authorized is whether a privilege token could be exchanged with accessToken at the last poll, only authorized
+	// viewers get signals
+	authorized bool
+	// synced is false until the viewer got a snapshot, and again after an update was dropped for it
+	synced bool
+}
+
+func NewSignalPoller(settings *config.Settings, logger *zerolog.Logger) *SignalPoller {
+	interval := time.Duration(settings.SignalsPollIntervalSeconds) * time.Second
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	return &SignalPoller{
+		settings: settings,
+		logger:   logger,
+		interval: interval,
+		polls:    make(map[int64]*signalPoll),
+	}
+}
+
+// Subscribe returns the vehicle's signal updates and a func to stop receiving them, which must be called. The viewer
+// joins only if its own access token can be exchanged for a privilege token on the vehicle's signals.
+func (p *SignalPoller) Subscribe(tokenID int64, accessToken string) (<-chan SignalUpdate, func(), error) {
+	if _, err := PrivilegeTokens.Get(p.settings, accessToken, tokenID, SignalsPrivileges); err != nil {
+		return nil, nil, err
+	}
+	updates := make(chan SignalUpdate, signalSubscriberBuffer)
+
+	p.mu.Lock()
+	poll, ok := p.polls[tokenID]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		poll = &signalPoll{cancel: cancel, subscribers: make(map[chan SignalUpdate]*signalSubscriber)}
+		p.polls[tokenID] = poll
+		go p.run(ctx, tokenID, poll)
+	}
+	subscriber := &signalSubscriber{accessToken: accessToken, authorized: true}
+	poll.subscribers[updates] = subscriber
+	// later viewers don't wait for the next poll
+	if poll.latest != nil {
+		updates <- SignalUpdate{Type: SignalUpdateSnapshot, Signals: sortedSignals(poll.latest)}
+		subscriber.synced = true
+	}
+	p.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			delete(poll.subscribers, updates)
+			close(updates)
+			if len(poll.subscribers) == 0 {
+				poll.cancel()
+				delete(p.polls, tokenID)
+			}
+		})
+	}
+
+	return updates, unsubscribe, nil
+}
+
+// Viewers returns how many viewers the vehicle's signals have
+func (p *SignalPoller) Viewers(tokenID int64) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if poll, ok := p.polls[tokenID]; ok {
+		return len(poll.subscribers)
+	}
+	return 0
+}
+
+func (p *SignalPoller) run(ctx context.Context, tokenID int64, poll *signalPoll) {
+	p.logger.Info().Int64("tokenId", tokenID).Msg("Started polling live signals")
+	defer p.logger.Info().Int64("tokenId", tokenID).Msg("Stopped polling live signals")
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	var signalNames []string
+
+	for {
+		accessToken, privilegeToken, err := p.authorize(tokenID, poll)
+		if err != nil {
+			p.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Failed to get privilege token for live signals")
+			_, message := privilegeErrorStatus(err, 0, "Failed to get access to the vehicle")
+			p.broadcastError(poll, message)
+		} else if err := p.poll(tokenID, poll, privilegeToken, &signalNames); err != nil {
+			p.logger.Error().Err(err).Int64("tokenId", tokenID).Msg("Failed to poll live signals")
+			p.broadcastError(poll, "Failed to fetch latest signal values")
+			// the token may have been revoked, exchange a new one next time
+			PrivilegeTokens.Invalidate(accessToken, tokenID, SignalsPrivileges)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *SignalPoller) poll(tokenID int64, poll *signalPoll, privilegeToken string, signalNames *[]string) error {
+	if *signalNames == nil {
+		names, err := queryAvailableSignals(p.settings, tokenID, privilegeToken)
+		if err != nil {
+			return err
+		}
+		*signalNames = names
+	}
+	if len(*signalNames) == 0 {
+		return nil
+	}
+
+	entries, err := queryLatestSignalValues(p.settings, tokenID, *signalNames, privilegeToken)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	changed := SignalEntries{}
+	latest := make(map[string]SignalEntry, len(entries))
+	for _, entry := range entries {
+		latest[entry.SignalName] = entry
+		previous, ok := poll.latest[entry.SignalName]
+		if !ok || previous.Timestamp != entry.Timestamp || !reflect.DeepEqual(previous.Value, entry.Value) {
+			changed = append(changed, entry)
+		}
+	}
+	poll.latest = latest
+	sort.Slice(changed, func(i, j int) bool {
+		return changed[i].SignalName < changed[j].SignalName
+	})
+
+	for updates, subscriber := range poll.subscribers {
+		if !subscriber.authorized {
+			continue
+		}
+		update := SignalUpdate{Type: SignalUpdateChanges, Signals: changed}
+		if !subscriber.synced {
+			update = SignalUpdate{Type: SignalUpdateSnapshot, Signals: sortedSignals(latest)}
+		} else if len(changed) == 0 {
+			continue
+		}
+
+		select {
+		case updates <- update:
+			subscriber.synced = true
+		default:
+			// the browser can't keep up, it missed changes so resync it with the next snapshot
+			subscriber.synced = false
+		}
+	}
+	return nil
+}
+
+// authorize exchanges a privilege token with the access token of every viewer, so each one's own rights are checked
+// on every poll. Viewers whose rights were revoked get an error instead of signals. It returns an authorized viewer's
+// access token and privilege token to poll with.
+func (p *SignalPoller) authorize(tokenID int64, poll *signalPoll) (string, string, error) {
+	p.mu.Lock()
+	subscribers := make(map[chan SignalUpdate]*signalSubscriber, len(poll.subscribers))
+	for updates, subscriber := range poll.subscribers {
+		subscribers[updates] = subscriber
+	}
+	p.mu.Unlock()
+
+	var accessToken, privilegeToken string
+	var lastErr error
+	authorized := make(map[*signalSubscriber]bool, len(subscribers))
+	for _, subscriber := range subscribers {
+		token, err := PrivilegeTokens.Get(p.settings, subscriber.accessToken, tokenID, SignalsPrivileges)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		authorized[subscriber] = true
+		if privilegeToken == "" {
+			accessToken, privilegeToken = subscriber.accessToken, token
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// viewers may have left meanwhile, their channels are closed, and the ones who joined were checked by Subscribe
+	for updates, subscriber := range poll.subscribers {
+		if _, checked := subscribers[updates]; !checked {
+			continue
+		}
+		if subscriber.authorized && !authorized[subscriber] {
+			select {
+			case updates <- SignalUpdate{Type: SignalUpdateError, Error: "Your access to the vehicle's signals has ended"}:
+			default:
+			}
+		}
+		subscriber.authorized = authorized[subscriber]
+		if !subscriber.authorized {
+			// resynced with a snapshot if access comes back
+			subscriber.synced = false
+		}
+	}
+	if privilegeToken == "" {
+		if lastErr == nil {
+			lastErr = errors.New("no viewers")
+		}
+		return "", "", lastErr
+	}
+	return accessToken, privilegeToken, nil
+}
+
+func (p *SignalPoller) broadcastError(poll *signalPoll, message string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for updates := range poll.subscribers {
+		select {
+		case updates <- SignalUpdate{Type: SignalUpdateError, Error: message}:
+		default:
+		}
+	}
+}
+
+func sortedSignals(signals map[string]SignalEntry) SignalEntries {
+	entries := make(SignalEntries, 0, len(signals))
+	for _, entry := range signals {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].SignalName < entries[j].SignalName
+	})
+	return entries
+}
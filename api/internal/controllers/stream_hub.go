@@ -0,0 +1,139 @@
+package controllers
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+const (
+	// streamSubscriberBuffer is how many messages a slow browser may lag behind before messages are dropped for it
+	streamSubscriberBuffer = 64
+
+	maxStreamReconnectDelay = 30 * time.Second
+)
+
+// StreamHub keeps a single upstream subscription per stream and fans its messages out to every subscriber.
+// The upstream subscription is opened with the first subscriber and closed after the last one leaves.
+type StreamHub struct {
+	source StreamSource
+	logger *zerolog.Logger
+
+	mu      sync.Mutex
+	streams map[string]*hubStream
+}
+
+type hubStream struct {
+	cancel      context.CancelFunc
+	subscribers map[chan StreamMessage]struct{}
+}
+
+func NewStreamHub(source StreamSource, logger *zerolog.Logger) *StreamHub {
+	return &StreamHub{
+		source:  source,
+		logger:  logger,
+		streams: make(map[string]*hubStream),
+	}
+}
+
+// Subscribe returns the messages of the stream and a func to stop receiving them, which must be called
+func (h *StreamHub) Subscribe(streamID string) (<-chan StreamMessage, func()) {
+	messages := make(chan StreamMessage, streamSubscriberBuffer)
+
+	h.mu.Lock()
+	stream, ok := h.streams[streamID]
+	if !ok {
+		ctx, cancel := context.WithCancel(context.Background())
+		stream = &hubStream{cancel: cancel, subscribers: make(map[chan StreamMessage]struct{})}
+		h.streams[streamID] = stream
+		go h.run(ctx, streamID, stream)
+	}
+	stream.subscribers[messages] = struct{}{}
+	h.mu.Unlock()
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			h.mu.Lock()
+			defer h.mu.Unlock()
+			// Close may have beaten us to it
+			if _, ok := stream.subscribers[messages]; !ok {
+				return
+			}
+			delete(stream.subscribers, messages)
+			close(messages)
+			if len(stream.subscribers) == 0 {
+				stream.cancel()
+				delete(h.streams, streamID)
+			}
+		})
+	}
+
+	return messages, unsubscribe
+}
+
+// Close ends every subscription, so open SSE responses finish and the server can shut down
+func (h *StreamHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for streamID, stream := range h.streams {
+		stream.cancel()
+		for subscriber := range stream.subscribers {
+			delete(stream.subscribers, subscriber)
+			close(subscriber)
+		}
+		delete(h.streams, streamID)
+	}
+}
+
+// Subscribers returns how many subscribers the stream has
+func (h *StreamHub) Subscribers(streamID string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if stream, ok := h.streams[streamID]; ok {
+		return len(stream.subscribers)
+	}
+	return 0
+}
+
+// run keeps the upstream subscription alive, reconnecting with backoff, until the last subscriber leaves
+func (h *StreamHub) run(ctx context.Context, streamID string, stream *hubStream) {
+	h.logger.Info().Str("stream", streamID).Str("source", h.source.Name()).Msg("Opening upstream stream subscription")
+	defer h.logger.Info().Str("stream", streamID).Msg("Closed upstream stream subscription")
+
+	delay := time.Second
+	for {
+		upstream, err := h.source.Subscribe(ctx, streamID)
+		if err != nil {
+			h.logger.Warn().Err(err).Str("stream", streamID).Dur("retryIn", delay).Msg("Failed to subscribe to stream")
+		} else {
+			delay = time.Second
+			for message := range upstream {
+				h.broadcast(stream, message)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, maxStreamReconnectDelay)
+	}
+}
+
+// broadcast sends to the subscribers of this stream instance, which has none left once it has been closed
+func (h *StreamHub) broadcast(stream *hubStream, message StreamMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for subscriber := range stream.subscribers {
+		select {
+		case subscriber <- message:
+		default:
+			// the browser can't keep up, drop rather than stall everyone else
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package controllers
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+const (
+	// recordings stop on their own so a forgotten one doesn't fill the disk
+	maxStreamRecordingDuration = time.Hour
+	maxStreamRecordingMessages = 100000
+
+	// maxReplayGap shortens long silences in a recording, eg. while the vehicle was parked
+	maxReplayGap = 10 * time.Second
+)
+
+// ReplaySpeeds are the supported replay multipliers
+var ReplaySpeeds = []int{1, 5, 20}
+
+var ErrRecordingInProgress = fmt.Errorf("a recording of this vehicle is already in progress")
+
+// StreamRecording describes a recorded session of a vehicle stream. The messages are kept next to it as NDJSON.
+type StreamRecording struct {
+	ID        string     `json:"id"`
+	Owner     string     `json:"owner"`
+	TokenID   int64      `json:"tokenId"`
+	StreamID  string     `json:"streamId"`
+	StartedAt time.Time  `json:"startedAt"`
+	StoppedAt *time.Time `json:"stoppedAt,omitempty"`
+	Messages  int        `json:"messages"`
+}
+
+func (r StreamRecording) Active() bool {
+	return r.StoppedAt == nil
+}
+
+// RecordedStreamMessage is one NDJSON line: the message as published plus when we received it, which drives replay timing
+type RecordedStreamMessage struct {
+	ReceivedAt time.Time `json:"receivedAt"`
+	StreamMessage
+}
+
+// StreamRecorder records hub streams to files in dir, a <id>.json with the metadata and a <id>.ndjson with the messages
+type StreamRecorder struct {
+	dir    string
+	hub    *StreamHub
+	logger *zerolog.Logger
+
+	mu         sync.Mutex
+	recordings map[string]*StreamRecording
+	stops      map[string]func()
+}
+
+// NewStreamRecorder loads the recordings already in dir. Recordings interrupted by a restart are marked as stopped.
+func NewStreamRecorder(dir string, hub *StreamHub, logger *zerolog.Logger) (*StreamRecorder, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("error creating recordings directory: %w", err)
+	}
+
+	recorder := &StreamRecorder{
+		dir:        dir,
+		hub:        hub,
+		logger:     logger,
+		recordings: make(map[string]*StreamRecording),
+		stops:      make(map[string]func()),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading recording %s: %w", path, err)
+		}
+		var recording StreamRecording
+		if err := json.Unmarshal(data, &recording); err != nil {
+			logger.Warn().Err(err).Str("path", path).Msg("Skipping unreadable stream recording")
+			continue
+		}
+		if recording.Active() {
+			stoppedAt := recording.StartedAt
+			if info, err := os.Stat(recorder.messagesPath(recording.ID)); err == nil {
+				stoppedAt = info.ModTime().UTC()
+			}
+			recording.StoppedAt = &stoppedAt
+			if err := recorder.saveMetadata(recording); err != nil {
+				return nil, err
+			}
+		}
+		recorder.recordings[recording.ID] = &recording
+	}
+
+	return recorder, nil
+}
+
+func (r *StreamRecorder) metadataPath(id string) string {
+	return filepath.Join(r.dir, id+".json")
+}
+
+func (r *StreamRecorder) messagesPath(id string) string {
+	return filepath.Join(r.dir, id+".ndjson")
+}
+
+func (r *StreamRecorder) saveMetadata(recording StreamRecording) error {
+	data, err := json.MarshalIndent(recording, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(r.metadataPath(recording.ID), data, 0o644)
+}
+
+// Start records the vehicle's stream until Stop, or until the duration or message limit is reached
+func (r *StreamRecorder) Start(owner string, tokenID int64) (StreamRecording, error) {
+	owner = strings.ToLower(owner)
+
+	r.mu.Lock()
+	for _, recording := range r.recordings {
+		if recording.Owner == owner && recording.TokenID == tokenID && recording.Active() {
+			r.mu.Unlock()
+			return StreamRecording{}, ErrRecordingInProgress
+		}
+	}
+
+	recording := &StreamRecording{
+		ID:        uuid.New().String(),
+		Owner:     owner,
+		TokenID:   tokenID,
+		StreamID:  VehicleStreamID(tokenID),
+		StartedAt: time.Now().UTC(),
+	}
+	file, err := os.Create(r.messagesPath(recording.ID))
+	if err != nil {
+		r.mu.Unlock()
+		return StreamRecording{}, fmt.Errorf("error creating recording file: %w", err)
+	}
+	if err := r.saveMetadata(*recording); err != nil {
+		r.mu.Unlock()
+		file.Close()
+		return StreamRecording{}, err
+	}
+
+	messages, unsubscribe := r.hub.Subscribe(recording.StreamID)
+	r.recordings[recording.ID] = recording
+	r.stops[recording.ID] = unsubscribe
+	snapshot := *recording
+	r.mu.Unlock()
+
+	r.logger.Info().Str("recordingId", recording.ID).Int64("tokenId", tokenID).Msg("Started stream recording")
+	go r.record(recording.ID, file, messages, unsubscribe)
+
+	return snapshot, nil
+}
+
+func (r *StreamRecorder) record(id string, file *os.File, messages <-chan StreamMessage, unsubscribe func()) {
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	deadline := time.NewTimer(maxStreamRecordingDuration)
+	defer deadline.Stop()
+
+	count := 0
+loop:
+	for {
+		select {
+		case message, ok := <-messages:
+			if !ok {
+				break loop
+			}
+			if err := encoder.Encode(RecordedStreamMessage{ReceivedAt: time.Now().UTC(), StreamMessage: message}); err != nil {
+				r.logger.Error().Err(err).Str("recordingId", id).Msg("Failed to write stream recording")
+				break loop
+			}
+			count++
+
+			r.mu.Lock()
+			r.recordings[id].Messages = count
+			r.mu.Unlock()
+
+			if count >= maxStreamRecordingMessages {
+				break loop
+			}
+		case <-deadline.C:
+			break loop
+		}
+	}
+
+	// no-op when Stop already unsubscribed
+	unsubscribe()
+
+	if err := writer.Flush(); err != nil {
+		r.logger.Error().Err(err).Str("recordingId", id).Msg("Failed to flush stream recording")
+	}
+	file.Close()
+
+	stoppedAt := time.Now().UTC()
+	r.mu.Lock()
+	recording := r.recordings[id]
+	recording.StoppedAt = &stoppedAt
+	delete(r.stops, id)
+	snapshot := *recording
+	r.mu.Unlock()
+
+	if err := r.saveMetadata(snapshot); err != nil {
+		r.logger.Error().Err(err).Str("recordingId", id).Msg("Failed to save stream recording")
+	}
+	r.logger.Info().Str("recordingId", id).Int("messages", count).Msg("Stopped stream recording")
+}
+
+// Stop ends the owner's recording. The file is finalized asynchronously.
+func (r *StreamRecorder) Stop(owner, id string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	recording, ok := r.recordings[id]
+	if !ok || recording.Owner != strings.ToLower(owner) {
+		return false
+	}
+	if stop, ok := r.stops[id]; ok {
+		// closes the subscription channel, which ends record()
+		stop()
+	}
+	return true
+}
+
+// Get returns the owner's recording
+func (r *StreamRecorder) Get(owner, id string) (StreamRecording, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	recording, ok := r.recordings[id]
+	if !ok || recording.Owner != strings.ToLower(owner) {
+		return StreamRecording{}, false
+	}
+	return *recording, true
+}
+
+// List returns the owner's recordings of the vehicle, newest first. A tokenID of 0 returns all vehicles.
+func (r *StreamRecorder) List(owner string, tokenID int64) []StreamRecording {
+	owner = strings.ToLower(owner)
+
+	r.mu.Lock()
+	recordings := make([]StreamRecording, 0)
+	for _, recording := range r.recordings {
+		if recording.Owner == owner && (tokenID == 0 || recording.TokenID == tokenID) {
+			recordings = append(recordings, *recording)
+		}
+	}
+	r.mu.Unlock()
+
+	sort.Slice(recordings, func(i, j int) bool {
+		return recordings[i].StartedAt.After(recordings[j].StartedAt)
+	})
+	return recordings
+}
+
+// Delete removes a stopped recording and its files
+func (r *StreamRecorder) Delete(owner, id string) error {
+	r.mu.Lock()
+	recording, ok := r.recordings[id]
+	if !ok || recording.Owner != strings.ToLower(owner) {
+		r.mu.Unlock()
+		return os.ErrNotExist
+	}
+	if recording.Active() {
+		r.mu.Unlock()
+		return ErrRecordingInProgress
+	}
+	delete(r.recordings, id)
+	r.mu.Unlock()
+
+	if err := os.Remove(r.messagesPath(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Remove(r.metadataPath(id))
+}
+
+// MessagesPath is the NDJSON file of the recording, for exporting it as is
+func (r *StreamRecorder) MessagesPath(recording StreamRecording) string {
+	return r.messagesPath(recording.ID)
+}
+
+// Replay plays the recording back with its original timing divided by speed. The channel is closed at the end or when ctx is done.
+func (r *StreamRecorder) Replay(ctx context.Context, recording StreamRecording, speed int) (<-chan StreamMessage, error) {
+	file, err := os.Open(r.messagesPath(recording.ID))
+	if err != nil {
+		return nil, fmt.Errorf("error opening recording: %w", err)
+	}
+
+	messages := make(chan StreamMessage)
+	go func() {
+		defer close(messages)
+		defer file.Close()
+
+		scanner := bufio.NewScanner(file)
+		scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+
+		var previous time.Time
+		for scanner.Scan() {
+			var recorded RecordedStreamMessage
+			if err := json.Unmarshal(scanner.Bytes(), &recorded); err != nil {
+				r.logger.Warn().Err(err).Str("recordingId", recording.ID).Msg("Skipping unreadable recorded message")
+				continue
+			}
+
+			if !previous.IsZero() {
+				gap := min(recorded.ReceivedAt.Sub(previous), maxReplayGap)
+				if gap > 0 {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(gap / time.Duration(speed)):
+					}
+				}
+			}
+			previous = recorded.ReceivedAt
+
+			select {
+			case messages <- recorded.StreamMessage:
+			case <-ctx.Done():
+				return
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			r.logger.Error().Err(err).Str("recordingId", recording.ID).Msg("Failed to read recording")
+		}
+	}()
+
+	return messages, nil
+}
@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"github.com/fasthttp/websocket"
+)
+
+// StreamMessage is one message published on a stream, in the shape DIMO publishes vehicle data to Streamr
+type StreamMessage struct {
+	Time   string          `json:"time"`
+	Type   string          `json:"type"`
+	Source string          `json:"source"`
+	Data   json.RawMessage `json:"data"`
+}
+
+// StreamSource subscribes to a stream. The channel is closed when ctx is cancelled or the upstream connection is lost.
+type StreamSource interface {
+	Name() string
+	Subscribe(ctx context.Context, streamID string) (<-chan StreamMessage, error)
+}
+
+// VehicleStreamID is the Streamr stream DIMO publishes the vehicle's data to
+func VehicleStreamID(tokenID int64) string {
+	return fmt.Sprintf("streams.dimo.eth/vehicles/%d", tokenID)
+}
+
+// NewStreamSource picks the source from STREAM_SOURCE, either "streamr" (default) or "fake"
+func NewStreamSource(settings *config.Settings) (StreamSource, error) {
+	switch settings.StreamSource {
+	case "fake":
+		return NewFakeStreamSource(time.Second), nil
+	case "", "streamr":
+		if settings.StreamrBrokerURL == "" {
+			return nil, fmt.Errorf("STREAMR_BROKER_URL is required for the streamr stream source")
+		}
+		return NewStreamrBrokerSource(settings.StreamrBrokerURL, settings.StreamrAPIKey), nil
+	default:
+		return nil, fmt.Errorf("unknown STREAM_SOURCE: %s", settings.StreamSource)
+	}
+}
+
+// StreamrBrokerSource subscribes through the websocket plugin of a Streamr broker node.
+// The broker's own address needs subscribe permission on the vehicle streams, browsers no longer need a wallet.
+type StreamrBrokerSource struct {
+	brokerURL string
+	apiKey    string
+	dialer    *websocket.Dialer
+}
+
+func NewStreamrBrokerSource(brokerURL, apiKey string) *StreamrBrokerSource {
+	return &StreamrBrokerSource{
+		brokerURL: strings.TrimSuffix(brokerURL, "/"),
+		apiKey:    apiKey,
+		dialer:    &websocket.Dialer{HandshakeTimeout: 10 * time.Second},
+	}
+}
+
+func (s *StreamrBrokerSource) Name() string {
+	return "streamr"
+}
+
+func (s *StreamrBrokerSource) Subscribe(ctx context.Context, streamID string) (<-chan StreamMessage, error) {
+	subscribeURL := fmt.Sprintf("%s/streams/%s/subscribe", s.brokerURL, url.PathEscape(streamID))
+	if s.apiKey != "" {
+		subscribeURL += "?apiKey=" + url.QueryEscape(s.apiKey)
+	}
+
+	conn, _, err := s.dialer.DialContext(ctx, subscribeURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to streamr broker: %w", err)
+	}
+
+	messages := make(chan StreamMessage, 16)
+
+	// unblock ReadMessage when the subscriber goes away
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	go func() {
+		defer close(messages)
+		defer conn.Close()
+		for {
+			_, payload, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var message StreamMessage
+			if err := json.Unmarshal(payload, &message); err != nil || message.Data == nil {
+				// not in the usual envelope, pass it through as data
+				message = StreamMessage{Time: time.Now().UTC().Format(time.RFC3339), Source: streamID, Data: payload}
+			}
+
+			select {
+			case messages <- message:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return messages, nil
+}
+
+// FakeStreamSource publishes a vehicle driving around, for working on the live page without Streamr
+type FakeStreamSource struct {
+	interval time.Duration
+}
+
+func NewFakeStreamSource(interval time.Duration) *FakeStreamSource {
+	return &FakeStreamSource{interval: interval}
+}
+
+func (f *FakeStreamSource) Name() string {
+	return "fake"
+}
+
+func (f *FakeStreamSource) Subscribe(ctx context.Context, streamID string) (<-chan StreamMessage, error) {
+	messages := make(chan StreamMessage, 16)
+
+	go func() {
+		defer close(messages)
+
+		ticker := time.NewTicker(f.interval)
+		defer ticker.Stop()
+
+		heading := rand.Float64() * 2 * math.Pi
+		location := LatLon{Latitude: 52.52437, Longitude: 13.41053}
+		odometer := 10000 + rand.Float64()*50000
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				speed := 30 + 20*math.Sin(float64(now.Unix())/30)
+				heading += (rand.Float64() - 0.5) / 5
+				distanceKm := speed * f.interval.Hours()
+				location.Latitude += distanceKm / 111.32 * math.Cos(heading)
+				location.Longitude += distanceKm / (111.32 * math.Cos(location.Latitude*math.Pi/180)) * math.Sin(heading)
+				odometer += distanceKm
+
+				data, _ := json.Marshal(map[string]any{
+					"speed":                    math.Round(speed*10) / 10,
+					"currentLocationLatitude":  location.Latitude,
+					"currentLocationLongitude": location.Longitude,
+					"powertrainTransmissionTravelledDistance": math.Round(odometer*10) / 10,
+					"lowVoltageBatteryCurrentVoltage":         12.4 + rand.Float64()/2,
+				})
+
+				message := StreamMessage{
+					Time:   now.UTC().Format(time.RFC3339),
+					Type:   "com.dimo.device.status",
+					Source: "fake/" + streamID,
+					Data:   data,
+				}
+				select {
+				case messages <- message:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+
+	return messages, nil
+}
@@ -0,0 +1,169 @@
+package controllers
+
+import (
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/DIMO-Network/shared/privileges"
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+)
+
+// privilegeExpiringSoon flags grants that run out within this window on the vehicles and account pages
+const privilegeExpiringSoon = 7 * 24 * time.Hour
+
+// HeldPrivilege is a privilege the session address holds on a shared vehicle
+type HeldPrivilege struct {
+	ID   privileges.Privilege
+	Name string
+	// ExpiresAt is RFC3339 for timeago.js
+	ExpiresAt    string
+	ExpiringSoon bool
+	// Page is the vehicle page the privilege opens, e.g. "credentials", empty if it has none of its own
+	Page string
+}
+
+// privilegePages are the vehicle pages that exist for one privilege alone, linked from the account page
+var privilegePages = map[privileges.Privilege]string{
+	privileges.VehicleCommands:      "commands",
+	privileges.VehicleVinCredential: "credentials",
+}
+
+// VehicleAccess tells the pages which features of a vehicle the session address can use
+type VehicleAccess struct {
+	Owner bool
+	// Privileges held on a shared vehicle, empty for owners who hold them all
+	Privileges   []HeldPrivilege
+	Signals      bool
+	Trips        bool
+	LiveLocation bool
+	Streams      bool
+	Commands     bool
+	Credentials  bool
+}
+
+// ActivePrivileges returns the privileges the session address holds on the vehicle at now, with the latest expiry of each.
+// Owners hold every privilege.
+func (v Vehicle) ActivePrivileges(now time.Time) map[privileges.Privilege]time.Time {
+	active := map[privileges.Privilege]time.Time{}
+	if !v.Shared {
+		for privilege := range VehiclePrivilegeNames {
+			active[privilege] = time.Time{}
+		}
+		return active
+	}
+	for _, grant := range v.Privileges.Nodes {
+		if !grant.ExpiresAt.After(now) {
+			continue
+		}
+		privilege := privileges.Privilege(grant.ID)
+		if grant.ExpiresAt.After(active[privilege]) {
+			active[privilege] = grant.ExpiresAt
+		}
+	}
+	return active
+}
+
+// MissingPrivileges returns the required privileges the session address doesn't hold on the vehicle
+func (v Vehicle) MissingPrivileges(required []privileges.Privilege, now time.Time) []privileges.Privilege {
+	active := v.ActivePrivileges(now)
+	missing := []privileges.Privilege{}
+	for _, privilege := range required {
+		if _, ok := active[privilege]; !ok {
+			missing = append(missing, privilege)
+		}
+	}
+	return missing
+}
+
+// NewVehicleAccess works out the features the session address can use on the vehicle
+func NewVehicleAccess(v Vehicle, now time.Time) *VehicleAccess {
+	can := func(required []privileges.Privilege) bool {
+		return len(v.MissingPrivileges(required, now)) == 0
+	}
+	access := &VehicleAccess{
+		Owner:        !v.Shared,
+		Privileges:   []HeldPrivilege{},
+		Signals:      can(SignalsPrivileges),
+		Trips:        can(TripsPrivileges),
+		LiveLocation: can(LiveLocationPrivileges),
+		Streams:      can(StreamsPrivileges),
+		Commands:     can(CommandsPrivileges),
+		Credentials:  can(CredentialsPrivileges),
+	}
+	if !v.Shared {
+		return access
+	}
+
+	for privilege, expiresAt := range v.ActivePrivileges(now) {
+		name, ok := VehiclePrivilegeNames[privilege]
+		if !ok {
+			name = PrivilegeNames([]privileges.Privilege{privilege})
+		}
+		access.Privileges = append(access.Privileges, HeldPrivilege{
+			ID:           privilege,
+			Name:         name,
+			ExpiresAt:    expiresAt.Format(time.RFC3339),
+			ExpiringSoon: expiresAt.Sub(now) < privilegeExpiringSoon,
+			Page:         privilegePages[privilege],
+		})
+	}
+	slices.SortFunc(access.Privileges, func(a, b HeldPrivilege) int {
+		return int(a.ID - b.ID)
+	})
+	return access
+}
+
+// PrivilegeIDs lists the held privileges as "1,4", for the account page to preselect them
+func (a *VehicleAccess) PrivilegeIDs() string {
+	if a.Owner {
+		return privilegesKey(SortedVehiclePrivileges())
+	}
+	ids := make([]privileges.Privilege, 0, len(a.Privileges))
+	for _, privilege := range a.Privileges {
+		ids = append(ids, privilege.ID)
+	}
+	return privilegesKey(ids)
+}
+
+// SortedVehiclePrivileges returns every vehicle privilege by ID
+func SortedVehiclePrivileges() []privileges.Privilege {
+	all := make([]privileges.Privilege, 0, len(VehiclePrivilegeNames))
+	for privilege := range VehiclePrivilegeNames {
+		all = append(all, privilege)
+	}
+	slices.Sort(all)
+	return all
+}
+
+// FindVehicleWithPrivileges returns the vehicle if the addresses hold the required privileges on it, a MissingPrivilegesError
+// if it's shared without them and nil if the addresses can't see the vehicle at all
+func FindVehicleWithPrivileges(ethAddresses []string, tokenID int64, required []privileges.Privilege, settings *config.Settings) (*Vehicle, error) {
+	vehicle, _, err := FindAccessibleVehicle(ethAddresses, tokenID, settings)
+	if err != nil || vehicle == nil {
+		return nil, err
+	}
+	if missing := vehicle.MissingPrivileges(required, time.Now()); len(missing) > 0 {
+		return nil, &MissingPrivilegesError{TokenID: tokenID, Missing: missing}
+	}
+	return vehicle, nil
+}
+
+// attachAccess sets the access of each vehicle for the pages
+func attachAccess(vehicles []Vehicle, now time.Time) {
+	for i := range vehicles {
+		vehicles[i].Access = NewVehicleAccess(vehicles[i], now)
+	}
+}
+
+// privilegeSummary lists the held privileges by name, e.g. "Non-location data, Live data"
+func privilegeSummary(access *VehicleAccess) string {
+	if access.Owner {
+		return "Owner, all privileges"
+	}
+	names := make([]string, 0, len(access.Privileges))
+	for _, privilege := range access.Privileges {
+		names = append(names, privilege.Name)
+	}
+	return strings.Join(names, ", ")
+}
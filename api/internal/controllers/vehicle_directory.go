@@ -0,0 +1,191 @@
+package controllers
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dimo-network/trips-web-app/api/internal/config"
+	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
+)
+
+// vehicleDirectoryTTL is how long the vehicles of an address are served from memory before the identity API is asked again
+const vehicleDirectoryTTL = 30 * time.Second
+
+// AccountVehicles are the vehicles an address owns and the ones shared with it, or those of several addresses
+type AccountVehicles struct {
+	Owned  []Vehicle
+	Shared []Vehicle
+}
+
+type vehicleDirectoryEntry struct {
+	vehicles  AccountVehicles
+	expiresAt time.Time
+}
+
+// VehicleDirectory caches the owned and shared vehicles per address. Concurrent lookups of the same address
+// share a single pair of identity API queries.
+type VehicleDirectory struct {
+	ttl     time.Duration
+	mu      sync.Mutex
+	entries map[string]vehicleDirectoryEntry
+	// generation changes on every invalidation, lookups started before it don't get cached
+	generation uint64
+	lookups    singleflight.Group
+}
+
+func NewVehicleDirectory(ttl time.Duration) *VehicleDirectory {
+	return &VehicleDirectory{ttl: ttl, entries: make(map[string]vehicleDirectoryEntry)}
+}
+
+// Vehicles is the directory every view looks vehicles up in
+var Vehicles = NewVehicleDirectory(vehicleDirectoryTTL)
+
+// Lookup returns the vehicles of the address. The slices are copies, callers may sort or annotate them.
+func (d *VehicleDirectory) Lookup(ethAddress string, settings *config.Settings) (AccountVehicles, error) {
+	key := strings.ToLower(ethAddress)
+
+	d.mu.Lock()
+	entry, ok := d.entries[key]
+	generation := d.generation
+	d.mu.Unlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.vehicles.clone(), nil
+	}
+
+	result, err, _ := d.lookups.Do(key, func() (any, error) {
+		vehicles, err := fetchAccountVehicles(ethAddress, settings)
+		if err != nil {
+			return AccountVehicles{}, err
+		}
+
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.generation == generation {
+			d.pruneLocked()
+			d.entries[key] = vehicleDirectoryEntry{vehicles: vehicles, expiresAt: time.Now().Add(d.ttl)}
+		}
+		return vehicles, nil
+	})
+	if err != nil {
+		return AccountVehicles{}, err
+	}
+	return result.(AccountVehicles).clone(), nil
+}
+
+// LookupAll returns the vehicles of every address, a vehicle any of them owns is listed as owned. A vehicle shared with
+// several of them is listed once, from the address holding the most privileges on it, as a privilege token is exchanged
+// by a single address.
+func (d *VehicleDirectory) LookupAll(ethAddresses []string, settings *config.Settings) (AccountVehicles, error) {
+	if len(ethAddresses) == 1 {
+		return d.Lookup(ethAddresses[0], settings)
+	}
+
+	results := make([]AccountVehicles, len(ethAddresses))
+	group := errgroup.Group{}
+	for i, ethAddress := range ethAddresses {
+		group.Go(func() error {
+			vehicles, err := d.Lookup(ethAddress, settings)
+			results[i] = vehicles
+			return err
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return AccountVehicles{}, err
+	}
+
+	merged := AccountVehicles{Owned: []Vehicle{}, Shared: []Vehicle{}}
+	owned := map[int64]bool{}
+	for _, result := range results {
+		for _, vehicle := range result.Owned {
+			if !owned[vehicle.TokenID] {
+				owned[vehicle.TokenID] = true
+				merged.Owned = append(merged.Owned, vehicle)
+			}
+		}
+	}
+	now := time.Now()
+	shared := map[int64]int{}
+	for _, result := range results {
+		for _, vehicle := range result.Shared {
+			if owned[vehicle.TokenID] {
+				continue
+			}
+			i, found := shared[vehicle.TokenID]
+			if !found {
+				shared[vehicle.TokenID] = len(merged.Shared)
+				merged.Shared = append(merged.Shared, vehicle)
+			} else if len(vehicle.ActivePrivileges(now)) > len(merged.Shared[i].ActivePrivileges(now)) {
+				merged.Shared[i] = vehicle
+			}
+		}
+	}
+	return merged, nil
+}
+
+// Invalidate drops the cached vehicles of the address, the next lookup queries the identity API
+func (d *VehicleDirectory) Invalidate(ethAddress string) {
+	key := strings.ToLower(ethAddress)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.entries, key)
+	d.generation++
+	// later lookups must not join a query that started before the invalidation
+	d.lookups.Forget(key)
+}
+
+// InvalidateAll drops every cached address
+func (d *VehicleDirectory) InvalidateAll() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	clear(d.entries)
+	d.generation++
+}
+
+// pruneLocked drops the expired entries so addresses that stopped visiting don't stay in memory
+func (d *VehicleDirectory) pruneLocked() {
+	now := time.Now()
+	for key, entry := range d.entries {
+		if now.After(entry.expiresAt) {
+			delete(d.entries, key)
+		}
+	}
+}
+
+func (a AccountVehicles) clone() AccountVehicles {
+	return AccountVehicles{Owned: slices.Clone(a.Owned), Shared: slices.Clone(a.Shared)}
+}
+
+// All returns the owned vehicles followed by the shared ones
+func (a AccountVehicles) All() []Vehicle {
+	return append(slices.Clone(a.Owned), a.Shared...)
+}
+
+// fetchAccountVehicles queries the owned and shared vehicles in parallel
+func fetchAccountVehicles(ethAddress string, settings *config.Settings) (AccountVehicles, error) {
+	vehicles := AccountVehicles{}
+	group := errgroup.Group{}
+	group.Go(func() error {
+		owned, err := QueryIdentityAPIForVehicles(ethAddress, settings)
+		vehicles.Owned = owned
+		return err
+	})
+	group.Go(func() error {
+		shared, err := QuerySharedVehicles(ethAddress, settings)
+		vehicles.Shared = shared
+		return err
+	})
+	if err := group.Wait(); err != nil {
+		return AccountVehicles{}, err
+	}
+	for i := range vehicles.Owned {
+		vehicles.Owned[i].AccessAddress = ethAddress
+	}
+	for i := range vehicles.Shared {
+		vehicles.Shared[i].AccessAddress = ethAddress
+	}
+	return vehicles, nil
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+const defaultVehiclesPerPage = 25
+
+// VehiclesPerPageOptions are the page sizes offered on the vehicles page
+var VehiclesPerPageOptions = []int{10, 25, 50, 100}
+
+// VehicleSortKeys are the fields the vehicles page can be sorted by
+var VehicleSortKeys = map[string]func(a, b Vehicle) int{
+	"tokenId": func(a, b Vehicle) int {
+		return cmp.Compare(a.TokenID, b.TokenID)
+	},
+	"make": func(a, b Vehicle) int {
+		return cmp.Compare(strings.ToLower(a.Definition.Make), strings.ToLower(b.Definition.Make))
+	},
+	"model": func(a, b Vehicle) int {
+		return cmp.Compare(strings.ToLower(a.Definition.Model), strings.ToLower(b.Definition.Model))
+	},
+	"year": func(a, b Vehicle) int {
+		return cmp.Compare(a.Definition.Year, b.Definition.Year)
+	},
+}
+
+// SearchVehicles keeps the vehicles matching every word of the search in their make, model, year or device serial
+func SearchVehicles(vehicles []Vehicle, search string) []Vehicle {
+	terms := strings.Fields(strings.ToLower(search))
+	if len(terms) == 0 {
+		return vehicles
+	}
+
+	matches := []Vehicle{}
+	for _, vehicle := range vehicles {
+		fields := strings.ToLower(strings.Join([]string{
+			vehicle.Definition.Make,
+			vehicle.Definition.Model,
+			strconv.Itoa(vehicle.Definition.Year),
+			vehicle.AftermarketDevice.Serial,
+		}, " "))
+		if !slices.ContainsFunc(terms, func(term string) bool { return !strings.Contains(fields, term) }) {
+			matches = append(matches, vehicle)
+		}
+	}
+	return matches
+}
+
+// SortVehicles sorts in place by one of VehicleSortKeys, ties keep token ID order
+func SortVehicles(vehicles []Vehicle, key string, descending bool) {
+	compare, ok := VehicleSortKeys[key]
+	if !ok {
+		compare = VehicleSortKeys["tokenId"]
+	}
+	slices.SortStableFunc(vehicles, func(a, b Vehicle) int {
+		result := compare(a, b)
+		if result == 0 {
+			return cmp.Compare(a.TokenID, b.TokenID)
+		}
+		if descending {
+			return -result
+		}
+		return result
+	})
+}
+
+// VehiclePage is one page of a vehicle list
+type VehiclePage struct {
+	Vehicles   []Vehicle
+	Page       int
+	TotalPages int
+	Total      int
+}
+
+// PaginateVehicles returns the requested page, clamped to the pages that exist
+func PaginateVehicles(vehicles []Vehicle, page, perPage int) VehiclePage {
+	if perPage <= 0 {
+		perPage = defaultVehiclesPerPage
+	}
+	totalPages := max(1, (len(vehicles)+perPage-1)/perPage)
+	page = min(max(page, 1), totalPages)
+
+	start := (page - 1) * perPage
+	end := min(start+perPage, len(vehicles))
+	return VehiclePage{
+		Vehicles:   vehicles[start:end],
+		Page:       page,
+		TotalPages: totalPages,
+		Total:      len(vehicles),
+	}
+}
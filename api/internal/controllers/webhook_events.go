@@ -0,0 +1,299 @@
+package controllers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// WebhookSignatureHeader carries the hex HMAC-SHA256 of the raw body, optionally prefixed with "sha256="
+	WebhookSignatureHeader = "X-Signature"
+
+	// maxWebhookEventsPerVehicle caps the inbox, oldest events are dropped first
+	maxWebhookEventsPerVehicle = 200
+)
+
+// WebhookEvent is a webhook call received from DIMO
+type WebhookEvent struct {
+	ID          string            `json:"id"`
+	TokenID     int64             `json:"tokenId"`
+	Type        string            `json:"type"`
+	Payload     json.RawMessage   `json:"payload"`
+	Headers     map[string]string `json:"headers"`
+	ContentType string            `json:"contentType"`
+	ReceivedAt  time.Time         `json:"receivedAt"`
+}
+
+// WebhookEventFilter narrows down the inbox. Zero values match everything.
+type WebhookEventFilter struct {
+	TokenID int64
+	Type    string
+	// Query is matched case-insensitively against the raw payload
+	Query string
+}
+
+// WebhookEventStore keeps the received events per vehicle, in memory
+type WebhookEventStore struct {
+	mu     sync.RWMutex
+	events map[int64][]WebhookEvent
+}
+
+var WebhookEvents = NewWebhookEventStore()
+
+func NewWebhookEventStore() *WebhookEventStore {
+	return &WebhookEventStore{events: make(map[int64][]WebhookEvent)}
+}
+
+func (s *WebhookEventStore) Add(event WebhookEvent) WebhookEvent {
+	event.ID = uuid.New().String()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	events := append(s.events[event.TokenID], event)
+	if len(events) > maxWebhookEventsPerVehicle {
+		events = events[len(events)-maxWebhookEventsPerVehicle:]
+	}
+	s.events[event.TokenID] = events
+
+	return event
+}
+
+func (s *WebhookEventStore) Get(id string) (WebhookEvent, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, events := range s.events {
+		for _, event := range events {
+			if event.ID == id {
+				return event, true
+			}
+		}
+	}
+	return WebhookEvent{}, false
+}
+
+// List returns the events of the given vehicles matching the filter, newest first
+func (s *WebhookEventStore) List(tokenIDs map[int64]bool, filter WebhookEventFilter, limit int) []WebhookEvent {
+	query := strings.ToLower(filter.Query)
+
+	s.mu.RLock()
+	matching := make([]WebhookEvent, 0)
+	for tokenID, events := range s.events {
+		if !tokenIDs[tokenID] || (filter.TokenID != 0 && filter.TokenID != tokenID) {
+			continue
+		}
+		for _, event := range events {
+			if filter.Type != "" && event.Type != filter.Type {
+				continue
+			}
+			if query != "" && !strings.Contains(strings.ToLower(string(event.Payload)), query) {
+				continue
+			}
+			matching = append(matching, event)
+		}
+	}
+	s.mu.RUnlock()
+
+	sort.Slice(matching, func(i, j int) bool {
+		return matching[i].ReceivedAt.After(matching[j].ReceivedAt)
+	})
+	if len(matching) > limit {
+		matching = matching[:limit]
+	}
+	return matching
+}
+
+// Types returns the distinct event types received for the given vehicles, for the inbox filter
+func (s *WebhookEventStore) Types(tokenIDs map[int64]bool) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	seen := make(map[string]bool)
+	types := make([]string, 0)
+	for tokenID, events := range s.events {
+		if !tokenIDs[tokenID] {
+			continue
+		}
+		for _, event := range events {
+			if event.Type != "" && !seen[event.Type] {
+				seen[event.Type] = true
+				types = append(types, event.Type)
+			}
+		}
+	}
+	sort.Strings(types)
+	return types
+}
+
+// SignWebhookPayload returns the hex HMAC-SHA256 of the payload
+func SignWebhookPayload(secret string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhookSignature compares the signature header against the payload in constant time
+func VerifyWebhookSignature(secret string, payload []byte, signature string) bool {
+	signature = strings.TrimPrefix(strings.TrimSpace(signature), "sha256=")
+	got, err := hex.DecodeString(signature)
+	if err != nil || len(got) == 0 {
+		return false
+	}
+	want, _ := hex.DecodeString(SignWebhookPayload(secret, payload))
+	return hmac.Equal(got, want)
+}
+
+// ParseWebhookEvent pulls the vehicle and event type out of the payload. The vehicle is looked up as
+// tokenId, vehicleTokenId or a "did:...:<tokenId>" subject, at the top level or under data.
+func ParseWebhookEvent(payload []byte) (tokenID int64, eventType string, err error) {
+	var body map[string]any
+	if err := json.Unmarshal(payload, &body); err != nil {
+		return 0, "", fmt.Errorf("payload is not a JSON object")
+	}
+
+	candidates := []map[string]any{body}
+	if data, ok := body["data"].(map[string]any); ok {
+		candidates = append(candidates, data)
+	}
+
+	for _, candidate := range candidates {
+		if eventType == "" {
+			eventType = firstString(candidate, "type", "eventType", "event", "name")
+		}
+		if tokenID == 0 {
+			tokenID = tokenIDFromFields(candidate)
+		}
+	}
+
+	return tokenID, eventType, nil
+}
+
+func firstString(fields map[string]any, keys ...string) string {
+	for _, key := range keys {
+		if value, ok := fields[key].(string); ok && value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func tokenIDFromFields(fields map[string]any) int64 {
+	for _, key := range []string{"tokenId", "vehicleTokenId", "tokenID"} {
+		switch value := fields[key].(type) {
+		case float64:
+			return int64(value)
+		case string:
+			if id, err := strconv.ParseInt(value, 10, 64); err == nil {
+				return id
+			}
+		}
+	}
+
+	// eg. did:erc721:137:0xbA5738a18d83D41847dfFbDC6101d37C69c9B0cF:12345
+	if subject, ok := fields["subject"].(string); ok {
+		if idx := strings.LastIndex(subject, ":"); idx >= 0 {
+			if id, err := strconv.ParseInt(subject[idx+1:], 10, 64); err == nil {
+				return id
+			}
+		}
+	}
+	return 0
+}
+
+// WebhookReplayResult is what the target answered to a replayed event
+type WebhookReplayResult struct {
+	Status     int    `json:"status"`
+	Body       string `json:"body"`
+	DurationMs int64  `json:"durationMs"`
+}
+
+// ReplayWebhookEvent POSTs the stored payload to the URL. Replays aren't signed: the URL is whatever the user typed,
+// and a signature made with the receiver secret would let it post the payload back to the receiver as if DIMO had.
+// Hosts in allowedHosts are reached whatever their address, without following redirects.
+func ReplayWebhookEvent(ctx context.Context, event WebhookEvent, targetURL string, allowedHosts map[string]bool) (*WebhookReplayResult, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, targetURL, bytes.NewReader(event.Payload))
+	if err != nil {
+		return nil, err
+	}
+	contentType := event.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Replayed-Event-ID", event.ID)
+
+	client := publicHTTPClient(10 * time.Second)
+	if allowedHosts[strings.ToLower(req.URL.Hostname())] {
+		client = &http.Client{
+			Timeout: 10 * time.Second,
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+	}
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return &WebhookReplayResult{
+		Status:     resp.StatusCode,
+		Body:       string(body),
+		DurationMs: time.Since(start).Milliseconds(),
+	}, nil
+}
+
+// publicHTTPClient only connects to public addresses, so URLs users enter can't reach the services next to the app or
+// the cloud metadata endpoint. The address is checked when dialing, after DNS resolution and for every redirect.
+func publicHTTPClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if !isPublicAddr(addr) {
+				return fmt.Errorf("%s is not a public address", addr)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// a proxy would dial the target itself, out of reach of the check
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// sharedAddressSpace is the carrier-grade NAT range, private in practice though netip doesn't count it as such
+var sharedAddressSpace = netip.MustParsePrefix("100.64.0.0/10")
+
+func isPublicAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	return addr.IsGlobalUnicast() && !addr.IsPrivate() && !sharedAddressSpace.Contains(addr)
+}
@@ -0,0 +1,183 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+)
+
+// Webhook is an event type the webhooks service can notify about
+type Webhook struct {
+	ID          string `json:"id"`
+	Description string `json:"description"`
+}
+
+// WebhookSubscription is a vehicle subscribed to a webhook event
+type WebhookSubscription struct {
+	EventID     string `json:"eventId"`
+	Description string `json:"description"`
+	CreatedAt   string `json:"createdAt,omitempty"`
+}
+
+// WebhookServiceError is a failed call to the webhooks service, mapped to the status we answer the browser with
+type WebhookServiceError struct {
+	Status  int
+	Message string
+}
+
+func (e *WebhookServiceError) Error() string {
+	return e.Message
+}
+
+// WebhooksClient calls the webhooks service on behalf of the user, so the browser never needs to reach it or hold the JWT
+type WebhooksClient struct {
+	baseURL string
+	client  *http.Client
+}
+
+func NewWebhooksClient(baseURL string) *WebhooksClient {
+	return &WebhooksClient{
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// ListWebhooks returns the event types that can be subscribed to
+func (w *WebhooksClient) ListWebhooks(ctx context.Context, accessToken string) ([]Webhook, error) {
+	var webhooks []Webhook
+	if err := w.do(ctx, http.MethodGet, "/webhooks", accessToken, &webhooks); err != nil {
+		return nil, err
+	}
+	for i := range webhooks {
+		webhooks[i].ID = strings.TrimSpace(webhooks[i].ID)
+	}
+	return webhooks, nil
+}
+
+func (w *WebhooksClient) ListSubscriptions(ctx context.Context, accessToken string, tokenID int64) ([]WebhookSubscription, error) {
+	// the service has used both snake case and Go field names for the event ID
+	var upstream []struct {
+		EventID       string `json:"event_id"`
+		LegacyEventID string `json:"EventID"`
+		Description   string `json:"description"`
+		CreatedAt     string `json:"created_at"`
+	}
+	if err := w.do(ctx, http.MethodGet, fmt.Sprintf("/subscriptions/%d", tokenID), accessToken, &upstream); err != nil {
+		return nil, err
+	}
+
+	subscriptions := make([]WebhookSubscription, 0, len(upstream))
+	for _, sub := range upstream {
+		eventID := sub.EventID
+		if eventID == "" {
+			eventID = sub.LegacyEventID
+		}
+		subscriptions = append(subscriptions, WebhookSubscription{
+			EventID:     strings.TrimSpace(eventID),
+			Description: sub.Description,
+			CreatedAt:   sub.CreatedAt,
+		})
+	}
+	return subscriptions, nil
+}
+
+func (w *WebhooksClient) Subscribe(ctx context.Context, accessToken string, tokenID int64, eventID string) error {
+	path := fmt.Sprintf("/subscriptions/%d/event/%s", tokenID, url.PathEscape(eventID))
+	return w.do(ctx, http.MethodPost, path, accessToken, nil)
+}
+
+func (w *WebhooksClient) Unsubscribe(ctx context.Context, accessToken string, tokenID int64, eventID string) error {
+	path := fmt.Sprintf("/subscriptions/%d/event/%s", tokenID, url.PathEscape(eventID))
+	return w.do(ctx, http.MethodDelete, path, accessToken, nil)
+}
+
+func (w *WebhooksClient) do(ctx context.Context, method, path, accessToken string, result any) error {
+	if w.baseURL == "" {
+		return &WebhookServiceError{Status: fiber.StatusServiceUnavailable, Message: "Webhooks service is not configured"}
+	}
+
+	var body io.Reader
+	if method == http.MethodPost {
+		body = strings.NewReader("{}")
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, w.baseURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", accessToken))
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return &WebhookServiceError{Status: fiber.StatusBadGateway, Message: "Webhooks service is unreachable"}
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return &WebhookServiceError{Status: fiber.StatusBadGateway, Message: "Error reading response from webhooks service"}
+	}
+
+	if resp.StatusCode >= 300 {
+		return normalizeWebhookError(resp.StatusCode, respBody)
+	}
+
+	if result == nil || len(respBody) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(respBody, result); err != nil {
+		return &WebhookServiceError{Status: fiber.StatusBadGateway, Message: "Invalid response from webhooks service"}
+	}
+	return nil
+}
+
+// normalizeWebhookError maps the upstream status onto the few cases the UI distinguishes
+func normalizeWebhookError(status int, body []byte) *WebhookServiceError {
+	switch status {
+	case http.StatusConflict:
+		return &WebhookServiceError{Status: fiber.StatusConflict, Message: "You are already subscribed to this event"}
+	case http.StatusNotFound:
+		return &WebhookServiceError{Status: fiber.StatusNotFound, Message: "Subscription or event not found"}
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &WebhookServiceError{Status: fiber.StatusForbidden, Message: "Not allowed to manage webhooks for this vehicle"}
+	case http.StatusBadRequest:
+		return &WebhookServiceError{Status: fiber.StatusBadRequest, Message: upstreamErrorMessage(body, "Invalid webhook request")}
+	}
+	return &WebhookServiceError{Status: fiber.StatusBadGateway, Message: "Webhooks service error: " + upstreamErrorMessage(body, http.StatusText(status))}
+}
+
+// upstreamErrorMessage pulls the message out of {"error": ...} or {"message": ...}, falling back to the raw body
+func upstreamErrorMessage(body []byte, fallback string) string {
+	var payload struct {
+		Error   string `json:"error"`
+		Message string `json:"message"`
+	}
+	if err := json.Unmarshal(body, &payload); err == nil {
+		if payload.Error != "" {
+			return payload.Error
+		}
+		if payload.Message != "" {
+			return payload.Message
+		}
+	}
+
+	text := strings.TrimSpace(string(body))
+	if text == "" {
+		return fallback
+	}
+	if len(text) > 200 {
+		text = text[:200]
+	}
+	return text
+}
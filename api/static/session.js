@@ -0,0 +1,115 @@
+// Warns before the session runs out and keeps it alive without leaving the page: "Stay signed in" extends it while it
+// can still be extended, after that the wallet signs a new challenge to renew it.
+(function () {
+    const pollInterval = 60 * 1000;
+    const warnBefore = 5 * 60 * 1000;
+
+    let banner;
+    let status;
+
+    function showBanner(text, action, actionLabel) {
+        if (!banner) {
+            banner = document.createElement('div');
+            banner.style.cssText = 'position:fixed;bottom:16px;left:50%;transform:translateX(-50%);z-index:1000;' +
+                'background:#1e1e1e;color:#fff;border:1px solid #555;border-radius:8px;padding:12px 16px;' +
+                'display:flex;gap:12px;align-items:center;font-size:14px;';
+            document.body.appendChild(banner);
+        }
+        banner.innerHTML = '';
+
+        const message = document.createElement('span');
+        message.innerText = text;
+        banner.appendChild(message);
+
+        if (action) {
+            const button = document.createElement('button');
+            button.innerText = actionLabel;
+            button.onclick = action;
+            banner.appendChild(button);
+        } else {
+            const link = document.createElement('a');
+            link.href = '/';
+            link.target = '_blank';
+            link.innerText = 'Sign in again in a new tab';
+            banner.appendChild(link);
+        }
+    }
+
+    function hideBanner() {
+        if (banner) {
+            banner.remove();
+            banner = null;
+        }
+    }
+
+    function minutesLeft(expiresAt) {
+        return Math.max(0, Math.round((new Date(expiresAt) - Date.now()) / 60000));
+    }
+
+    function checkSession() {
+        fetch('/api/session')
+            .then(response => response.json().then(data => ({ok: response.ok, data})))
+            .then(({ok, data}) => {
+                if (!ok) {
+                    showBanner('Your session has expired.', window.ethereum ? renewSession : null, 'Sign in with wallet');
+                    return;
+                }
+                status = data;
+                if (new Date(data.expiresAt) - Date.now() > warnBefore) {
+                    hideBanner();
+                    return;
+                }
+                const text = `Your session expires in ${minutesLeft(data.expiresAt)} min.`;
+                if (data.canExtend) {
+                    showBanner(text, extendSession, 'Stay signed in');
+                } else {
+                    showBanner(text, window.ethereum ? renewSession : null, 'Sign with wallet to stay signed in');
+                }
+            })
+            .catch(error => console.error('Failed to check session:', error));
+    }
+
+    function extendSession() {
+        fetch('/api/session/extend', {method: 'POST'})
+            .then(() => checkSession())
+            .catch(error => console.error('Failed to extend session:', error));
+    }
+
+    async function postJSON(url, body) {
+        const response = await fetch(url, {
+            method: 'POST',
+            headers: {'Content-Type': 'application/json'},
+            body: JSON.stringify(body),
+        });
+        const text = await response.text();
+        if (!response.ok) {
+            let message = text;
+            try {
+                message = JSON.parse(text).error || text;
+            } catch (e) {
+                // plain text error
+            }
+            throw new Error(message);
+        }
+        return JSON.parse(text);
+    }
+
+    async function renewSession() {
+        try {
+            const accounts = await window.ethereum.request({method: 'eth_requestAccounts'});
+            const address = (status && status.address) || accounts[0];
+            const challenge = await postJSON('/auth/web3/generate_challenge', {address});
+            const signature = await window.ethereum.request({
+                method: 'personal_sign',
+                params: [challenge.challenge, address],
+            });
+            await postJSON('/api/session/renew', {state: challenge.state, signature});
+            checkSession();
+        } catch (error) {
+            showBanner('Failed to renew session: ' + error.message, null);
+        }
+    }
+
+    checkSession();
+    setInterval(checkSession, pollInterval);
+})();
@@ -1,5 +1,12 @@
 import {html, LitElement, css} from 'lit'
 import {SettingsService} from "@services/settings-service";
+import {ApiService} from "@services/api-service";
+import {isLocalhost} from "@utils/utils";
+
+interface ChallengeResponse {
+    state: string,
+    challenge: string
+}
 
 export class LoginElement extends LitElement {
     static properties = {
@@ -7,11 +14,15 @@ export class LoginElement extends LitElement {
         token: {type: String},
         alertText: {type: String},
         loginUrl: {type: String},
+        authProvider: {type: String},
     }
     private loginBaseUrl: string;
     private loginUrl: string;
     private settings: SettingsService;
     private clientId: string;
+    private authProvider: string;
+    private alertText: string;
+    private apiService = ApiService.getInstance();
 
     constructor() {
         super();
@@ -19,6 +30,8 @@ export class LoginElement extends LitElement {
         this.loginUrl = '';
         this.settings = SettingsService.getInstance();
         this.clientId = '';
+        this.authProvider = '';
+        this.alertText = '';
     }
 
     async connectedCallback() {
@@ -27,6 +40,7 @@ export class LoginElement extends LitElement {
         const settings = await this.settings.fetchPublicSettings();
         this.clientId = settings?.clientId || ""
         this.loginBaseUrl = settings?.loginUrl || ""
+        this.authProvider = settings?.authProvider || "dimo"
 
         if (this.clientId.length === 42) {
             this.setupLoginUrl();
@@ -44,6 +58,14 @@ export class LoginElement extends LitElement {
     `
 
     render() {
+        if (this.authProvider === "local") {
+            return html`
+                <div class="grid place-items-center">
+                    <button class="login-with-dimo-link" @click=${this.signInWithWallet}>Sign in with wallet</button>
+                    <p ?hidden=${this.alertText === ""}>${this.alertText}</p>
+                </div>
+            `;
+        }
         return html`
             <div class="grid place-items-center" ?hidden=${this.loginUrl === ""}>
                 <a id="loginLink" href="${this.loginUrl}" class="login-with-dimo-link">Login with DIMO!</a>
@@ -55,6 +77,42 @@ export class LoginElement extends LitElement {
         `;
     }
 
+    // signs a Sign-In with Ethereum challenge from the backend with the browser wallet, the backend starts the session
+    async signInWithWallet() {
+        // @ts-ignore injected by the wallet extension
+        const ethereum = window.ethereum;
+        if (!ethereum) {
+            this.alertText = "No browser wallet found, install one to sign in.";
+            return;
+        }
+
+        try {
+            const accounts: string[] = await ethereum.request({method: "eth_requestAccounts"});
+            const address = accounts[0];
+
+            const challenge = await this.apiService.callApi<ChallengeResponse>("POST", "/auth/web3/generate_challenge", {address});
+            if (!challenge.success) {
+                this.alertText = `Failed to get a challenge: ${challenge.error}`;
+                return;
+            }
+
+            const signature = await ethereum.request({
+                method: "personal_sign",
+                params: [challenge.data!.challenge, address],
+            });
+
+            const submitted = await this.apiService.callApi("POST", "/auth/web3/submit_challenge", {state: challenge.data!.state, signature});
+            if (!submitted.success) {
+                this.alertText = `Failed to sign in: ${submitted.error}`;
+                return;
+            }
+
+            window.location.href = isLocalhost() ? "https://localdev.dimo.org:3007/vehicles/me" : "/vehicles/me";
+        } catch (error: any) {
+            this.alertText = `Failed to sign in: ${error.message || error}`;
+        }
+    }
+
     setupLoginUrl() {
         let redirectUrl = "";
         // Check if the hostname is "localhost" or "127.0.0.1"
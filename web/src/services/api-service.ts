@@ -64,7 +64,8 @@ export class ApiService {
         const finalUrl = this.constructUrl(endpoint);
 
         try {
-            const response = await fetch(finalUrl, {method, headers, body});
+            // the backend sets the session cookie, the dev server on another port has to accept it
+            const response = await fetch(finalUrl, {method, headers, body, credentials: "include"});
 
             const result = await this.processResponse(response);
 
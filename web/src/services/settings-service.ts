@@ -2,7 +2,8 @@ import {ApiService} from "@services/api-service.ts";
 
 export interface PublicSettings {
     "clientId": `0x${string}`,
-    "loginUrl": string
+    "loginUrl": string,
+    "authProvider": "dimo" | "local"
 }
 
 export interface PrivateSettings {